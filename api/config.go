@@ -0,0 +1,138 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/go-martini/martini"
+	eb "github.com/QubitProducts/bamboo/services/event_bus"
+	"github.com/QubitProducts/bamboo/services/history"
+)
+
+type ConfigAPI struct {
+	History  history.Storage
+	EventBus *eb.EventBus
+}
+
+// All lists the kept config history entries, oldest first
+func (c *ConfigAPI) All(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+
+	entries, err := c.History.All()
+	if err != nil {
+		responseError(w, err.Error())
+		return
+	}
+
+	responseJSON(w, entries)
+}
+
+// Diff shows the changes introduced by an entry. The entry is compared with
+// the one before it unless another entry id is given as ?against=
+func (c *ConfigAPI) Diff(params martini.Params, w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+
+	entry, content, err := c.History.Get(params["id"])
+	if err != nil {
+		responseHistoryError(w, err)
+		return
+	}
+
+	againstID := r.URL.Query().Get("against")
+	if againstID == "" {
+		againstID, err = c.previousID(entry.ID)
+		if err != nil {
+			responseError(w, err.Error())
+			return
+		}
+	}
+
+	againstContent := ""
+	if againstID != "" {
+		_, againstContent, err = c.History.Get(againstID)
+		if err != nil {
+			responseHistoryError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, fmt.Sprintf("--- %s\n+++ %s\n", againstID, entry.ID))
+	io.WriteString(w, history.Diff(againstContent, content))
+}
+
+// Rollback pins the config of an entry until it is unpinned
+func (c *ConfigAPI) Rollback(params martini.Params, w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+
+	err := c.History.Pin(params["id"])
+	if err != nil {
+		responseHistoryError(w, err)
+		return
+	}
+
+	entry, _, err := c.History.Pinned()
+	if err != nil {
+		responseError(w, err.Error())
+		return
+	}
+
+	c.EventBus.Publish(eb.ConfigEvent{EventType: "rollback"})
+	responseJSON(w, entry)
+}
+
+// Unpin goes back to rendering configs from the current state
+func (c *ConfigAPI) Unpin(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+
+	err := c.History.Unpin()
+	if err != nil {
+		responseError(w, err.Error())
+		return
+	}
+
+	c.EventBus.Publish(eb.ConfigEvent{EventType: "unpin"})
+	responseJSON(w, new(map[string]string))
+}
+
+func (c *ConfigAPI) enabled(w http.ResponseWriter) bool {
+	if c.History == nil {
+		http.Error(w, "Config history is disabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// Returns the id of the entry recorded right before id, or "" if it is the oldest
+func (c *ConfigAPI) previousID(id string) (string, error) {
+	entries, err := c.History.All()
+	if err != nil {
+		return "", err
+	}
+
+	previous := ""
+	for _, entry := range entries {
+		if entry.ID == id {
+			break
+		}
+		previous = entry.ID
+	}
+	return previous, nil
+}
+
+func responseHistoryError(w http.ResponseWriter, err error) {
+	if err == history.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	responseError(w, err.Error())
+}
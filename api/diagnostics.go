@@ -0,0 +1,14 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+)
+
+type DiagnosticsAPI struct{}
+
+// All lists the apps with invalid endpoint declarations or backend labels
+func (d *DiagnosticsAPI) All(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, diagnostics.All())
+}
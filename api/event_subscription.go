@@ -32,6 +32,7 @@ func (sub *EventSubscriptionAPI) Notify(payload []byte) {
 	if err != nil {
 		log.Printf("Unable to decode JSON Marathon Event request: %s \n", string(payload))
 	}
+	event.Payload = payload
 
 	sub.EventBus.Publish(event)
 }
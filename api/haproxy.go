@@ -0,0 +1,21 @@
+package api
+
+import (
+	"net/http"
+
+	eb "github.com/QubitProducts/bamboo/services/event_bus"
+)
+
+type HAProxyAPI struct{}
+
+// LastRejected shows the last rendered config refused by validation along
+// with the validator output
+func (h *HAProxyAPI) LastRejected(w http.ResponseWriter, r *http.Request) {
+	rejected := eb.LastRejectedConfig()
+	if rejected == nil {
+		http.Error(w, "No rejected config", http.StatusNotFound)
+		return
+	}
+
+	responseJSON(w, rejected)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/go-martini/martini"
+	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/rollout"
+)
+
+type RolloutAPI struct {
+	Rollouts rollout.Storage
+	Weights  application.Storage
+}
+
+// Body of a rollout creation
+type rolloutRequest struct {
+	Version  string `json:"version"`
+	Baseline string `json:"baseline"`
+	Steps    []int  `json:"steps"`
+	Dwell    int    `json:"dwell"`
+}
+
+// A rollout with where it stands
+type rolloutStatus struct {
+	rollout.Rollout
+	// Share of the traffic of the rolled out version
+	Percent int `json:"percent"`
+	// When the next step is taken, absent unless running
+	NextStepAt *time.Time `json:"nextStepAt,omitempty"`
+}
+
+func statusOf(r rollout.Rollout) rolloutStatus {
+	status := rolloutStatus{Rollout: r, Percent: r.Percent()}
+	if next := r.NextStepAt(); !next.IsZero() {
+		status.NextStepAt = &next
+	}
+	return status
+}
+
+func (a *RolloutAPI) All(rw http.ResponseWriter, r *http.Request) {
+	rollouts, err := a.Rollouts.All()
+	if err != nil {
+		responseError(rw, err.Error())
+		return
+	}
+
+	byId := make(map[string]rolloutStatus, len(rollouts))
+	for _, ro := range rollouts {
+		byId[ro.ID] = statusOf(ro)
+	}
+
+	responseJSON(rw, byId)
+}
+
+func (a *RolloutAPI) Get(params martini.Params, rw http.ResponseWriter, r *http.Request) {
+	ro, err := a.Rollouts.Get(appIdParam(params))
+	if err != nil {
+		responseRolloutError(rw, err)
+		return
+	}
+
+	responseJSON(rw, statusOf(ro))
+}
+
+func (a *RolloutAPI) Create(params martini.Params, rw http.ResponseWriter, r *http.Request) {
+	id := appIdParam(params)
+	var request rolloutRequest
+	payload, _ := ioutil.ReadAll(r.Body)
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		responseError(rw, err.Error())
+		return
+	}
+
+	if request.Baseline == "" {
+		request.Baseline, err = a.currentBaseline(id, request.Version)
+		if err != nil {
+			responseError(rw, err.Error())
+			return
+		}
+	}
+
+	ro, err := rollout.New(id, request.Version, request.Baseline, request.Steps, request.Dwell)
+	if err != nil {
+		responseError(rw, err.Error())
+		return
+	}
+	err = rollout.Start(a.Rollouts, a.Weights, ro)
+	if err != nil {
+		responseError(rw, err.Error())
+		return
+	}
+
+	responseJSON(rw, statusOf(ro))
+}
+
+func (a *RolloutAPI) Delete(params martini.Params, rw http.ResponseWriter, r *http.Request) {
+	err := a.Rollouts.Delete(appIdParam(params))
+	if err != nil {
+		responseRolloutError(rw, err)
+		return
+	}
+
+	responseJSON(rw, new(map[string]string))
+}
+
+func (a *RolloutAPI) Pause(params martini.Params, rw http.ResponseWriter, r *http.Request) {
+	ro, err := rollout.Pause(a.Rollouts, appIdParam(params))
+	a.respond(rw, ro, err)
+}
+
+func (a *RolloutAPI) Resume(params martini.Params, rw http.ResponseWriter, r *http.Request) {
+	ro, err := rollout.Resume(a.Rollouts, appIdParam(params))
+	a.respond(rw, ro, err)
+}
+
+func (a *RolloutAPI) Abort(params martini.Params, rw http.ResponseWriter, r *http.Request) {
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Aborted through the API"
+	}
+	ro, err := rollout.Abort(a.Rollouts, a.Weights, appIdParam(params), reason)
+	a.respond(rw, ro, err)
+}
+
+func (a *RolloutAPI) respond(rw http.ResponseWriter, ro rollout.Rollout, err error) {
+	if err != nil {
+		responseRolloutError(rw, err)
+		return
+	}
+	responseJSON(rw, statusOf(ro))
+}
+
+// The baseline of a rollout defaults to the only other version weighted for
+// the app
+func (a *RolloutAPI) currentBaseline(id string, version string) (string, error) {
+	weights, err := a.Weights.All()
+	if err != nil {
+		return "", err
+	}
+	baseline := ""
+	for _, weight := range weights {
+		if weight.ID != id {
+			continue
+		}
+		for v := range weight.Versions {
+			if v == version {
+				continue
+			}
+			if baseline != "" {
+				return "", errors.New("Several versions are weighted, the rollout needs a baseline")
+			}
+			baseline = v
+		}
+	}
+	if baseline == "" {
+		return "", errors.New("No other version is weighted, the rollout needs a baseline")
+	}
+	return baseline, nil
+}
+
+// App ids hold slashes, they are matched by a ** route. Weights use app
+// ids without the leading slash
+func appIdParam(params martini.Params) string {
+	return strings.TrimPrefix(params["_1"], "/")
+}
+
+func responseRolloutError(rw http.ResponseWriter, err error) {
+	if err == rollout.ErrNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	responseError(rw, err.Error())
+}
@@ -3,7 +3,6 @@ package api
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -13,18 +12,13 @@ import (
 
 	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/go-martini/martini"
 	conf "github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/marathon_client"
 	"github.com/QubitProducts/bamboo/services/service"
 )
 
-const (
-	HttpDefaultTimeout = time.Second * 15
-)
-
 var (
-	MarathonUser      string
-	MarathonPassword  string
-	MarathonEndpoints []string
-	BambooEndpoint    string
+	MarathonConf   conf.Marathon
+	BambooEndpoint string
 )
 
 type ServiceAPI struct {
@@ -32,15 +26,8 @@ type ServiceAPI struct {
 	Storage service.Storage
 }
 
-// marathon call back urls
-type MarathonCallback struct {
-	CallbackUrls []string
-}
-
 func LoadConfig(config conf.Configuration) {
-	MarathonUser = config.Marathon.User
-	MarathonPassword = config.Marathon.Password
-	MarathonEndpoints = config.Marathon.Endpoints()
+	MarathonConf = config.Marathon
 	BambooEndpoint = config.Bamboo.Endpoint + "/api/marathon/event_callback"
 }
 
@@ -123,19 +110,23 @@ func responseError(w http.ResponseWriter, message string) {
 	http.Error(w, message, http.StatusBadRequest)
 }
 
+// How long a health check may wait for each request to Marathon
+const healthCheckTimeout = 2 * time.Second
+
+// Healthy once Marathon answers and, unless events come from the event
+// stream, Bamboo's event callback is registered, registering it if needed.
+// Marathon gets a single attempt so probes answer quickly.
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
-	var numEndpoint = len(MarathonEndpoints)
-	var numUnregisterd = 0
-	for _, marathonEnp := range MarathonEndpoints {
-		if registered := checkMarathonCallback(marathonEnp); !registered {
-			if err := registerMarathonEvent(marathonEnp); err != nil {
-				log.Println("healthcheck failed")
-				numUnregisterd++
-			}
+	client, err := marathon_client.Shared(MarathonConf)
+	if err == nil {
+		if MarathonConf.UseEventStream {
+			_, err = client.Probe("GET", "/ping", healthCheckTimeout)
+		} else {
+			err = client.ProbeSubscription(BambooEndpoint, healthCheckTimeout)
 		}
 	}
-
-	if numUnregisterd == numEndpoint {
+	if err != nil {
+		log.Println("healthcheck failed:", err)
 		http.Error(w, "healthcheck failed", http.StatusInternalServerError)
 		return
 	}
@@ -148,82 +139,3 @@ func responseJSON(w http.ResponseWriter, data interface{}) {
 	bites, _ := json.Marshal(data)
 	w.Write(bites)
 }
-
-// register singla marathon event
-func registerMarathonEvent(marathonEnp string) error {
-	client := &http.Client{}
-	url := marathonEnp + "/v2/eventSubscriptions?callbackUrl=" + BambooEndpoint
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	if len(MarathonUser) > 0 && len(MarathonPassword) > 0 {
-		req.SetBasicAuth(MarathonUser, MarathonPassword)
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		errorMsg := "An error occurred while accessing Marathon callback system: %s\n"
-		log.Printf(errorMsg, err)
-		return err
-	}
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	body := string(bodyBytes)
-	if strings.HasPrefix(body, "{\"message") {
-		warningMsg := "Access to the callback system of Marathon seems to be failed, response: %s\n"
-		log.Printf(warningMsg, body)
-		return fmt.Errorf(warningMsg, body)
-	}
-
-	return nil
-}
-
-// check marathon eventSubscriptions whether container bamboo endpoint
-func checkMarathonCallback(marathonEnp string) bool {
-	client := &http.Client{
-		Timeout: HttpDefaultTimeout,
-	}
-
-	url := marathonEnp + "/v2/eventSubscriptions"
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Println("Check marathon eventSubscriptions got error: ", err)
-		return false
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Check marathon eventSubscriptions got error: ", err)
-		return false
-	}
-
-	if resp == nil || resp.StatusCode != http.StatusOK {
-		return false
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Println("Check marathon eventSubscriptions read resp body got error: ", err)
-		return false
-	}
-
-	var marathonCallbak MarathonCallback
-	if err := json.Unmarshal(body, &marathonCallbak); err != nil {
-		log.Println("Unmarshal marathon callback got error: ", err)
-		return false
-	}
-
-	for _, callbackUrl := range marathonCallbak.CallbackUrls {
-		if callbackUrl == BambooEndpoint {
-			return true
-		}
-	}
-
-	return false
-}
@@ -18,7 +18,6 @@ type StateAPI struct {
 }
 
 func (state *StateAPI) Get(w http.ResponseWriter, r *http.Request) {
-	templateData, _ := haproxy.GetTemplateData(state.Config, state.Storage, state.AppStorage)
-	payload, _ := json.Marshal(templateData)
+	payload, _ := json.Marshal(haproxy.LastTemplateData())
 	io.WriteString(w, string(payload))
 }
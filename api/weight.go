@@ -9,6 +9,8 @@ import (
 	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/go-martini/martini"
 	"github.com/QubitProducts/bamboo/configuration"
 	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/haproxy"
 )
 
 var (
@@ -42,6 +44,10 @@ func (w *WeightAPI) Put(rw http.ResponseWriter, r *http.Request) {
 		responseError(rw, err.Error())
 		return
 	}
+	if errs := haproxy.ValidateWeight(weight); len(errs) > 0 {
+		responseFieldErrors(rw, errs)
+		return
+	}
 
 	err = w.Storage.Upsert(weight)
 	if err != nil {
@@ -52,6 +58,23 @@ func (w *WeightAPI) Put(rw http.ResponseWriter, r *http.Request) {
 	responseJSON(rw, weight)
 }
 
+// Preview returns the server weights a weight would be applied as, without
+// storing it
+func (w *WeightAPI) Preview(rw http.ResponseWriter, r *http.Request) {
+	weight, err := parseBody(r)
+	if err != nil {
+		responseError(rw, err.Error())
+		return
+	}
+	if errs := haproxy.ValidateWeight(weight); len(errs) > 0 {
+		responseFieldErrors(rw, errs)
+		return
+	}
+
+	frontend, _ := haproxy.LookupFrontend(weight.ID)
+	responseJSON(rw, haproxy.CalcWeights(frontend, weight))
+}
+
 func (w *WeightAPI) Delete(params martini.Params, rw http.ResponseWriter, r *http.Request) {
 	id := params["id"]
 	err := w.Storage.Delete(id)
@@ -63,6 +86,17 @@ func (w *WeightAPI) Delete(params martini.Params, rw http.ResponseWriter, r *htt
 	responseJSON(rw, new(map[string]string))
 }
 
+// Answers 400 with the invalid fields
+func responseFieldErrors(rw http.ResponseWriter, errs []error) {
+	details := make([]diagnostics.Detail, len(errs))
+	for i, err := range errs {
+		details[i] = diagnostics.DetailOf(err)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(rw).Encode(map[string][]diagnostics.Detail{"errors": details})
+}
+
 func parseBody(r *http.Request) (application.Weight, error) {
 	var weight application.Weight
 	payload, _ := ioutil.ReadAll(r.Body)
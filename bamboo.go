@@ -1,17 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"path"
-	"strings"
 	"syscall"
 	"time"
 
@@ -23,8 +19,14 @@ import (
 	"github.com/QubitProducts/bamboo/configuration"
 	"github.com/QubitProducts/bamboo/qzk"
 	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/canary"
 	"github.com/QubitProducts/bamboo/services/event_bus"
+	"github.com/QubitProducts/bamboo/services/history"
+	"github.com/QubitProducts/bamboo/services/marathon_client"
+	"github.com/QubitProducts/bamboo/services/provider"
+	"github.com/QubitProducts/bamboo/services/rollout"
 	"github.com/QubitProducts/bamboo/services/service"
+	"github.com/QubitProducts/bamboo/services/sse"
 )
 
 /*
@@ -82,11 +84,26 @@ func main() {
 		log.Panicf("Failed to create application ZK storage: %v", err)
 	}
 
+	rolloutStorage, err := rollout.NewZKStorage(zkConn, conf.Bamboo.Zookeeper)
+	if err != nil {
+		log.Panicf("Failed to create rollout ZK storage: %v", err)
+	}
+	scheduler := &rollout.Scheduler{Rollouts: rolloutStorage, Weights: appStorage}
+	go scheduler.Run(nil)
+	if conf.Canary.Enabled {
+		go canary.NewMonitor(&conf, rolloutStorage, appStorage).Run(nil)
+	}
+
+	configHistory := createConfigHistory(conf.HAProxy)
+
 	// Register handlers
-	handlers := event_bus.Handlers{Conf: &conf, Storage: storage, AppStorage: appStorage}
+	handlers := event_bus.Handlers{Conf: &conf, Storage: storage, AppStorage: appStorage, History: configHistory}
 	eventBus.Register(handlers.MarathonEventHandler)
 	eventBus.Register(handlers.ServiceEventHandler)
 	eventBus.Register(handlers.WeightEventHandler)
+	eventBus.Register(handlers.ConfigEventHandler)
+	eventBus.Register(handlers.ProviderEventHandler)
+	registerStaticProviders(conf, zkConn, eventBus)
 	eventBus.Publish(event_bus.MarathonEvent{EventType: "bamboo_startup", Timestamp: time.Now().Format(time.RFC3339)})
 
 	// Handle gracefully exit
@@ -96,14 +113,18 @@ func main() {
 	api.LoadConfig(conf)
 
 	// Start server
-	initServer(&conf, storage, appStorage, eventBus)
+	initServer(&conf, storage, appStorage, rolloutStorage, configHistory, eventBus)
 }
 
-func initServer(conf *configuration.Configuration, storage service.Storage, appStorage application.Storage, eventBus *event_bus.EventBus) {
+func initServer(conf *configuration.Configuration, storage service.Storage, appStorage application.Storage, rolloutStorage rollout.Storage, configHistory history.Storage, eventBus *event_bus.EventBus) {
 	stateAPI := api.StateAPI{Config: conf, Storage: storage, AppStorage: appStorage}
 	serviceAPI := api.ServiceAPI{Config: conf, Storage: storage}
 	eventSubAPI := api.EventSubscriptionAPI{Conf: conf, EventBus: eventBus}
 	weightAPI := api.WeightAPI{Config: conf, Storage: appStorage}
+	rolloutAPI := api.RolloutAPI{Rollouts: rolloutStorage, Weights: appStorage}
+	haproxyAPI := api.HAProxyAPI{}
+	diagnosticsAPI := api.DiagnosticsAPI{}
+	configAPI := api.ConfigAPI{History: configHistory, EventBus: eventBus}
 
 	conf.StatsD.Increment(1.0, "restart", 1)
 	// Status live information
@@ -126,7 +147,25 @@ func initServer(conf *configuration.Configuration, storage service.Storage, appS
 		api.Get("/weight", weightAPI.All)
 		api.Post("/weight", weightAPI.Put)
 		api.Put("/weight", weightAPI.Put)
+		api.Post("/weight/preview", weightAPI.Preview)
 		api.Delete("/weight/:id", weightAPI.Delete)
+		// Rollout API, actions first as ** also matches them
+		api.Get("/rollouts", rolloutAPI.All)
+		api.Post("/rollouts/**/pause", rolloutAPI.Pause)
+		api.Post("/rollouts/**/resume", rolloutAPI.Resume)
+		api.Post("/rollouts/**/abort", rolloutAPI.Abort)
+		api.Get("/rollouts/**", rolloutAPI.Get)
+		api.Post("/rollouts/**", rolloutAPI.Create)
+		api.Delete("/rollouts/**", rolloutAPI.Delete)
+		// HAProxy API
+		api.Get("/haproxy/last-rejected", haproxyAPI.LastRejected)
+		// Diagnostics API
+		api.Get("/diagnostics", diagnosticsAPI.All)
+		// Config history API
+		api.Get("/config/history", configAPI.All)
+		api.Get("/config/history/:id/diff", configAPI.Diff)
+		api.Post("/config/rollback/:id", configAPI.Rollback)
+		api.Delete("/config/rollback", configAPI.Unpin)
 	})
 
 	// Static pages
@@ -150,33 +189,58 @@ func executableFolder() string {
 	return folderPath
 }
 
+// Default number of rendered configs kept when HAProxy.HistorySize is unset
+const defaultHistorySize = 20
+
+func createConfigHistory(conf configuration.HAProxy) history.Storage {
+	if conf.HistoryPath == "" {
+		return nil
+	}
+
+	size := conf.HistorySize
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	storage, err := history.NewDiskStorage(conf.HistoryPath, size)
+	if err != nil {
+		log.Panicf("Failed to create config history storage: %v", err)
+	}
+	return storage
+}
+
 func registerMarathonEvent(conf *configuration.Configuration) {
-	client := &http.Client{}
-	// it's safe to register with multiple marathon nodes
-	for _, marathon := range conf.Marathon.Endpoints() {
-		url := marathon + "/v2/eventSubscriptions?callbackUrl=" + conf.Bamboo.Endpoint + "/api/marathon/event_callback"
-		req, _ := http.NewRequest("POST", url, nil)
-		req.Header.Add("Content-Type", "application/json")
-		if len(conf.Marathon.User) > 0 && len(conf.Marathon.Password) > 0 {
-			req.SetBasicAuth(conf.Marathon.User, conf.Marathon.Password)
-		}
-		resp, err := client.Do(req)
+	client, err := marathon_client.Shared(conf.Marathon)
+	if err != nil {
+		log.Panicf("Failed to create Marathon client: %v", err)
+	}
+	// subscriptions are shared by all Marathon nodes, registering with the leader is enough
+	err = client.Subscribe(conf.Bamboo.Endpoint + "/api/marathon/event_callback")
+	if err != nil {
+		errorMsg := "An error occurred while accessing Marathon callback system: %s\n"
+		log.Printf(errorMsg, err)
+	}
+}
+
+// Routes the static backends of the configuration along with Marathon's
+func registerStaticProviders(conf configuration.Configuration, zkConn *zk.Conn, eventBus *event_bus.EventBus) {
+	if conf.Static.File != "" {
+		static, err := provider.WatchFile(conf.Static.File, conf.Static.PollDelay(), func() {
+			eventBus.Publish(event_bus.ProviderEvent{Provider: conf.Static.File, EventType: "change"})
+		})
 		if err != nil {
-			errorMsg := "An error occurred while accessing Marathon callback system: %s\n"
-			log.Printf(errorMsg, err)
-			return
+			log.Panicf("Failed to load static backends: %v", err)
 		}
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close()
+		provider.Register(static)
+	}
+
+	if conf.Static.ZkPath != "" {
+		static, err := provider.WatchZK(zkConn, conf.Static.ZkPath, func() {
+			eventBus.Publish(event_bus.ProviderEvent{Provider: conf.Static.ZkPath, EventType: "change"})
+		})
 		if err != nil {
-			log.Fatal(err)
-			return
-		}
-		body := string(bodyBytes)
-		if strings.HasPrefix(body, "{\"message") {
-			warningMsg := "Access to the callback system of Marathon seems to be failed, response: %s\n"
-			log.Printf(warningMsg, body)
+			log.Panicf("Failed to load static backends: %v", err)
 		}
+		provider.Register(static)
 	}
 }
 
@@ -220,64 +284,30 @@ func listenToZookeeper(conf configuration.Configuration, eventBus *event_bus.Eve
 	return serviceConn
 }
 
+// Listens to the event stream of the Marathon leader only, so each event
+// arrives once, and reconnects when the leader changes
 func listenToMarathonEventStream(conf *configuration.Configuration, sub api.EventSubscriptionAPI) {
-	client := &http.Client{}
-	client.Timeout = 0 * time.Second
-
-	for _, marathon := range conf.Marathon.Endpoints() {
-		ticker := time.NewTicker(1 * time.Second)
-		eventsURL := marathon + "/v2/events"
-		go func() {
-			for _ = range ticker.C {
-				req, err := http.NewRequest("GET", eventsURL, nil)
-				req.Header.Set("Accept", "text/event-stream")
-				if len(conf.Marathon.User) > 0 && len(conf.Marathon.Password) > 0 {
-					req.SetBasicAuth(conf.Marathon.User, conf.Marathon.Password)
-				}
-				if err != nil {
-					errorMsg := "An error occurred while creating request to Marathon events system: %s\n"
-					log.Printf(errorMsg, err)
-					continue
-				}
-
-				resp, err := client.Do(req)
-				if err != nil {
-					errorMsg := "An error occurred while making a request to Marathon events system: %s\n"
-					log.Printf(errorMsg, err)
-					continue
-				}
-
-				defer resp.Body.Close()
-
-				reader := bufio.NewReader(resp.Body)
-				for {
-					line, err := reader.ReadString('\n')
-					if err != nil {
-						if err != io.EOF {
-							errorMsg := "An error occurred while reading Marathon event: %s\n"
-							log.Printf(errorMsg, err)
-						}
-						break
-					}
-
-					if len(strings.TrimSpace(line)) == 0 {
-						continue
-					}
-
-					if !strings.HasPrefix(line, "data: ") {
-						errorMsg := "Wrong event format: %s\n"
-						log.Printf(errorMsg, line)
-						continue
-					}
-
-					line = line[6:]
-					sub.Notify([]byte(line))
-				}
-
-				log.Println("Event stream connection was closed. Re-opening...")
-			}
-		}()
+	client, err := marathon_client.Shared(conf.Marathon)
+	if err != nil {
+		log.Panicf("Failed to create Marathon client: %v", err)
+	}
+	stream := &sse.Stream{
+		Connect:     client.OpenEventStream,
+		IdleTimeout: conf.Marathon.EventStreamIdleDelay(),
+		OnEvent: func(event sse.Event) {
+			sub.Notify([]byte(event.Data))
+		},
+		OnError: func(err error) {
+			errorMsg := "An error occurred with the Marathon events system: %s\n"
+			log.Printf(errorMsg, err)
+		},
+		OnReconnect: func() {
+			log.Println("Event stream connection was re-opened")
+			// Events may have been missed while disconnected
+			sub.EventBus.Publish(event_bus.MarathonEvent{EventType: "bamboo_stream_reconnect", Timestamp: time.Now().Format(time.RFC3339)})
+		},
 	}
+	go stream.Run(nil)
 }
 
 func configureLog() {
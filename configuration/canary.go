@@ -0,0 +1,38 @@
+package configuration
+
+import (
+	"time"
+)
+
+// Automatic abort of canary versions, comparing the HAProxy statistics of
+// their servers with those of the baseline version. Zero thresholds are
+// not checked
+type Canary struct {
+	Enabled bool
+	// Seconds between checks, defaults to 10
+	CheckInterval int
+	// HAProxy stats page in CSV, e.g. "http://localhost:9000/haproxy?stats;csv".
+	// HAProxy.AdminSocket is used when empty
+	StatsURL string
+	// Responses of the canary needed before its error rate and response
+	// time are judged
+	MinRequests int
+	// How much higher than the baseline's the share of 5xx responses of the
+	// canary may get, e.g. 0.05 for 5 points
+	MaxErrorRateIncrease float64
+	// How many times the baseline's average response time the canary's
+	// may get, e.g. 1.5
+	MaxResponseTimeRatio float64
+	// Failed health checks of the canary servers tolerated
+	MaxCheckFailures int
+}
+
+const defaultCanaryCheckInterval = 10 * time.Second
+
+// CheckDelay returns how often canaries are checked
+func (c Canary) CheckDelay() time.Duration {
+	if c.CheckInterval <= 0 {
+		return defaultCanaryCheckInterval
+	}
+	return time.Duration(c.CheckInterval) * time.Second
+}
@@ -2,10 +2,12 @@ package configuration
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 var logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
@@ -25,6 +27,12 @@ type Configuration struct {
 
 	// StatsD configuration
 	StatsD StatsD
+
+	// Backends outside of Marathon
+	Static Static
+
+	// Automatic canary abort
+	Canary Canary
 }
 
 /*
@@ -47,7 +55,20 @@ func FromFile(filePath string) (Configuration, error) {
 	setValueFromEnv(&conf.Marathon.Endpoint, "MARATHON_ENDPOINT")
 	setValueFromEnv(&conf.Marathon.User, "MARATHON_USER")
 	setValueFromEnv(&conf.Marathon.Password, "MARATHON_PASSWORD")
+	setValueFromEnv(&conf.Marathon.CACertFile, "MARATHON_CA_CERT_FILE")
+	setValueFromEnv(&conf.Marathon.ClientCertFile, "MARATHON_CLIENT_CERT_FILE")
+	setValueFromEnv(&conf.Marathon.ClientKeyFile, "MARATHON_CLIENT_KEY_FILE")
+	setValueFromEnv(&conf.Marathon.AuthToken, "MARATHON_AUTH_TOKEN")
+	setValueFromEnv(&conf.Marathon.AuthTokenFile, "MARATHON_AUTH_TOKEN_FILE")
+	setValueFromEnv(&conf.Marathon.ACSLoginURL, "MARATHON_ACS_LOGIN_URL")
+	setValueFromEnv(&conf.Marathon.ACSUid, "MARATHON_ACS_UID")
+	setValueFromEnv(&conf.Marathon.ACSPassword, "MARATHON_ACS_PASSWORD")
+	setValueFromEnv(&conf.Marathon.ACSPrivateKeyFile, "MARATHON_ACS_PRIVATE_KEY_FILE")
 	setBoolValueFromEnv(&conf.Marathon.UseEventStream, "MARATHON_USE_EVENT_STREAM")
+	setValueFromEnv(&conf.Marathon.TaskHealthPolicy, "MARATHON_TASK_HEALTH_POLICY")
+	setValueFromEnv(&conf.Marathon.VersionOrder, "MARATHON_VERSION_ORDER")
+	setListValueFromEnv(&conf.Marathon.EventTypes, "MARATHON_EVENT_TYPES")
+	setValueFromEnv(&conf.Marathon.AppIdFilter, "MARATHON_APP_ID_FILTER")
 
 	setValueFromEnv(&conf.Bamboo.Endpoint, "BAMBOO_ENDPOINT")
 	setValueFromEnv(&conf.Bamboo.Zookeeper.Host, "BAMBOO_ZK_HOST")
@@ -56,15 +77,61 @@ func FromFile(filePath string) (Configuration, error) {
 	setValueFromEnv(&conf.HAProxy.TemplatePath, "HAPROXY_TEMPLATE_PATH")
 	setValueFromEnv(&conf.HAProxy.OutputPath, "HAPROXY_OUTPUT_PATH")
 	setValueFromEnv(&conf.HAProxy.ReloadCommand, "HAPROXY_RELOAD_CMD")
+	setValueFromEnv(&conf.HAProxy.ReloadStrategy, "HAPROXY_RELOAD_STRATEGY")
+	setValueFromEnv(&conf.HAProxy.WeightStrategy, "HAPROXY_WEIGHT_STRATEGY")
+	setValueFromEnv(&conf.HAProxy.AdminSocket, "HAPROXY_ADMIN_SOCKET")
 	setValueFromEnv(&conf.HAProxy.ReloadValidationCommand, "HAPROXY_RELOAD_VALIDATION_CMD")
 	setValueFromEnv(&conf.HAProxy.ReloadCleanupCommand, "HAPROXY_RELOAD_CLEANUP_CMD")
+	setValueFromEnv(&conf.HAProxy.HistoryPath, "HAPROXY_HISTORY_PATH")
+
+	setValueFromEnv(&conf.Static.File, "STATIC_FILE")
+	setValueFromEnv(&conf.Static.ZkPath, "STATIC_ZK_PATH")
+
+	setBoolValueFromEnv(&conf.Canary.Enabled, "CANARY_ENABLED")
+	setValueFromEnv(&conf.Canary.StatsURL, "CANARY_STATS_URL")
 
 	setValueFromEnv(&conf.StatsD.Host, "STATSD_HOST")
 	setValueFromEnv(&conf.StatsD.Prefix, "STATSD_PREFIX")
 	setBoolValueFromEnv(&conf.StatsD.Enabled, "STATSD_ENABLED")
+	if err == nil {
+		err = conf.Validate()
+	}
 	return *conf, err
 }
 
+// Validate fails on settings naming an unknown policy, strategy or version
+// order, so a typo
+// stops Bamboo at startup instead of silently selecting the default
+func (config *Configuration) Validate() error {
+	settings := []struct {
+		name  string
+		value string
+		known []string
+	}{
+		{"Marathon.TaskHealthPolicy", config.Marathon.TaskHealthPolicy,
+			[]string{HealthPolicyRequireHealthy, HealthPolicyIgnore, HealthPolicyNoChecksHealthy}},
+		{"Marathon.VersionOrder", config.Marathon.VersionOrder, versionOrderNames()},
+		{"HAProxy.ReloadStrategy", config.HAProxy.ReloadStrategy,
+			[]string{ReloadStrategyCommand, ReloadStrategyHTTPAgent}},
+		{"HAProxy.WeightStrategy", config.HAProxy.WeightStrategy,
+			[]string{WeightStrategyHTTPAgent, WeightStrategyRuntimeAPI}},
+	}
+
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+		known := false
+		for _, value := range setting.known {
+			known = known || setting.value == value
+		}
+		if !known {
+			return fmt.Errorf("Unknown %s %q, expected one of %s", setting.name, setting.value, strings.Join(setting.known, ", "))
+		}
+	}
+	return nil
+}
+
 func setValueFromEnv(field *string, envVar string) {
 	env := os.Getenv(envVar)
 	if len(env) > 0 {
@@ -73,6 +140,14 @@ func setValueFromEnv(field *string, envVar string) {
 	}
 }
 
+func setListValueFromEnv(field *[]string, envVar string) {
+	env := os.Getenv(envVar)
+	if len(env) > 0 {
+		log.Printf("Using environment override %s=%s", envVar, env)
+		*field = strings.Split(env, ",")
+	}
+}
+
 func setBoolValueFromEnv(field *bool, envVar string) {
 	env := os.Getenv(envVar)
 	if len(env) > 0 {
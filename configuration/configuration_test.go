@@ -0,0 +1,44 @@
+package configuration
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidate(t *testing.T) {
+	Convey("#Validate", t, func() {
+		conf := Configuration{}
+
+		Convey("should accept defaults", func() {
+			So(conf.Validate(), ShouldBeNil)
+		})
+
+		Convey("should accept known names", func() {
+			conf.Marathon.TaskHealthPolicy = HealthPolicyRequireHealthy
+			conf.HAProxy.ReloadStrategy = ReloadStrategyHTTPAgent
+			conf.HAProxy.WeightStrategy = WeightStrategyRuntimeAPI
+			So(conf.Validate(), ShouldBeNil)
+		})
+
+		Convey("should reject a misspelled health policy", func() {
+			conf.Marathon.TaskHealthPolicy = "require-healty"
+			So(conf.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("should reject unknown strategies", func() {
+			conf.HAProxy.ReloadStrategy = "systemd"
+			So(conf.Validate(), ShouldNotBeNil)
+			conf.HAProxy.ReloadStrategy = ""
+			conf.HAProxy.WeightStrategy = "runtime"
+			So(conf.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("should only accept added version orders", func() {
+			conf.Marathon.VersionOrder = "calver"
+			So(conf.Validate(), ShouldNotBeNil)
+			AddVersionOrder("calver")
+			So(conf.Validate(), ShouldBeNil)
+		})
+	})
+}
@@ -8,4 +8,68 @@ type HAProxy struct {
 	ReloadCleanupCommand    string
 	IP                      string
 	Port                    string
+	// How HAProxy gets reloaded, "command" runs ReloadCommand and
+	// "http-agent" calls the agent at IP:Port
+	ReloadStrategy string
+	// How weights are applied, "http-agent" pushes them to the agent at
+	// IP:Port and "runtime-api" sets them over AdminSocket without reloading
+	WeightStrategy string
+	// HAProxy stats socket with admin level, see AdminSocketPath
+	AdminSocket string
+	// Number of server slots pre-allocated per backend, task changes are then
+	// applied over AdminSocket without reloading. 0 disables slots
+	ServerSlots int
+
+	// Directory keeping previously rendered configs, history is disabled when empty
+	HistoryPath string
+	// Number of rendered configs kept in HistoryPath
+	HistorySize int
+
+	// Backend settings of apps without BAMBOO_* labels for them
+	Backend Backend
+
+	// Address HAProxy binds the endpoints of each svcType to, e.g.
+	// {"pub": "0.0.0.0", "inner": "10.0.0.5"}. Endpoints of other svcTypes
+	// are left out. All endpoints bind every interface when empty
+	BindAddresses map[string]string
+}
+
+// Backend settings, zero values fall back to the defaults of the protocol
+type Backend struct {
+	// Load balancing algorithm, defaults to "roundrobin" for http and
+	// "leastconn" for tcp
+	Balance string
+	// Max connections per server, defaults to 10 for http and none for tcp
+	MaxConn int
+	// Server timeout in HAProxy time format, e.g. "30s". Defaults to the
+	// "defaults" section of the template
+	TimeoutServer string
+	// Cookie based stickiness for http, defaults to true
+	Sticky *bool
+	// Health check interval in HAProxy time format, defaults to "3000" (ms)
+	// for http and no checks for tcp
+	CheckInterval string
+}
+
+const (
+	// Runs HAProxy.ReloadCommand on the Bamboo host
+	ReloadStrategyCommand = "command"
+	// Asks the HAProxy agent at HAProxy.IP:HAProxy.Port to reload
+	ReloadStrategyHTTPAgent = "http-agent"
+
+	// Pushes weights to the HAProxy agent at HAProxy.IP:HAProxy.Port
+	WeightStrategyHTTPAgent = "http-agent"
+	// Sets weights through the runtime API on HAProxy.AdminSocket
+	WeightStrategyRuntimeAPI = "runtime-api"
+)
+
+const defaultAdminSocket = "/run/haproxy/admin.sock"
+
+// AdminSocketPath returns the admin stats socket, defaulting to the one set
+// up by the shipped template
+func (h HAProxy) AdminSocketPath() string {
+	if h.AdminSocket == "" {
+		return defaultAdminSocket
+	}
+	return h.AdminSocket
 }
@@ -1,7 +1,10 @@
 package configuration
 
 import (
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 /*
@@ -13,7 +16,134 @@ type Marathon struct {
 	User     string
 	Password string
 
+	// HTTPS endpoints: PEM CA certificates trusted besides the system ones,
+	// and a client certificate and key for mutual TLS
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+
+	// Bearer token sent instead of basic auth, or a file holding it which is
+	// read again when Marathon answers 401
+	AuthToken     string
+	AuthTokenFile string
+
+	// DC/OS ACS login, e.g. "https://leader.mesos/acs/api/v1/auth/login",
+	// with a password or a service account private key (PEM). The token is
+	// renewed when Marathon answers 401
+	ACSLoginURL       string
+	ACSUid            string
+	ACSPassword       string
+	ACSPrivateKeyFile string
+
 	UseEventStream bool
+
+	// Which tasks get traffic depending on their Marathon health checks, one
+	// of the HealthPolicy constants. Defaults to HealthPolicyNoChecksHealthy
+	TaskHealthPolicy string
+
+	// How the SRY_APP_VSN versions of an app are ordered, the oldest one is
+	// its primary version. One of the marathon.VersionOrder constants,
+	// defaults to "semver"
+	VersionOrder string
+
+	// Seconds between full resyncs of the cluster model, which is otherwise
+	// kept up to date from Marathon events. Defaults to 300
+	ResyncInterval int64
+
+	// Timeout in seconds of each request to Marathon, defaults to 10
+	RequestTimeout int64
+
+	// Reconnect the event stream after that many seconds without data or
+	// heartbeat, 0 keeps it open however quiet Marathon is
+	EventStreamIdleTimeout int64
+
+	// Marathon event types that trigger a HAProxy update, defaults to
+	// DefaultEventTypes. Bamboo's own events always do
+	EventTypes []string
+	// Glob matched against the app id of events about a single app, e.g.
+	// "/prod/*". Events about other apps don't trigger a HAProxy update
+	AppIdFilter string
+}
+
+// Marathon events that can change routing
+var DefaultEventTypes = []string{
+	"status_update_event",
+	"health_status_changed_event",
+	"api_post_event",
+	"app_terminated_event",
+	"deployment_success",
+	"deployment_failed",
+	"deployment_step_success",
+	"pod_created_event",
+	"pod_updated_event",
+	"pod_deleted_event",
+	"instance_changed_event",
+	"instance_health_changed_event",
+}
+
+const (
+	// Tasks must pass all their health checks, apps without checks get no traffic
+	HealthPolicyRequireHealthy = "require-healthy"
+	// Health checks are not taken into account
+	HealthPolicyIgnore = "ignore"
+	// Tasks must pass all their health checks, apps without checks get traffic
+	HealthPolicyNoChecksHealthy = "no-checks-healthy"
+)
+
+// Names Marathon.VersionOrder may take. The marathon package adds its
+// orders and those of marathon.RegisterVersionOrder, which configuration
+// can't import.
+var versionOrders = map[string]bool{}
+var versionOrdersLock sync.Mutex
+
+// AddVersionOrder makes Validate accept an order name for
+// Marathon.VersionOrder
+func AddVersionOrder(name string) {
+	versionOrdersLock.Lock()
+	defer versionOrdersLock.Unlock()
+	versionOrders[name] = true
+}
+
+// The version order names added so far, sorted
+func versionOrderNames() []string {
+	versionOrdersLock.Lock()
+	defer versionOrdersLock.Unlock()
+	names := make([]string, 0, len(versionOrders))
+	for name := range versionOrders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const defaultResyncInterval = 300 * time.Second
+
+func (m Marathon) ResyncDelay() time.Duration {
+	if m.ResyncInterval <= 0 {
+		return defaultResyncInterval
+	}
+	return time.Duration(m.ResyncInterval) * time.Second
+}
+
+const defaultRequestTimeout = 10 * time.Second
+
+func (m Marathon) RequestDelay() time.Duration {
+	if m.RequestTimeout <= 0 {
+		return defaultRequestTimeout
+	}
+	return time.Duration(m.RequestTimeout) * time.Second
+}
+
+func (m Marathon) EventStreamIdleDelay() time.Duration {
+	return time.Duration(m.EventStreamIdleTimeout) * time.Second
+}
+
+func (m Marathon) AllowedEventTypes() []string {
+	if len(m.EventTypes) == 0 {
+		return DefaultEventTypes
+	}
+	return m.EventTypes
 }
 
 func (m Marathon) Endpoints() []string {
@@ -0,0 +1,27 @@
+package configuration
+
+import (
+	"time"
+)
+
+// Static backends that aren't on Marathon, like databases or VMs. They are
+// listed in a JSON or YAML file, or a ZK node, and reloaded when it changes
+type Static struct {
+	// JSON or YAML file listing the backends
+	File string
+	// Seconds between checks of File for changes, defaults to 5
+	PollInterval int
+	// ZK node listing the backends in JSON or YAML, on the ensemble of
+	// Bamboo.Zookeeper
+	ZkPath string
+}
+
+const defaultStaticPollInterval = 5 * time.Second
+
+// PollDelay returns how often File is checked for changes
+func (s Static) PollDelay() time.Duration {
+	if s.PollInterval <= 0 {
+		return defaultStaticPollInterval
+	}
+	return time.Duration(s.PollInterval) * time.Second
+}
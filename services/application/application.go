@@ -3,6 +3,14 @@ package application
 type Weight struct {
 	ID       string         `param:"id" json:"id"`
 	Versions map[string]int `param:"versions" json:"versions"`
+	// Version getting the traffic of apps without Versions, instead of the
+	// oldest one
+	Primary string `param:"primary" json:"primary,omitempty"`
+	// Versions whose weight the canary check set to 0, and why
+	Aborted map[string]string `param:"aborted" json:"aborted,omitempty"`
+	// Requests matching a rule go to its version whatever the weights, the
+	// first matching rule wins
+	Rules []Rule `param:"rules" json:"rules,omitempty"`
 }
 
 type Storage interface {
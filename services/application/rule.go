@@ -0,0 +1,81 @@
+package application
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+)
+
+// Rule routes the http requests carrying a header or a cookie, or coming
+// from an address range, to a version. Exactly one of Header, Cookie and
+// Source is set.
+type Rule struct {
+	Version string `json:"version"`
+	// Header name, e.g. "X-Canary"
+	Header string `json:"header,omitempty"`
+	// Cookie name
+	Cookie string `json:"cookie,omitempty"`
+	// Value of the header or cookie, any value matches when empty
+	Value string `json:"value,omitempty"`
+	// Source address or CIDR range, e.g. "10.1.0.0/16"
+	Source string `json:"source,omitempty"`
+}
+
+var (
+	// Header and cookie names, tokens of RFC 7230
+	tokenPattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+	// Values are written to the HAProxy config unquoted
+	valuePattern = regexp.MustCompile(`^[^\s"'\\#]+$`)
+)
+
+// RuleError reports an invalid field of a rule
+type RuleError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("Invalid rule %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// Validate checks that the rule can be written to the HAProxy config
+func (r Rule) Validate() error {
+	if r.Version == "" {
+		return &RuleError{Field: "version", Reason: "a rule needs a version"}
+	}
+
+	set := 0
+	for _, field := range []string{r.Header, r.Cookie, r.Source} {
+		if field != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return &RuleError{Field: "header", Value: r.Header, Reason: "a rule matches exactly one of header, cookie or source"}
+	}
+
+	switch {
+	case r.Header != "" && !tokenPattern.MatchString(r.Header):
+		return &RuleError{Field: "header", Value: r.Header, Reason: "not a header name"}
+	case r.Cookie != "" && !tokenPattern.MatchString(r.Cookie):
+		return &RuleError{Field: "cookie", Value: r.Cookie, Reason: "not a cookie name"}
+	case r.Source != "" && r.Value != "":
+		return &RuleError{Field: "value", Value: r.Value, Reason: "source rules don't take a value"}
+	case r.Value != "" && !valuePattern.MatchString(r.Value):
+		return &RuleError{Field: "value", Value: r.Value, Reason: "spaces, quotes, backslashes and # aren't allowed"}
+	}
+	if r.Source != "" {
+		_, _, err := net.ParseCIDR(r.Source)
+		if err != nil && net.ParseIP(r.Source) == nil {
+			return &RuleError{Field: "source", Value: r.Source, Reason: "expected an address or a CIDR range"}
+		}
+	}
+	return nil
+}
+
+func (e *RuleError) Detail() diagnostics.Detail {
+	return diagnostics.Detail{Field: e.Field, Value: e.Value, Message: e.Error()}
+}
@@ -0,0 +1,275 @@
+package canary
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	conf "github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/haproxy"
+	"github.com/QubitProducts/bamboo/services/rollout"
+)
+
+// Canary is a version of an app taking part of its traffic next to a
+// baseline version
+type Canary struct {
+	ID       string
+	Version  string
+	Baseline string
+	// Whether a rollout drives the weights of the app
+	Rollout bool
+}
+
+// Counters of a version since its canary was first checked
+type counters struct {
+	responses     int64
+	errors5xx     int64
+	checkFailures int64
+	// Response times multiplied by the responses they average
+	weightedTime float64
+}
+
+func (c *counters) add(stats haproxy.VersionStats) {
+	c.responses += stats.Responses
+	c.errors5xx += stats.Errors5xx
+	c.checkFailures += stats.CheckFailures
+	c.weightedTime += stats.ResponseTime * float64(stats.Responses)
+}
+
+func (c counters) errorRate() float64 {
+	if c.responses == 0 {
+		return 0
+	}
+	return float64(c.errors5xx) / float64(c.responses)
+}
+
+func (c counters) responseTime() float64 {
+	if c.responses == 0 {
+		return 0
+	}
+	return c.weightedTime / float64(c.responses)
+}
+
+// Stats of a canary and of its baseline
+type window struct {
+	canary   counters
+	baseline counters
+}
+
+// Monitor aborts canaries doing worse than their baseline, see
+// conf.Canary for the thresholds. HAProxy counters are read every
+// CheckInterval and only what changed since the previous read counts, so
+// traffic from before the canary started is left out.
+type Monitor struct {
+	Conf     *conf.Configuration
+	Rollouts rollout.Storage
+	Weights  application.Storage
+	// Reads the HAProxy server stats
+	Stats func() ([]haproxy.ServerStats, error)
+	// Finds the frontend of an app
+	Frontend func(id string) (haproxy.Frontend, bool)
+
+	// Counters of the previous read, by backend and server
+	previous map[string]haproxy.ServerStats
+	// Windows of the current canaries
+	windows map[Canary]*window
+}
+
+// NewMonitor reads the stats from Canary.StatsURL, or from the admin socket
+func NewMonitor(config *conf.Configuration, rollouts rollout.Storage, weights application.Storage) *Monitor {
+	stats := haproxy.NewRuntimeClient(config.HAProxy.AdminSocketPath()).Stats
+	if config.Canary.StatsURL != "" {
+		stats = func() ([]haproxy.ServerStats, error) {
+			return haproxy.FetchStats(config.Canary.StatsURL)
+		}
+	}
+	return &Monitor{
+		Conf:     config,
+		Rollouts: rollouts,
+		Weights:  weights,
+		Stats:    stats,
+		Frontend: haproxy.LookupFrontend,
+	}
+}
+
+// Run checks the canaries every CheckInterval until stop is closed
+func (m *Monitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.Conf.Canary.CheckDelay())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := m.Check()
+			if err != nil {
+				log.Println("Unable to check canaries:", err)
+			}
+		}
+	}
+}
+
+// Check reads the stats once and aborts the canaries breaching a threshold
+func (m *Monitor) Check() error {
+	stats, err := m.Stats()
+	if err != nil {
+		return err
+	}
+	deltas := m.deltas(stats)
+
+	canaries, err := m.canaries()
+	if err != nil {
+		return err
+	}
+
+	windows := make(map[Canary]*window, len(canaries))
+	for _, c := range canaries {
+		frontend, ok := m.Frontend(c.ID)
+		if !ok {
+			continue
+		}
+		w, ok := m.windows[c]
+		if !ok {
+			// counters before the first read of the canary are not its own
+			w = &window{}
+		} else {
+			versions := haproxy.StatsByVersion(frontend, deltas)
+			w.canary.add(versions[c.Version])
+			w.baseline.add(versions[c.Baseline])
+		}
+
+		reason := judge(m.Conf.Canary, w)
+		if reason == "" {
+			windows[c] = w
+			continue
+		}
+		err = m.abort(c, reason)
+		if err != nil {
+			log.Printf("Unable to abort canary %s of %s: %s\n", c.Version, c.ID, err)
+			windows[c] = w
+		}
+	}
+	m.windows = windows
+	return nil
+}
+
+// Returns what each server counted since the previous read. Counters going
+// down, after a reload, count from zero.
+func (m *Monitor) deltas(stats []haproxy.ServerStats) []haproxy.ServerStats {
+	current := make(map[string]haproxy.ServerStats, len(stats))
+	deltas := make([]haproxy.ServerStats, 0, len(stats))
+	for _, s := range stats {
+		key := s.Backend + "/" + s.Server
+		current[key] = s
+		delta := s
+		if previous, ok := m.previous[key]; ok && s.Responses >= previous.Responses && s.Errors5xx >= previous.Errors5xx && s.CheckFailures >= previous.CheckFailures {
+			delta.Responses -= previous.Responses
+			delta.Errors5xx -= previous.Errors5xx
+			delta.CheckFailures -= previous.CheckFailures
+		}
+		deltas = append(deltas, delta)
+	}
+	m.previous = current
+	return deltas
+}
+
+// Finds the apps with a canary: those with a running or paused rollout,
+// and those with exactly two weighted versions, the lighter one being the
+// canary
+func (m *Monitor) canaries() ([]Canary, error) {
+	rollouts, err := m.Rollouts.All()
+	if err != nil {
+		return nil, err
+	}
+	weights, err := m.Weights.All()
+	if err != nil {
+		return nil, err
+	}
+
+	canaries := []Canary{}
+	rolledOut := map[string]bool{}
+	for _, r := range rollouts {
+		if !r.Active() {
+			continue
+		}
+		rolledOut[r.ID] = true
+		if percent := r.Percent(); percent > 0 && percent < 100 {
+			canaries = append(canaries, Canary{ID: r.ID, Version: r.Version, Baseline: r.Baseline, Rollout: true})
+		}
+	}
+
+	for _, weight := range weights {
+		if rolledOut[weight.ID] {
+			continue
+		}
+		weighted := []string{}
+		for version, w := range weight.Versions {
+			if w > 0 {
+				weighted = append(weighted, version)
+			}
+		}
+		if len(weighted) != 2 {
+			continue
+		}
+		light, heavy := weighted[0], weighted[1]
+		if weight.Versions[light] > weight.Versions[heavy] {
+			light, heavy = heavy, light
+		}
+		if weight.Versions[light] == weight.Versions[heavy] {
+			continue
+		}
+		canaries = append(canaries, Canary{ID: weight.ID, Version: light, Baseline: heavy})
+	}
+	return canaries, nil
+}
+
+// Returns why the canary of a window breaches the thresholds, empty if it
+// doesn't
+func judge(thresholds conf.Canary, w *window) string {
+	if thresholds.MaxCheckFailures > 0 && w.canary.checkFailures > int64(thresholds.MaxCheckFailures) {
+		return fmt.Sprintf("%d failed health checks, more than %d", w.canary.checkFailures, thresholds.MaxCheckFailures)
+	}
+	if w.canary.responses == 0 || w.canary.responses < int64(thresholds.MinRequests) {
+		return ""
+	}
+
+	canaryRate, baselineRate := w.canary.errorRate(), w.baseline.errorRate()
+	if thresholds.MaxErrorRateIncrease > 0 && canaryRate-baselineRate > thresholds.MaxErrorRateIncrease {
+		return fmt.Sprintf("5xx rate %.1f%% against %.1f%% for the baseline", canaryRate*100, baselineRate*100)
+	}
+
+	canaryTime, baselineTime := w.canary.responseTime(), w.baseline.responseTime()
+	if thresholds.MaxResponseTimeRatio > 0 && baselineTime > 0 && canaryTime > baselineTime*thresholds.MaxResponseTimeRatio {
+		return fmt.Sprintf("response time %.0fms against %.0fms for the baseline", canaryTime, baselineTime)
+	}
+	return ""
+}
+
+// Sends the traffic of the canary back to the baseline
+func (m *Monitor) abort(c Canary, reason string) error {
+	m.Conf.StatsD.Increment(1.0, "canary.abort", 1)
+	if c.Rollout {
+		_, err := rollout.Abort(m.Rollouts, m.Weights, c.ID, "Canary check: "+reason)
+		return err
+	}
+
+	log.Printf("Canary %s of %s aborted: %s\n", c.Version, c.ID, reason)
+	weights, err := m.Weights.All()
+	if err != nil {
+		return err
+	}
+	for _, weight := range weights {
+		if weight.ID != c.ID {
+			continue
+		}
+		weight.Versions[c.Baseline] += weight.Versions[c.Version]
+		weight.Versions[c.Version] = 0
+		if weight.Aborted == nil {
+			weight.Aborted = map[string]string{}
+		}
+		weight.Aborted[c.Version] = reason
+		return m.Weights.Upsert(weight)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package canary
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+	conf "github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/haproxy"
+	"github.com/QubitProducts/bamboo/services/rollout"
+)
+
+type memoryRollouts map[string]rollout.Rollout
+
+func (m memoryRollouts) All() ([]rollout.Rollout, error) {
+	all := []rollout.Rollout{}
+	for _, r := range m {
+		all = append(all, r)
+	}
+	return all, nil
+}
+
+func (m memoryRollouts) Get(id string) (rollout.Rollout, error) {
+	r, ok := m[id]
+	if !ok {
+		return r, rollout.ErrNotFound
+	}
+	return r, nil
+}
+
+func (m memoryRollouts) Upsert(r rollout.Rollout) error {
+	m[r.ID] = r
+	return nil
+}
+
+func (m memoryRollouts) Update(r rollout.Rollout) error {
+	return m.Upsert(r)
+}
+
+func (m memoryRollouts) Delete(id string) error {
+	delete(m, id)
+	return nil
+}
+
+type memoryWeights map[string]application.Weight
+
+func (m memoryWeights) All() ([]application.Weight, error) {
+	all := []application.Weight{}
+	for _, weight := range m {
+		all = append(all, weight)
+	}
+	return all, nil
+}
+
+func (m memoryWeights) Upsert(weight application.Weight) error {
+	m[weight.ID] = weight
+	return nil
+}
+
+func (m memoryWeights) Delete(id string) error {
+	delete(m, id)
+	return nil
+}
+
+var frontend = haproxy.Frontend{Name: "web-http-80", Servers: []haproxy.Server{
+	{Name: "srv1-v1-31000", Version: "v1"},
+	{Name: "srv2-v2-31001", Version: "v2"},
+}}
+
+// Server stats of the baseline v1 and the canary v2
+func serverStats(v1 haproxy.ServerStats, v2 haproxy.ServerStats) []haproxy.ServerStats {
+	v1.Backend, v1.Server = "web-http-80", "srv1-v1-31000"
+	v2.Backend, v2.Server = "web-http-80", "srv2-v2-31001"
+	return []haproxy.ServerStats{v1, v2}
+}
+
+func TestMonitor(t *testing.T) {
+	Convey("#Check", t, func() {
+		config := &conf.Configuration{Canary: conf.Canary{
+			MinRequests:          100,
+			MaxErrorRateIncrease: 0.05,
+			MaxResponseTimeRatio: 2,
+			MaxCheckFailures:     2,
+		}}
+		rollouts := memoryRollouts{}
+		weights := memoryWeights{}
+		var stats []haproxy.ServerStats
+		monitor := &Monitor{
+			Conf:     config,
+			Rollouts: rollouts,
+			Weights:  weights,
+			Stats:    func() ([]haproxy.ServerStats, error) { return stats, nil },
+			Frontend: func(id string) (haproxy.Frontend, bool) { return frontend, id == "/web" },
+		}
+
+		// The first read only sets the counters the canary is judged from
+		check := func(v1 haproxy.ServerStats, v2 haproxy.ServerStats) {
+			stats = serverStats(v1, v2)
+			So(monitor.Check(), ShouldBeNil)
+		}
+		check(haproxy.ServerStats{Responses: 5000, Errors5xx: 500}, haproxy.ServerStats{Responses: 1000, Errors5xx: 100})
+
+		Convey("With a weighted canary", func() {
+			weights.Upsert(application.Weight{ID: "/web", Versions: map[string]int{"v1": 90, "v2": 10}})
+			check(haproxy.ServerStats{Responses: 5000, Errors5xx: 500}, haproxy.ServerStats{Responses: 1000, Errors5xx: 100})
+
+			Convey("it should abort on a higher error rate since it started", func() {
+				check(haproxy.ServerStats{Responses: 6000, Errors5xx: 510}, haproxy.ServerStats{Responses: 1200, Errors5xx: 120})
+				So(weights["/web"].Versions, ShouldResemble, map[string]int{"v1": 100, "v2": 0})
+				So(weights["/web"].Aborted["v2"], ShouldEqual, "5xx rate 10.0% against 1.0% for the baseline")
+			})
+
+			Convey("it should wait for enough requests", func() {
+				check(haproxy.ServerStats{Responses: 6000, Errors5xx: 510}, haproxy.ServerStats{Responses: 1050, Errors5xx: 150})
+				So(weights["/web"].Versions["v2"], ShouldEqual, 10)
+			})
+
+			Convey("it should abort on slow responses", func() {
+				check(haproxy.ServerStats{Responses: 6000, ResponseTime: 20}, haproxy.ServerStats{Responses: 1200, ResponseTime: 50})
+				So(weights["/web"].Aborted["v2"], ShouldEqual, "response time 50ms against 20ms for the baseline")
+			})
+
+			Convey("it should abort on failed health checks", func() {
+				check(haproxy.ServerStats{Responses: 5000}, haproxy.ServerStats{Responses: 1000, CheckFailures: 3})
+				So(weights["/web"].Versions["v2"], ShouldEqual, 0)
+			})
+
+			Convey("it should count from zero after a reload", func() {
+				check(haproxy.ServerStats{Responses: 100}, haproxy.ServerStats{Responses: 100, Errors5xx: 20})
+				So(weights["/web"].Versions["v2"], ShouldEqual, 0)
+			})
+
+			Convey("it should count from zero when only the 5xx counter went down", func() {
+				check(haproxy.ServerStats{Responses: 6000, Errors5xx: 0}, haproxy.ServerStats{Responses: 1200, Errors5xx: 90})
+				So(weights["/web"].Versions["v2"], ShouldEqual, 0)
+			})
+
+			Convey("it should keep a healthy canary", func() {
+				check(haproxy.ServerStats{Responses: 6000, Errors5xx: 550}, haproxy.ServerStats{Responses: 1200, Errors5xx: 105})
+				So(weights["/web"].Versions["v2"], ShouldEqual, 10)
+				So(weights["/web"].Aborted, ShouldBeNil)
+			})
+		})
+
+		Convey("With a rollout", func() {
+			r, _ := rollout.New("/web", "v2", "v1", []int{10, 100}, 60)
+			rollout.Start(rollouts, weights, r)
+			check(haproxy.ServerStats{Responses: 5000, Errors5xx: 500}, haproxy.ServerStats{Responses: 1000, Errors5xx: 100})
+
+			Convey("it should abort the rollout and record why", func() {
+				check(haproxy.ServerStats{Responses: 6000, Errors5xx: 510}, haproxy.ServerStats{Responses: 1200, Errors5xx: 120})
+				So(rollouts["/web"].State, ShouldEqual, rollout.StateAborted)
+				So(rollouts["/web"].Reason, ShouldStartWith, "Canary check: 5xx rate")
+				So(weights["/web"].Versions, ShouldResemble, map[string]int{"v1": 100, "v2": 0})
+			})
+
+			Convey("it should leave the last step alone", func() {
+				finished := rollouts["/web"]
+				finished.Step = 1
+				finished.StepStartedAt = time.Now()
+				rollouts.Upsert(finished)
+				check(haproxy.ServerStats{Responses: 6000, Errors5xx: 510}, haproxy.ServerStats{Responses: 1200, Errors5xx: 120})
+				So(rollouts["/web"].State, ShouldEqual, rollout.StateRunning)
+			})
+		})
+	})
+}
@@ -0,0 +1,153 @@
+package diagnostics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sources of problems
+const (
+	// BB_DM_ENDPOINTS declarations, apps with invalid ones aren't routed
+	SourceEndpoints = "endpoints"
+	// BAMBOO_* backend labels, invalid ones fall back to their default
+	SourceLabels = "labels"
+	// Bind addresses and uris of endpoints, clashing ones aren't routed
+	SourceRoutes = "routes"
+	// Tasks without the port an endpoint routes to, only those tasks are left out
+	SourcePorts = "ports"
+	// Apps of the static file and ZK providers, invalid ones aren't routed
+	SourceStaticFile = "static-file"
+	SourceStaticZK   = "static-zk"
+	// Version routing rules of the weights, invalid ones are left out
+	SourceRules = "rules"
+)
+
+// Sources lists every source of problems
+var Sources = []string{SourceEndpoints, SourceLabels, SourceRoutes, SourcePorts, SourceStaticFile, SourceStaticZK, SourceRules}
+
+// Detail is a single invalid setting
+type Detail struct {
+	Field   string `json:"field,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// Errors providing a Detail are reported with their field and value
+type detailer interface {
+	Detail() Detail
+}
+
+// DetailOf describes an error
+func DetailOf(err error) Detail {
+	if d, ok := err.(detailer); ok {
+		return d.Detail()
+	}
+	return Detail{Message: err.Error()}
+}
+
+// Problem lists what is wrong with an app
+type Problem struct {
+	AppId  string   `json:"appId"`
+	Source string   `json:"source"`
+	Errors []Detail `json:"errors"`
+	// Whether the app is left out of the HAProxy config because of it
+	Skipped bool `json:"skipped"`
+	// When the problem was first seen
+	Since time.Time `json:"since"`
+
+	counted bool
+}
+
+// Source => app id => problem
+var problems = map[string]map[string]*Problem{}
+var lock sync.Mutex
+
+// Replace sets the problems of a source found by the latest pass, apps
+// missing from it are fixed
+func Replace(source string, errors map[string][]error, skipped bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous := problems[source]
+	current := make(map[string]*Problem, len(errors))
+	for appId, errs := range errors {
+		if len(errs) == 0 {
+			continue
+		}
+		details := make([]Detail, len(errs))
+		for i, err := range errs {
+			details[i] = DetailOf(err)
+		}
+
+		problem := &Problem{AppId: appId, Source: source, Errors: details, Skipped: skipped, Since: time.Now()}
+		if old, ok := previous[appId]; ok {
+			problem.Since = old.Since
+			problem.counted = old.counted
+		}
+		current[appId] = problem
+	}
+	problems[source] = current
+}
+
+// All returns the current problems ordered by app and source
+func All() []Problem {
+	lock.Lock()
+	defer lock.Unlock()
+
+	all := []Problem{}
+	for _, bySource := range problems {
+		for _, problem := range bySource {
+			all = append(all, *problem)
+		}
+	}
+	sort.Sort(byApp(all))
+	return all
+}
+
+// Counts returns the number of apps with problems per source
+func Counts() map[string]int {
+	lock.Lock()
+	defer lock.Unlock()
+
+	counts := map[string]int{}
+	for source, bySource := range problems {
+		counts[source] = len(bySource)
+	}
+	return counts
+}
+
+// TakeNew returns the problems that appeared since the last call
+func TakeNew() []Problem {
+	lock.Lock()
+	defer lock.Unlock()
+
+	taken := []Problem{}
+	for _, bySource := range problems {
+		for _, problem := range bySource {
+			if !problem.counted {
+				problem.counted = true
+				taken = append(taken, *problem)
+			}
+		}
+	}
+	sort.Sort(byApp(taken))
+	return taken
+}
+
+type byApp []Problem
+
+func (a byApp) Len() int {
+	return len(a)
+}
+
+func (a byApp) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a byApp) Less(i, j int) bool {
+	if a[i].AppId != a[j].AppId {
+		return a[i].AppId < a[j].AppId
+	}
+	return a[i].Source < a[j].Source
+}
@@ -0,0 +1,43 @@
+package diagnostics
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiagnostics(t *testing.T) {
+	Convey("#Replace", t, func() {
+		problems = map[string]map[string]*Problem{}
+		Replace(SourceEndpoints, map[string][]error{"/b": {errors.New("bad bind")}, "/ok": nil}, true)
+		Replace(SourceLabels, map[string][]error{"/a": {errors.New("bad label")}}, false)
+
+		Convey("should list the problems by app", func() {
+			all := All()
+			So(len(all), ShouldEqual, 2)
+			So(all[0].AppId, ShouldEqual, "/a")
+			So(all[0].Skipped, ShouldBeFalse)
+			So(all[1].Errors, ShouldResemble, []Detail{{Message: "bad bind"}})
+			So(Counts(), ShouldResemble, map[string]int{SourceEndpoints: 1, SourceLabels: 1})
+		})
+
+		Convey("should keep when a problem was first seen", func() {
+			since := All()[1].Since
+			Replace(SourceEndpoints, map[string][]error{"/b": {errors.New("still bad")}}, true)
+			So(All()[1].Since.Equal(since), ShouldBeTrue)
+		})
+
+		Convey("should forget fixed apps", func() {
+			Replace(SourceEndpoints, map[string][]error{}, true)
+			So(len(All()), ShouldEqual, 1)
+		})
+
+		Convey("should hand out new problems once", func() {
+			So(len(TakeNew()), ShouldEqual, 2)
+			So(len(TakeNew()), ShouldEqual, 0)
+			Replace(SourceEndpoints, map[string][]error{"/b": {errors.New("still bad")}}, true)
+			So(len(TakeNew()), ShouldEqual, 0)
+		})
+	})
+}
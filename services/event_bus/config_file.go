@@ -0,0 +1,110 @@
+package event_bus
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+// Path of the copy of the last config HAProxy reloaded successfully
+func lastGoodPath(configPath string) string {
+	return configPath + ".last-good"
+}
+
+// Writes content to a temporary file next to path and renames it into place,
+// so readers never observe a partially written config
+func writeConfigAtomic(path string, content string) (err error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	_, err = tmpFile.WriteString(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Chmod(tmpPath, 0666)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Writes a config HAProxy already runs, its weights or slots having been
+// applied at runtime, and keeps it as the last known good one so a rollback
+// doesn't restore stale weights
+func writeAppliedConfig(configPath string, content string) error {
+	err := writeConfigAtomic(configPath, content)
+	if err != nil {
+		return err
+	}
+	err = writeConfigAtomic(lastGoodPath(configPath), content)
+	if err != nil {
+		log.Println("Failed to keep a copy of the applied config:", err)
+	}
+	return nil
+}
+
+// Seeds the last known good copy from the config currently on disk, which is
+// what HAProxy is running, when no copy has been kept yet
+func ensureLastGoodConfig(configPath string) {
+	goodPath := lastGoodPath(configPath)
+	if _, err := os.Stat(goodPath); err == nil {
+		return
+	}
+
+	current, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return
+	}
+
+	err = writeConfigAtomic(goodPath, string(current))
+	if err != nil {
+		log.Println("Failed to keep a copy of the running config:", err)
+	}
+}
+
+// Restores the last known good config and reloads HAProxy with it
+func rollbackConfig(conf *configuration.Configuration) {
+	configPath := conf.HAProxy.OutputPath
+	goodContent, err := ioutil.ReadFile(lastGoodPath(configPath))
+	if err != nil {
+		log.Println("No last known good config to restore:", err)
+		conf.StatsD.Increment(1.0, "haproxy.rollback.unavailable", 1)
+		return
+	}
+
+	log.Println("Restoring last known good config")
+	err = writeConfigAtomic(configPath, string(goodContent))
+	if err != nil {
+		log.Println("Failed to restore last known good config:", err)
+		conf.StatsD.Increment(1.0, "haproxy.rollback.failed", 1)
+		return
+	}
+
+	err = reloadHAProxy(conf)
+	if err != nil {
+		log.Println("Failed to reload last known good config:", err)
+		conf.StatsD.Increment(1.0, "haproxy.rollback.failed", 1)
+		return
+	}
+
+	conf.StatsD.Increment(1.0, "haproxy.rollback.succeeded", 1)
+}
@@ -0,0 +1,62 @@
+package event_bus
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+// The app a Marathon event is about, if any
+type marathonEventApp struct {
+	AppId         string `json:"appId"`
+	AppDefinition struct {
+		Id string `json:"id"`
+	} `json:"appDefinition"`
+}
+
+func eventAppId(event MarathonEvent) string {
+	var app marathonEventApp
+	if json.Unmarshal(event.Payload, &app) != nil {
+		return ""
+	}
+	if app.AppId != "" {
+		return app.AppId
+	}
+	return app.AppDefinition.Id
+}
+
+// Tells whether a Marathon event may change routing, based on the configured
+// event types and app id filter
+func acceptEvent(conf configuration.Marathon, event MarathonEvent) bool {
+	if strings.HasPrefix(event.EventType, "bamboo_") {
+		return true
+	}
+
+	allowed := false
+	for _, eventType := range conf.AllowedEventTypes() {
+		if eventType == event.EventType {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	if conf.AppIdFilter == "" {
+		return true
+	}
+	appId := eventAppId(event)
+	if appId == "" {
+		return true
+	}
+	matched, err := path.Match(conf.AppIdFilter, appId)
+	if err != nil {
+		log.Println("Invalid Marathon.AppIdFilter:", err)
+		return true
+	}
+	return matched
+}
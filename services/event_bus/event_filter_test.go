@@ -0,0 +1,65 @@
+package event_bus
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+func TestAcceptEvent(t *testing.T) {
+	Convey("#acceptEvent", t, func() {
+		conf := configuration.Marathon{}
+
+		Convey("should accept routing events by default", func() {
+			So(acceptEvent(conf, MarathonEvent{EventType: "status_update_event"}), ShouldBeTrue)
+			So(acceptEvent(conf, MarathonEvent{EventType: "deployment_success"}), ShouldBeTrue)
+		})
+
+		Convey("should drop events that can't change routing by default", func() {
+			So(acceptEvent(conf, MarathonEvent{EventType: "subscribe_event"}), ShouldBeFalse)
+			So(acceptEvent(conf, MarathonEvent{EventType: "framework_message_event"}), ShouldBeFalse)
+		})
+
+		Convey("should always accept Bamboo's own events", func() {
+			conf.EventTypes = []string{"status_update_event"}
+			So(acceptEvent(conf, MarathonEvent{EventType: "bamboo_startup"}), ShouldBeTrue)
+		})
+
+		Convey("should only accept configured event types", func() {
+			conf.EventTypes = []string{"deployment_success"}
+			So(acceptEvent(conf, MarathonEvent{EventType: "status_update_event"}), ShouldBeFalse)
+			So(acceptEvent(conf, MarathonEvent{EventType: "deployment_success"}), ShouldBeTrue)
+		})
+
+		Convey("When an app id filter is configured", func() {
+			conf.AppIdFilter = "/prod/*"
+
+			Convey("it should accept events about matching apps", func() {
+				So(acceptEvent(conf, MarathonEvent{
+					EventType: "status_update_event",
+					Payload:   []byte(`{"appId":"/prod/web"}`),
+				}), ShouldBeTrue)
+				So(acceptEvent(conf, MarathonEvent{
+					EventType: "api_post_event",
+					Payload:   []byte(`{"appDefinition":{"id":"/prod/api"}}`),
+				}), ShouldBeTrue)
+			})
+
+			Convey("it should drop events about other apps", func() {
+				So(acceptEvent(conf, MarathonEvent{
+					EventType: "status_update_event",
+					Payload:   []byte(`{"appId":"/dev/web"}`),
+				}), ShouldBeFalse)
+			})
+
+			Convey("it should accept events not about a single app", func() {
+				So(acceptEvent(conf, MarathonEvent{
+					EventType: "deployment_success",
+					Payload:   []byte(`{"plan":{}}`),
+				}), ShouldBeTrue)
+			})
+		})
+	})
+}
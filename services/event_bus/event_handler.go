@@ -1,19 +1,20 @@
 package event_bus
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/QubitProducts/bamboo/configuration"
 	"github.com/QubitProducts/bamboo/services/application"
 	"github.com/QubitProducts/bamboo/services/haproxy"
+	"github.com/QubitProducts/bamboo/services/history"
+	"github.com/QubitProducts/bamboo/services/marathon"
 	"github.com/QubitProducts/bamboo/services/service"
 	"github.com/QubitProducts/bamboo/services/template"
 )
@@ -25,6 +26,8 @@ type MarathonEvent struct {
 	// api_post_event, status_update_event, subscribe_event
 	EventType string
 	Timestamp string
+	// Raw event JSON, applied to the Marathon cluster model
+	Payload []byte `json:"-"`
 }
 
 type ZookeeperEvent struct {
@@ -40,27 +43,66 @@ type WeightEvent struct {
 	EventType string
 }
 
+// ProviderEvent is published when a provider other than Marathon reloads
+// its apps
+type ProviderEvent struct {
+	Provider  string
+	EventType string
+}
+
+// ConfigEvent is published when the pinned config in the history changes
+type ConfigEvent struct {
+	EventType string
+}
+
 type Handlers struct {
 	Conf       *configuration.Configuration
 	Storage    service.Storage
 	AppStorage application.Storage
+	// Validator checks rendered configs before they are written,
+	// defaults to running HAProxy.ReloadValidationCommand
+	Validator Validator
+	// History keeps the applied configs, nil disables history
+	History history.Storage
 }
 
 func (h *Handlers) MarathonEventHandler(event MarathonEvent) {
 	log.Printf("%s => %s\n", event.EventType, event.Timestamp)
-	queueUpdate(h)
+	// The cluster model sees every event, only updates are filtered
+	marathon.ApplyEvent(event.EventType, event.Payload)
+	if !acceptEvent(h.Conf.Marathon, event) {
+		eventType := event.EventType
+		if eventType == "" {
+			eventType = "unknown"
+		}
+		h.Conf.StatsD.Increment(1.0, "callback.marathon.dropped."+eventType, 1)
+		return
+	}
+	queueUpdate(h, event.EventType)
 	h.Conf.StatsD.Increment(1.0, "callback.marathon", 1)
 }
 
 func (h *Handlers) ServiceEventHandler(event ServiceEvent) {
 	log.Println("Domain mapping: Stated changed")
-	queueUpdate(h)
+	queueUpdate(h, "service_"+event.EventType)
 	h.Conf.StatsD.Increment(1.0, "reload.domain", 1)
 }
 
+func (h *Handlers) ProviderEventHandler(event ProviderEvent) {
+	log.Println("Provider", event.Provider, "changed")
+	queueUpdate(h, "provider_"+event.EventType)
+	h.Conf.StatsD.Increment(1.0, "reload.provider", 1)
+}
+
+func (h *Handlers) ConfigEventHandler(event ConfigEvent) {
+	log.Println("Pinned config changed:", event.EventType)
+	queueUpdate(h, event.EventType)
+	h.Conf.StatsD.Increment(1.0, "reload.config", 1)
+}
+
 func (h *Handlers) WeightEventHandler(event WeightEvent) {
 	log.Println("Weight changed")
-	frontendMapJson, _ := json.Marshal(haproxy.FrontendMap)
+	frontendMapJson, _ := json.Marshal(haproxy.Frontends())
 	log.Println("frontendMap", string(frontendMapJson))
 
 	weights, err := h.AppStorage.All()
@@ -71,70 +113,122 @@ func (h *Handlers) WeightEventHandler(event WeightEvent) {
 	weightJson, _ := json.Marshal(weights)
 	log.Println("weight", string(weightJson))
 
-	for _, weight := range weights {
-		if frontend, ok := haproxy.FrontendMap[weight.ID]; ok {
-			servers := haproxy.CalcWeights(frontend, weight)
-			updateWeight(h.Conf, servers)
-		}
+	// rules change the frontends, which only a reload applies
+	if rulesChanged(weights) {
+		log.Println("Routing rules changed, reloading")
+		queueUpdate(h, "weight_"+event.EventType)
+		return
 	}
-	// save weight into config file for haproxy recovery
-	content, err := generateConfig(h)
+
+	updater, err := NewWeightUpdater(h.Conf.HAProxy)
 	if err != nil {
-		log.Println("can't generate config", err.Error())
+		log.Println("Error: can't update app weight", err.Error())
+		return
 	}
-	err = ioutil.WriteFile(h.Conf.HAProxy.OutputPath, []byte(content), 0666)
-	if err != nil {
-		log.Println("Failed to write template on path", h.Conf.HAProxy.OutputPath)
+
+	serversChanged, updateFailed := false, false
+	for _, weight := range weights {
+		if frontend, ok := haproxy.LookupFrontend(weight.ID); ok {
+			servers := haproxy.CalcWeights(frontend, weight)
+			err = updater.UpdateWeights(servers)
+			if err == ErrServersChanged {
+				serversChanged = true
+			} else if err != nil {
+				log.Println("Error: can't update app weight", weight.ID, err.Error())
+				h.Conf.StatsD.Increment(1.0, "haproxy.weight.error", 1)
+				updateFailed = true
+			}
+		}
 	}
-}
 
-func updateWeight(conf *configuration.Configuration, servers []map[string]interface{}) {
-	if len(servers) < 1 {
-		log.Println("empty servers")
+	// weights can't be applied to servers HAProxy doesn't run yet, and
+	// weights HAProxy didn't take must not reach the config file, or the
+	// next update would find nothing to reload
+	if serversChanged || updateFailed {
+		if serversChanged {
+			log.Println("Servers were added or removed, falling back to a full reload")
+		} else {
+			log.Println("Weights were not applied, falling back to a full reload")
+		}
+		h.Conf.StatsD.Increment(1.0, "haproxy.weight.reload", 1)
+		queueUpdate(h, "weight_"+event.EventType)
 		return
 	}
 
-	json, err := json.Marshal(servers)
+	// save weight into config file for haproxy recovery
+	if _, pinned := h.pinnedConfig(); pinned {
+		log.Println("Config is pinned, not saving weights into config file")
+		return
+	}
+	content, err := generateConfig(h)
 	if err != nil {
-		log.Println(err.Error())
-		log.Println("Error: can't update app weight")
+		log.Println("can't generate config", err.Error())
 		return
 	}
-	log.Println("serversJson", string(json))
-
-	client := &http.Client{}
-	addr := fmt.Sprintf("%s:%s/api/weight", conf.HAProxy.IP, conf.HAProxy.Port)
-	req, err := http.NewRequest("PUT", addr, bytes.NewBuffer(json))
-	req.Close = true
+	err = checkConfig(h.validator(), content)
 	if err != nil {
-		log.Println("Failed to creat new http request: ", err)
+		h.Conf.StatsD.Increment(1.0, "haproxy.validation.rejected", 1)
+		log.Println("Refusing to write rejected config", err.Error())
 		return
 	}
-	resp, err := client.Do(req)
+	err = writeAppliedConfig(h.Conf.HAProxy.OutputPath, content)
 	if err != nil {
-		log.Println("Http request failed: ", err)
+		log.Println("Failed to write template on path", h.Conf.HAProxy.OutputPath)
 		return
 	}
-	defer resp.Body.Close()
+	h.recordConfig("weight_"+event.EventType, content)
+}
+
+// Routing rules of the weights HAProxy runs with, by app id
+var appliedRules = map[string][]application.Rule{}
+var appliedRulesLock sync.Mutex
+
+// Returns the routing rules of the weights, by app id
+func weightRules(weights []application.Weight) map[string][]application.Rule {
+	rules := map[string][]application.Rule{}
+	for _, weight := range weights {
+		if len(weight.Rules) > 0 {
+			rules[weight.ID] = weight.Rules
+		}
+	}
+	return rules
+}
+
+// Tells whether the rules of the weights differ from those HAProxy runs with
+func rulesChanged(weights []application.Weight) bool {
+	appliedRulesLock.Lock()
+	defer appliedRulesLock.Unlock()
+	return !reflect.DeepEqual(weightRules(weights), appliedRules)
+}
 
-	log.Println("updated", string(json), resp.StatusCode)
+// Records the rules HAProxy runs with once their config is applied
+func setAppliedRules(rules map[string][]application.Rule) {
+	appliedRulesLock.Lock()
+	defer appliedRulesLock.Unlock()
+	appliedRules = rules
 }
 
-var updateChan = make(chan *Handlers, 1)
+// A pending haproxy update and the type of the latest event asking for it
+type updateRequest struct {
+	handlers  *Handlers
+	eventType string
+}
+
+var updateChan = make(chan updateRequest, 1)
 
 func init() {
 	go func() {
 		log.Println("Starting update loop")
 		for {
-			h := <-updateChan
-			handleHAPUpdate(h)
+			req := <-updateChan
+			handleHAPUpdate(req.handlers, req.eventType)
 		}
 	}()
 }
 
 var queueUpdateSem = make(chan int, 1)
 
-func queueUpdate(h *Handlers) {
+func queueUpdate(h *Handlers, eventType string) {
 	queueUpdateSem <- 1
 
 	select {
@@ -143,14 +237,14 @@ func queueUpdate(h *Handlers) {
 	default:
 		log.Println("Queuing an haproxy update.")
 	}
-	updateChan <- h
+	updateChan <- updateRequest{h, eventType}
 
 	<-queueUpdateSem
 }
 
-func handleHAPUpdate(h *Handlers) {
+func handleHAPUpdate(h *Handlers, eventType string) {
 	reloadStart := time.Now()
-	reloaded, err := ensureLatestConfig(h)
+	reloaded, err := ensureLatestConfig(h, eventType)
 
 	if err != nil {
 		h.Conf.StatsD.Increment(1.0, "haproxy.reload.error", 1)
@@ -166,34 +260,74 @@ func handleHAPUpdate(h *Handlers) {
 }
 
 // For values of 'latest' conforming to general relativity.
-func ensureLatestConfig(h *Handlers) (reloaded bool, err error) {
-	content, err := generateConfig(h)
+func ensureLatestConfig(h *Handlers, eventType string) (reloaded bool, err error) {
+	// A pinned config wins over whatever would be rendered, and still
+	// applies when rendering fails
+	content, pinned := h.pinnedConfig()
+	var frontends []haproxy.Frontend
+	var weights map[string]int
+	var rules map[string][]application.Rule
+	if !pinned {
+		content, frontends, weights, rules, err = renderConfig(h)
+		if err != nil {
+			return
+		}
+	}
+
+	req, err := isReloadRequired(h.Conf.HAProxy.OutputPath, content)
 	if err != nil {
 		return
 	}
+	// a failed reload rolls the config back, so the one on disk is running
+	if !req {
+		if !pinned {
+			setAppliedRules(rules)
+		}
+		return
+	}
 
-	req, err := isReloadRequired(h.Conf.HAProxy.OutputPath, content)
-	if err != nil || !req {
+	err = checkConfig(h.validator(), content)
+	if err != nil {
+		h.Conf.StatsD.Increment(1.0, "haproxy.validation.rejected", 1)
 		return
 	}
 
-	/*	err = validateConfig(conf.HAProxy.ReloadValidationCommand, content)
+	if !pinned && applySlotChanges(h.Conf, frontends, weights) {
+		err = writeAppliedConfig(h.Conf.HAProxy.OutputPath, content)
 		if err != nil {
+			log.Println("Failed to write template on path", h.Conf.HAProxy.OutputPath)
 			return
-		}*/
+		}
+		setAppliedRules(rules)
+		h.recordConfig(eventType, content)
+		return
+	}
 
 	defer cleanupConfig(h.Conf.HAProxy.ReloadCleanupCommand)
 
+	setAppliedFrontends(nil)
 	reloaded, err = changeConfig(h.Conf, content)
 	if err != nil {
 		return
 	}
+	setAppliedFrontends(frontends)
+	if !pinned {
+		setAppliedRules(rules)
+	}
 
+	h.recordConfig(eventType, content)
 	return
 }
 
 // Generates the new config to be written
 func generateConfig(h *Handlers) (config string, err error) {
+	config, _, _, _, err = renderConfig(h)
+	return
+}
+
+// Renders the config along with the frontends, server weights and routing
+// rules it holds
+func renderConfig(h *Handlers) (config string, frontends []haproxy.Frontend, weights map[string]int, rules map[string][]application.Rule, err error) {
 	conf := h.Conf
 	templateContent, err := ioutil.ReadFile(conf.HAProxy.TemplatePath)
 	if err != nil {
@@ -201,6 +335,14 @@ func generateConfig(h *Handlers) (config string, err error) {
 		return
 	}
 
+	// read before the template data, so rules changed meanwhile are never
+	// taken as applied
+	appWeights, err := h.AppStorage.All()
+	if err != nil {
+		log.Println("Failed to retrieve app weights")
+		return
+	}
+
 	templateData, err := haproxy.GetTemplateData(conf, h.Storage, h.AppStorage)
 	if err != nil {
 		log.Println("Failed to retrieve template data")
@@ -215,7 +357,7 @@ func generateConfig(h *Handlers) (config string, err error) {
 		return
 	}
 	TemplateInvalid = false
-	return
+	return config, templateData.Frontends, templateData.Weights, weightRules(appWeights), nil
 }
 
 // Loads the existing config and decides if a reload is required
@@ -233,67 +375,35 @@ func isReloadRequired(configPath string, newContent string) (bool, error) {
 }
 
 // Takes the ReloadValidateCommand and returns nil if the command succeeded
-func validateConfig(validateTemplate string, newContent string) (err error) {
-	if validateTemplate == "" {
-		return nil
-	}
-
-	tmpFile, err := ioutil.TempFile("/tmp", "bamboo")
-	if err != nil {
-		return
-	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
-
-	log.Println("Generating validation command")
-	_, err = tmpFile.WriteString(newContent)
-	if err != nil {
-		return
-	}
-
-	validateCommand, err := template.RenderTemplate(
-		"validate",
-		validateTemplate,
-		tmpFile.Name())
-	if err != nil {
-		return
-	}
-
-	log.Println("Validating config")
-	err = execCommand(validateCommand)
-
-	return
+func validateConfig(validateTemplate string, newContent string) error {
+	return checkConfig(CommandValidator{Command: validateTemplate}, newContent)
 }
 
 func changeConfig(conf *configuration.Configuration, newContent string) (reloaded bool, err error) {
-	// This failing scares me a lot, as could end up with very invalid config
-	// content. I'd suggest restoring the original config, but that adds all
-	// kinds of new and interesting failure cases
 	log.Println("Change Config")
-	err = ioutil.WriteFile(conf.HAProxy.OutputPath, []byte(newContent), 0666)
+	ensureLastGoodConfig(conf.HAProxy.OutputPath)
+
+	err = writeConfigAtomic(conf.HAProxy.OutputPath, newContent)
 	if err != nil {
 		log.Println("Failed to write template on path", conf.HAProxy.OutputPath)
+		conf.StatsD.Increment(1.0, "haproxy.write.failed", 1)
 		return
 	}
 
-	/*	err = execCommand(conf.HAProxy.ReloadCommand)
-		if err != nil {
-			return
-		}*/
-
-	client := &http.Client{}
-	addr := fmt.Sprintf("%s:%s/api/haproxy", conf.HAProxy.IP, conf.HAProxy.Port)
-	req, err := http.NewRequest("PUT", addr, nil)
+	err = reloadHAProxy(conf)
 	if err != nil {
-		log.Println("Failed to creat new http request: ", err)
+		conf.StatsD.Increment(1.0, "haproxy.reload.failed", 1)
+		// The config on disk no longer matches what HAProxy is running
+		rollbackConfig(conf)
 		return
 	}
-	resp, err := client.Do(req)
+	conf.StatsD.Increment(1.0, "haproxy.reload.succeeded", 1)
+
+	err = writeConfigAtomic(lastGoodPath(conf.HAProxy.OutputPath), newContent)
 	if err != nil {
-		log.Println("Http request failed: ", err)
-		return
+		log.Println("Failed to keep a copy of the reloaded config:", err)
+		err = nil
 	}
-	defer resp.Body.Close()
 
 	reloaded = true
 	return
@@ -306,11 +416,17 @@ func cleanupConfig(command string) {
 }
 
 func execCommand(cmd string) error {
+	_, err := execCommandOutput(cmd)
+	return err
+}
+
+// Runs cmd through the shell and returns its combined output
+func execCommandOutput(cmd string) (string, error) {
 	log.Printf("Exec cmd: %s \n", cmd)
 	output, err := exec.Command("sh", "-c", cmd).CombinedOutput()
 	if err != nil {
 		log.Println(err.Error())
 		log.Println("Output:\n" + string(output[:]))
 	}
-	return err
+	return string(output), err
 }
@@ -4,11 +4,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"testing"
 
 	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
 
 	"github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/history"
 )
 
 // Yanked off http://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-golang
@@ -120,6 +126,69 @@ func TestEventHandler(t *testing.T) {
 		})
 	})
 
+	Convey("#changeConfig with an HAProxy agent", t, func() {
+		var reloads int
+		status := http.StatusOK
+		agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reloads++
+			w.WriteHeader(status)
+		}))
+		defer agent.Close()
+
+		agentURL, _ := url.Parse(agent.URL)
+		config.HAProxy.IP = "http://" + agentURL.Hostname()
+		config.HAProxy.Port = agentURL.Port()
+		config.HAProxy.OutputPath = fmt.Sprintf("/tmp/bamboo_cc%v.conf", rand.Int31())
+		defer os.Remove(config.HAProxy.OutputPath)
+		defer os.Remove(lastGoodPath(config.HAProxy.OutputPath))
+		orPanic(ioutil.WriteFile(config.HAProxy.OutputPath, []byte("good"), 0644))
+
+		Convey("When the reload succeeds", func() {
+			reloaded, err := changeConfig(&config, "better")
+
+			Convey("It should report reloaded", func() {
+				So(err, ShouldBeNil)
+				So(reloaded, ShouldBeTrue)
+			})
+
+			Convey("The new config should be kept as last known good", func() {
+				content, _ := ioutil.ReadFile(lastGoodPath(config.HAProxy.OutputPath))
+				So(string(content), ShouldEqual, "better")
+			})
+		})
+
+		Convey("When the reload returns a non-2xx status", func() {
+			status = http.StatusInternalServerError
+			reloaded, err := changeConfig(&config, "broken")
+
+			Convey("It should report the failure", func() {
+				So(err, ShouldNotBeNil)
+				So(reloaded, ShouldBeFalse)
+			})
+
+			Convey("The last known good config should be restored and reloaded", func() {
+				content, _ := ioutil.ReadFile(config.HAProxy.OutputPath)
+				So(string(content), ShouldEqual, "good")
+				So(reloads, ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("#writeAppliedConfig", t, func() {
+		path := fmt.Sprintf("/tmp/bamboo_wac%v.conf", rand.Int31())
+		defer os.Remove(path)
+		defer os.Remove(lastGoodPath(path))
+		orPanic(ioutil.WriteFile(lastGoodPath(path), []byte("stale weights"), 0644))
+
+		Convey("should keep the applied config as the last known good one", func() {
+			So(writeAppliedConfig(path, "new weights"), ShouldBeNil)
+			content, _ := ioutil.ReadFile(path)
+			So(string(content), ShouldEqual, "new weights")
+			good, _ := ioutil.ReadFile(lastGoodPath(path))
+			So(string(good), ShouldEqual, "new weights")
+		})
+	})
+
 	Convey("#validateConfig", t, func() {
 		Convey("When we validate the config with a failing command", func() {
 			err := validateConfig("exit 1", "arst")
@@ -145,4 +214,107 @@ func TestEventHandler(t *testing.T) {
 			})
 		})
 	})
+
+	Convey("#checkConfig", t, func() {
+		Convey("When the validator rejects the config", func() {
+			validator := ValidatorFunc(func(path string) (string, error) {
+				return "[ALERT] parsing error", fmt.Errorf("exit status 1")
+			})
+			err := checkConfig(validator, "bad config")
+
+			Convey("The err should be ErrConfigRejected", func() {
+				So(err, ShouldEqual, ErrConfigRejected)
+			})
+
+			Convey("The rejected config should be recorded", func() {
+				rejected := LastRejectedConfig()
+				So(rejected, ShouldNotBeNil)
+				So(rejected.Content, ShouldEqual, "bad config")
+				So(rejected.Output, ShouldEqual, "[ALERT] parsing error")
+			})
+		})
+
+		Convey("When the validator accepts the config", func() {
+			var validatedPath string
+			validator := ValidatorFunc(func(path string) (string, error) {
+				validatedPath = path
+				return "", nil
+			})
+			err := checkConfig(validator, "good config")
+
+			Convey("The err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+
+			Convey("The temporary config should be removed", func() {
+				_, statErr := os.Stat(validatedPath)
+				So(os.IsNotExist(statErr), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestRulesChanged(t *testing.T) {
+	Convey("#rulesChanged", t, func() {
+		appliedRules = map[string][]application.Rule{}
+		canary := []application.Rule{{Version: "v2", Header: "X-Canary"}}
+
+		Convey("should only report changed rules", func() {
+			So(rulesChanged([]application.Weight{{ID: "/web"}}), ShouldBeFalse)
+			So(rulesChanged([]application.Weight{{ID: "/web", Rules: canary}}), ShouldBeTrue)
+		})
+
+		Convey("should keep reporting rules until they are applied", func() {
+			changed := []application.Weight{{ID: "/web", Rules: canary}}
+			So(rulesChanged(changed), ShouldBeTrue)
+			So(rulesChanged(changed), ShouldBeTrue)
+			setAppliedRules(weightRules(changed))
+			So(rulesChanged([]application.Weight{{ID: "/web", Rules: canary, Versions: map[string]int{"v2": 5}}}), ShouldBeFalse)
+			So(rulesChanged([]application.Weight{{ID: "/web"}}), ShouldBeTrue)
+		})
+	})
+}
+
+func TestEnsureLatestConfig(t *testing.T) {
+	Convey("#ensureLatestConfig", t, func() {
+		historyPath, err := ioutil.TempDir("", "bamboo_history")
+		orPanic(err)
+		defer os.RemoveAll(historyPath)
+		store, err := history.NewDiskStorage(historyPath, 5)
+		orPanic(err)
+
+		conf := configuration.Configuration{}
+		conf.HAProxy.TemplatePath = "/nonexistent/haproxy_template.cfg"
+		conf.HAProxy.OutputPath = fmt.Sprintf("/tmp/bamboo_elc%v.conf", rand.Int31())
+		conf.HAProxy.ReloadCommand = "true"
+		defer os.Remove(conf.HAProxy.OutputPath)
+		defer os.Remove(lastGoodPath(conf.HAProxy.OutputPath))
+		h := &Handlers{
+			Conf:      &conf,
+			History:   store,
+			Validator: ValidatorFunc(func(path string) (string, error) { return "", nil }),
+		}
+
+		Convey("When a config is pinned and the template can't be rendered", func() {
+			entry, err := store.Record("test", "pinned config")
+			orPanic(err)
+			orPanic(store.Pin(entry.ID))
+			reloaded, err := ensureLatestConfig(h, "config_pinned")
+
+			Convey("the pinned config should still be applied", func() {
+				So(err, ShouldBeNil)
+				So(reloaded, ShouldBeTrue)
+				content, _ := ioutil.ReadFile(conf.HAProxy.OutputPath)
+				So(string(content), ShouldEqual, "pinned config")
+			})
+		})
+
+		Convey("When no config is pinned and the template can't be rendered", func() {
+			_, err := ensureLatestConfig(h, "marathon_event")
+
+			Convey("it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
 }
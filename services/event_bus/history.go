@@ -0,0 +1,39 @@
+package event_bus
+
+import (
+	"log"
+)
+
+// Returns the content of the pinned history entry, if any
+func (h *Handlers) pinnedConfig() (content string, pinned bool) {
+	if h.History == nil {
+		return "", false
+	}
+
+	entry, content, err := h.History.Pinned()
+	if err != nil {
+		log.Println("Failed to load pinned config:", err)
+		return "", false
+	}
+	if entry == nil {
+		return "", false
+	}
+
+	log.Println("Using pinned config", entry.ID)
+	return content, true
+}
+
+// Keeps an applied config in the history
+func (h *Handlers) recordConfig(eventType string, content string) {
+	if h.History == nil {
+		return
+	}
+
+	entry, err := h.History.Record(eventType, content)
+	if err != nil {
+		log.Println("Failed to record config history:", err)
+		h.Conf.StatsD.Increment(1.0, "haproxy.history.error", 1)
+		return
+	}
+	log.Println("Recorded config history entry", entry.ID)
+}
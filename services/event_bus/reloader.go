@@ -0,0 +1,118 @@
+package event_bus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+const (
+	ReloadStrategyCommand   = configuration.ReloadStrategyCommand
+	ReloadStrategyHTTPAgent = configuration.ReloadStrategyHTTPAgent
+
+	reloadAgentTimeout = time.Second * 30
+)
+
+// Reloader makes HAProxy pick up the config written to HAProxy.OutputPath
+type Reloader interface {
+	Reload() error
+}
+
+// ReloadError is returned by every Reloader when HAProxy failed to reload
+type ReloadError struct {
+	Strategy string
+	// Command output or agent response body
+	Output string
+	Err    error
+}
+
+func (e *ReloadError) Error() string {
+	return fmt.Sprintf("HAProxy reload using %s failed: %v", e.Strategy, e.Err)
+}
+
+// CommandReloader reloads HAProxy by running a shell command
+type CommandReloader struct {
+	Command string
+}
+
+func (c CommandReloader) Reload() error {
+	output, err := execCommandOutput(c.Command)
+	if err != nil {
+		return &ReloadError{Strategy: ReloadStrategyCommand, Output: output, Err: err}
+	}
+	return nil
+}
+
+// HTTPAgentReloader reloads HAProxy through a PUT on the agent's /api/haproxy
+type HTTPAgentReloader struct {
+	Address string
+	Client  *http.Client
+}
+
+func (a HTTPAgentReloader) Reload() error {
+	req, err := http.NewRequest("PUT", a.Address+"/api/haproxy", nil)
+	if err != nil {
+		log.Println("Failed to creat new http request: ", err)
+		return &ReloadError{Strategy: ReloadStrategyHTTPAgent, Err: err}
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		log.Println("Http request failed: ", err)
+		return &ReloadError{Strategy: ReloadStrategyHTTPAgent, Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Println("HAProxy reload failed: ", resp.StatusCode, string(body))
+		return &ReloadError{
+			Strategy: ReloadStrategyHTTPAgent,
+			Output:   string(body),
+			Err:      fmt.Errorf("agent returned status %d", resp.StatusCode),
+		}
+	}
+	return nil
+}
+
+// NewReloader returns the Reloader selected by HAProxy.ReloadStrategy. When
+// no strategy is set, the HTTP agent is used if HAProxy.IP is configured and
+// HAProxy.ReloadCommand otherwise.
+func NewReloader(conf configuration.HAProxy) (Reloader, error) {
+	strategy := conf.ReloadStrategy
+	if strategy == "" {
+		if conf.IP != "" {
+			strategy = ReloadStrategyHTTPAgent
+		} else {
+			strategy = ReloadStrategyCommand
+		}
+	}
+
+	switch strategy {
+	case ReloadStrategyCommand:
+		return CommandReloader{Command: conf.ReloadCommand}, nil
+	case ReloadStrategyHTTPAgent:
+		return HTTPAgentReloader{
+			Address: fmt.Sprintf("%s:%s", conf.IP, conf.Port),
+			Client:  &http.Client{Timeout: reloadAgentTimeout},
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown HAProxy reload strategy %q", strategy)
+}
+
+// Reloads HAProxy with the strategy selected in conf
+func reloadHAProxy(conf *configuration.Configuration) error {
+	reloader, err := NewReloader(conf.HAProxy)
+	if err != nil {
+		return err
+	}
+
+	err = reloader.Reload()
+	if reloadErr, ok := err.(*ReloadError); ok {
+		conf.StatsD.Increment(1.0, "haproxy.reload."+reloadErr.Strategy+".failed", 1)
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package event_bus
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+func TestReloader(t *testing.T) {
+	Convey("#NewReloader", t, func() {
+		Convey("When no strategy is configured and the agent IP is set", func() {
+			reloader, err := NewReloader(configuration.HAProxy{IP: "http://127.0.0.1", Port: "5004"})
+
+			Convey("it should use the HTTP agent", func() {
+				So(err, ShouldBeNil)
+				So(reloader, ShouldHaveSameTypeAs, HTTPAgentReloader{})
+			})
+		})
+
+		Convey("When no strategy is configured and the agent IP is not set", func() {
+			reloader, err := NewReloader(configuration.HAProxy{ReloadCommand: "exit 0"})
+
+			Convey("it should run the reload command", func() {
+				So(err, ShouldBeNil)
+				So(reloader, ShouldResemble, CommandReloader{Command: "exit 0"})
+			})
+		})
+
+		Convey("When an unknown strategy is configured", func() {
+			_, err := NewReloader(configuration.HAProxy{ReloadStrategy: "carrier-pigeon"})
+
+			Convey("we should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("#CommandReloader", t, func() {
+		Convey("When the command succeeds", func() {
+			err := CommandReloader{Command: "exit 0"}.Reload()
+
+			Convey("the err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the command fails", func() {
+			err := CommandReloader{Command: "echo 'no pid file'; exit 3"}.Reload()
+
+			Convey("we should get a ReloadError with the command output", func() {
+				reloadErr, ok := err.(*ReloadError)
+				So(ok, ShouldBeTrue)
+				So(reloadErr.Strategy, ShouldEqual, ReloadStrategyCommand)
+				So(reloadErr.Output, ShouldEqual, "no pid file\n")
+			})
+		})
+	})
+
+	Convey("#HTTPAgentReloader", t, func() {
+		var method, path string
+		status := http.StatusOK
+		agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path = r.Method, r.URL.Path
+			w.WriteHeader(status)
+			io.WriteString(w, "reload output")
+		}))
+		defer agent.Close()
+
+		reloader := HTTPAgentReloader{Address: agent.URL, Client: &http.Client{}}
+
+		Convey("When the agent reloads successfully", func() {
+			err := reloader.Reload()
+
+			Convey("it should PUT /api/haproxy", func() {
+				So(err, ShouldBeNil)
+				So(method, ShouldEqual, "PUT")
+				So(path, ShouldEqual, "/api/haproxy")
+			})
+		})
+
+		Convey("When the agent returns a non-2xx status", func() {
+			status = http.StatusBadGateway
+			err := reloader.Reload()
+
+			Convey("we should get a ReloadError with the response body", func() {
+				reloadErr, ok := err.(*ReloadError)
+				So(ok, ShouldBeTrue)
+				So(reloadErr.Strategy, ShouldEqual, ReloadStrategyHTTPAgent)
+				So(reloadErr.Output, ShouldEqual, "reload output")
+			})
+		})
+
+		Convey("When the agent is unreachable", func() {
+			agent.Close()
+			err := reloader.Reload()
+
+			Convey("we should get a ReloadError", func() {
+				_, ok := err.(*ReloadError)
+				So(ok, ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,62 @@
+package event_bus
+
+import (
+	"log"
+	"sync"
+
+	"github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/haproxy"
+)
+
+// Frontends known to run in HAProxy, nil when unknown (e.g. after a failed
+// reload or while a config is pinned)
+var appliedFrontends []haproxy.Frontend
+var appliedFrontendsLock sync.Mutex
+
+func setAppliedFrontends(frontends []haproxy.Frontend) {
+	appliedFrontendsLock.Lock()
+	defer appliedFrontendsLock.Unlock()
+	appliedFrontends = frontends
+}
+
+// Applies server membership changes to HAProxy.ServerSlots slots through the
+// runtime API. Returns false when a reload is needed instead: slots are
+// disabled, slots ran out, frontends changed or the runtime API failed.
+func applySlotChanges(conf *configuration.Configuration, frontends []haproxy.Frontend, weights map[string]int) bool {
+	if conf.HAProxy.ServerSlots <= 0 || frontends == nil {
+		return false
+	}
+
+	appliedFrontendsLock.Lock()
+	defer appliedFrontendsLock.Unlock()
+	if appliedFrontends == nil {
+		return false
+	}
+
+	changes, reloadRequired := haproxy.SlotChanges(appliedFrontends, frontends, weights)
+	if reloadRequired {
+		log.Println("Frontends or slot count changed, reloading HAProxy")
+		return false
+	}
+	// the config changed somewhere else than in the server slots
+	if len(changes) == 0 {
+		return false
+	}
+
+	client := haproxy.NewRuntimeClient(conf.HAProxy.AdminSocketPath())
+	for _, change := range changes {
+		err := client.ApplySlotChange(change)
+		if err != nil {
+			log.Println("Failed to update server slot", change.Backend, change.Server, err)
+			conf.StatsD.Increment(1.0, "haproxy.slots.error", 1)
+			// part of the changes may be live already, only a reload can tell
+			appliedFrontends = nil
+			return false
+		}
+	}
+
+	log.Println("Applied", len(changes), "server slot changes without reload")
+	conf.StatsD.Increment(1.0, "haproxy.slots.applied", 1)
+	appliedFrontends = frontends
+	return true
+}
@@ -0,0 +1,117 @@
+package event_bus
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/QubitProducts/bamboo/services/template"
+)
+
+var (
+	// ErrConfigRejected is returned when a rendered config fails validation
+	ErrConfigRejected = errors.New("HAProxy config rejected by validator")
+)
+
+// Validator checks a rendered HAProxy config written to configPath and
+// returns whatever the validator printed alongside the result
+type Validator interface {
+	Validate(configPath string) (output string, err error)
+}
+
+// ValidatorFunc adapts a plain function to the Validator interface
+type ValidatorFunc func(configPath string) (string, error)
+
+func (f ValidatorFunc) Validate(configPath string) (string, error) {
+	return f(configPath)
+}
+
+// CommandValidator runs a shell command, '{{.}}' in Command is expanded to the
+// path of the config under validation. An empty Command accepts everything.
+type CommandValidator struct {
+	Command string
+}
+
+func (v CommandValidator) Validate(configPath string) (output string, err error) {
+	if v.Command == "" {
+		return "", nil
+	}
+
+	validateCommand, err := template.RenderTemplate("validate", v.Command, configPath)
+	if err != nil {
+		return
+	}
+
+	log.Println("Validating config")
+	return execCommandOutput(validateCommand)
+}
+
+// RejectedConfig describes the last rendered config refused by the validator
+type RejectedConfig struct {
+	Timestamp time.Time `json:"timestamp"`
+	Content   string    `json:"content"`
+	Output    string    `json:"output"`
+	Error     string    `json:"error"`
+}
+
+var (
+	lastRejected     *RejectedConfig
+	lastRejectedLock sync.RWMutex
+)
+
+// LastRejectedConfig returns the most recent config refused by validation,
+// or nil if every config so far has passed
+func LastRejectedConfig() *RejectedConfig {
+	lastRejectedLock.RLock()
+	defer lastRejectedLock.RUnlock()
+	return lastRejected
+}
+
+func recordRejectedConfig(content string, output string, err error) {
+	lastRejectedLock.Lock()
+	defer lastRejectedLock.Unlock()
+	lastRejected = &RejectedConfig{
+		Timestamp: time.Now(),
+		Content:   content,
+		Output:    output,
+		Error:     err.Error(),
+	}
+}
+
+// Returns the validator configured on the handlers, falling back to
+// HAProxy.ReloadValidationCommand
+func (h *Handlers) validator() Validator {
+	if h.Validator != nil {
+		return h.Validator
+	}
+	return CommandValidator{Command: h.Conf.HAProxy.ReloadValidationCommand}
+}
+
+// Writes newContent to a temporary file and runs the validator against it.
+// Rejected configs are recorded so they can be inspected over the API.
+func checkConfig(validator Validator, newContent string) (err error) {
+	tmpFile, err := ioutil.TempFile("/tmp", "bamboo")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	log.Println("Generating validation command")
+	_, err = tmpFile.WriteString(newContent)
+	if err != nil {
+		return
+	}
+
+	output, err := validator.Validate(tmpFile.Name())
+	if err != nil {
+		log.Println("Rejected config:", err)
+		recordRejectedConfig(newContent, output, err)
+		return ErrConfigRejected
+	}
+
+	return nil
+}
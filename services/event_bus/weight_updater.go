@@ -0,0 +1,112 @@
+package event_bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/haproxy"
+)
+
+const (
+	WeightStrategyHTTPAgent  = configuration.WeightStrategyHTTPAgent
+	WeightStrategyRuntimeAPI = configuration.WeightStrategyRuntimeAPI
+)
+
+var (
+	// ErrServersChanged is returned when weights target servers the running
+	// HAProxy doesn't know about, so a full reload is needed
+	ErrServersChanged = errors.New("HAProxy servers changed, reload required")
+)
+
+// WeightUpdater applies the server weights computed by haproxy.CalcWeights to
+// the running HAProxy
+type WeightUpdater interface {
+	UpdateWeights(servers []map[string]interface{}) error
+}
+
+// HTTPAgentWeightUpdater pushes weights with a PUT on the agent's /api/weight
+type HTTPAgentWeightUpdater struct {
+	Address string
+	Client  *http.Client
+}
+
+func (a HTTPAgentWeightUpdater) UpdateWeights(servers []map[string]interface{}) error {
+	if len(servers) < 1 {
+		log.Println("empty servers")
+		return nil
+	}
+
+	json, err := json.Marshal(servers)
+	if err != nil {
+		log.Println(err.Error())
+		log.Println("Error: can't update app weight")
+		return err
+	}
+	log.Println("serversJson", string(json))
+
+	req, err := http.NewRequest("PUT", a.Address+"/api/weight", bytes.NewBuffer(json))
+	if err != nil {
+		log.Println("Failed to creat new http request: ", err)
+		return err
+	}
+	req.Close = true
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		log.Println("Http request failed: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	log.Println("updated", string(json), resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HAProxy agent returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// RuntimeWeightUpdater sets weights over the HAProxy admin socket, no reload
+// is involved
+type RuntimeWeightUpdater struct {
+	Client *haproxy.RuntimeClient
+}
+
+func (u RuntimeWeightUpdater) UpdateWeights(servers []map[string]interface{}) error {
+	serversChanged := false
+	for _, server := range servers {
+		backend := server["backend"].(string)
+		name := server["server"].(string)
+		err := u.Client.SetWeight(backend, name, server["weight"].(int))
+		if err == haproxy.ErrNoSuchServer {
+			serversChanged = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if serversChanged {
+		return ErrServersChanged
+	}
+	return nil
+}
+
+// NewWeightUpdater returns the WeightUpdater selected by HAProxy.WeightStrategy,
+// defaulting to the HTTP agent
+func NewWeightUpdater(conf configuration.HAProxy) (WeightUpdater, error) {
+	switch conf.WeightStrategy {
+	case "", WeightStrategyHTTPAgent:
+		return HTTPAgentWeightUpdater{
+			Address: fmt.Sprintf("%s:%s", conf.IP, conf.Port),
+			Client:  &http.Client{Timeout: reloadAgentTimeout},
+		}, nil
+	case WeightStrategyRuntimeAPI:
+		return RuntimeWeightUpdater{Client: haproxy.NewRuntimeClient(conf.AdminSocketPath())}, nil
+	}
+	return nil, fmt.Errorf("Unknown HAProxy weight strategy %q", conf.WeightStrategy)
+}
@@ -0,0 +1,127 @@
+package event_bus
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/services/haproxy"
+)
+
+// A fake HAProxy admin socket answering runtime commands from a fixed map,
+// unknown commands get "No such server."
+type fakeAdminSocket struct {
+	listener net.Listener
+	dir      string
+	answers  map[string]string
+	lock     sync.Mutex
+	received []string
+}
+
+func newFakeAdminSocket(answers map[string]string) *fakeAdminSocket {
+	dir, err := ioutil.TempDir("", "bamboo_sock")
+	orPanic(err)
+	listener, err := net.Listen("unix", filepath.Join(dir, "admin.sock"))
+	orPanic(err)
+
+	s := &fakeAdminSocket{listener: listener, dir: dir, answers: answers}
+	go s.serve()
+	return s
+}
+
+func (s *fakeAdminSocket) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		command, _ := bufio.NewReader(conn).ReadString('\n')
+		command = strings.TrimSpace(command)
+
+		s.lock.Lock()
+		s.received = append(s.received, command)
+		answer, ok := s.answers[command]
+		s.lock.Unlock()
+		if !ok {
+			answer = "No such server.\n"
+		}
+		io.WriteString(conn, answer)
+		conn.Close()
+	}
+}
+
+func (s *fakeAdminSocket) path() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeAdminSocket) commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.received
+}
+
+func (s *fakeAdminSocket) close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+func TestRuntimeWeightUpdater(t *testing.T) {
+	Convey("#RuntimeWeightUpdater", t, func() {
+		socket := newFakeAdminSocket(map[string]string{
+			"set weight app-http-80/app-v1-31000 3": "\n",
+			"set weight app-http-80/app-v2-31001 1": "\n",
+			"set weight app-http-80/app-v2-31002 0": "Backend is using a static LB algorithm and only accepts weights '0%' and '100%'.\n",
+		})
+		defer socket.close()
+		updater := RuntimeWeightUpdater{Client: haproxy.NewRuntimeClient(socket.path())}
+
+		Convey("When every server is known to HAProxy", func() {
+			err := updater.UpdateWeights([]map[string]interface{}{
+				{"backend": "app-http-80", "server": "app-v1-31000", "weight": 3},
+				{"backend": "app-http-80", "server": "app-v2-31001", "weight": 1},
+			})
+
+			Convey("it should set each weight over the socket", func() {
+				So(err, ShouldBeNil)
+				So(socket.commands(), ShouldResemble, []string{
+					"set weight app-http-80/app-v1-31000 3",
+					"set weight app-http-80/app-v2-31001 1",
+				})
+			})
+		})
+
+		Convey("When a server was added since the last reload", func() {
+			err := updater.UpdateWeights([]map[string]interface{}{
+				{"backend": "app-http-80", "server": "app-v3-31005", "weight": 1},
+				{"backend": "app-http-80", "server": "app-v1-31000", "weight": 3},
+			})
+
+			Convey("it should still set the known weights", func() {
+				So(len(socket.commands()), ShouldEqual, 2)
+			})
+
+			Convey("it should ask for a reload", func() {
+				So(err, ShouldEqual, ErrServersChanged)
+			})
+		})
+
+		Convey("When HAProxy refuses a weight", func() {
+			err := updater.UpdateWeights([]map[string]interface{}{
+				{"backend": "app-http-80", "server": "app-v2-31002", "weight": 0},
+			})
+
+			Convey("we should get the error without a reload", func() {
+				So(err, ShouldNotBeNil)
+				So(err, ShouldNotEqual, ErrServersChanged)
+			})
+		})
+	})
+}
@@ -0,0 +1,170 @@
+package haproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	conf "github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+)
+
+// Marathon app labels tuning the app's HAProxy backends
+const (
+	// Load balancing algorithm, e.g. "leastconn" or "hdr(host)"
+	LabelBalance = "BAMBOO_BALANCE"
+	// Max connections per server, "0" for no limit
+	LabelMaxConn = "BAMBOO_MAXCONN"
+	// Server timeout in HAProxy time format, e.g. "90s"
+	LabelTimeoutServer = "BAMBOO_TIMEOUT_SERVER"
+	// "true" or "false", cookie based stickiness of http backends
+	LabelSticky = "BAMBOO_STICKY"
+	// Health check interval in HAProxy time format, "0" disables checks
+	LabelCheckInterval = "BAMBOO_CHECK_INTERVAL"
+)
+
+// Defaults of each protocol, as the template hardcoded them
+const (
+	defaultHTTPBalance       = "roundrobin"
+	defaultTCPBalance        = "leastconn"
+	defaultHTTPMaxConn       = 10
+	defaultHTTPCheckInterval = 3000
+)
+
+var balanceAlgorithms = map[string]bool{
+	"roundrobin": true,
+	"static-rr":  true,
+	"leastconn":  true,
+	"first":      true,
+	"source":     true,
+	"uri":        true,
+	"random":     true,
+}
+
+var (
+	balanceHeader = regexp.MustCompile(`^hdr\([A-Za-z0-9_-]+\)$`)
+	haproxyTime   = regexp.MustCompile(`^([0-9]+)(us|ms|s|m|h|d)?$`)
+)
+
+// Milliseconds per HAProxy time unit, values without unit are milliseconds
+var timeUnits = map[string]float64{
+	"us": 0.001,
+	"":   1,
+	"ms": 1,
+	"s":  1000,
+	"m":  60 * 1000,
+	"h":  60 * 60 * 1000,
+	"d":  24 * 60 * 60 * 1000,
+}
+
+// SettingError reports a backend setting that was ignored because its value
+// is invalid
+type SettingError struct {
+	// Label or configuration field holding the value
+	Setting string
+	Value   string
+	Reason  string
+}
+
+func (e *SettingError) Error() string {
+	return fmt.Sprintf("Invalid %s %q: %s", e.Setting, e.Value, e.Reason)
+}
+
+func (e *SettingError) Detail() diagnostics.Detail {
+	return diagnostics.Detail{Field: e.Setting, Value: e.Value, Message: e.Error()}
+}
+
+// Parses a HAProxy time into milliseconds
+func parseTime(value string) (int, error) {
+	match := haproxyTime.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("expected a number with an optional unit us, ms, s, m, h or d")
+	}
+	number, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, err
+	}
+	return int(float64(number) * timeUnits[match[2]]), nil
+}
+
+// Sets the backend settings of a frontend from the app labels, then the
+// configured defaults, then those of its protocol. Invalid values are
+// returned as SettingErrors and skipped.
+func applyBackendSettings(frontend *Frontend, labels map[string]string, defaults conf.Backend) []error {
+	errors := []error{}
+	set := func(setting string, value string, apply func(string) error) {
+		if value == "" {
+			return
+		}
+		if err := apply(value); err != nil {
+			errors = append(errors, &SettingError{Setting: setting, Value: value, Reason: err.Error()})
+		}
+	}
+
+	balance := func(value string) error {
+		if !balanceAlgorithms[value] && !balanceHeader.MatchString(value) {
+			return fmt.Errorf("unknown balance algorithm")
+		}
+		frontend.Balance = value
+		return nil
+	}
+	maxConn := func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("expected a number of connections")
+		}
+		frontend.MaxConn = n
+		return nil
+	}
+	timeoutServer := func(value string) error {
+		ms, err := parseTime(value)
+		if err != nil {
+			return err
+		}
+		frontend.TimeoutServer = ms
+		return nil
+	}
+	sticky := func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		frontend.Sticky = b
+		return nil
+	}
+	checkInterval := func(value string) error {
+		ms, err := parseTime(value)
+		if err != nil {
+			return err
+		}
+		frontend.CheckInterval = ms
+		return nil
+	}
+
+	if frontend.Protocol == "http" {
+		frontend.Balance = defaultHTTPBalance
+		frontend.MaxConn = defaultHTTPMaxConn
+		frontend.Sticky = true
+		frontend.CheckInterval = defaultHTTPCheckInterval
+	} else {
+		frontend.Balance = defaultTCPBalance
+	}
+
+	set("HAProxy.Backend.Balance", defaults.Balance, balance)
+	if defaults.MaxConn > 0 {
+		frontend.MaxConn = defaults.MaxConn
+	}
+	set("HAProxy.Backend.TimeoutServer", defaults.TimeoutServer, timeoutServer)
+	if defaults.Sticky != nil {
+		frontend.Sticky = *defaults.Sticky
+	}
+	set("HAProxy.Backend.CheckInterval", defaults.CheckInterval, checkInterval)
+
+	set(LabelBalance, labels[LabelBalance], balance)
+	set(LabelMaxConn, labels[LabelMaxConn], maxConn)
+	set(LabelTimeoutServer, labels[LabelTimeoutServer], timeoutServer)
+	set(LabelSticky, labels[LabelSticky], sticky)
+	set(LabelCheckInterval, labels[LabelCheckInterval], checkInterval)
+
+	return errors
+}
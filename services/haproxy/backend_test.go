@@ -0,0 +1,95 @@
+package haproxy
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	conf "github.com/QubitProducts/bamboo/configuration"
+)
+
+func TestApplyBackendSettings(t *testing.T) {
+	Convey("#applyBackendSettings", t, func() {
+		Convey("When an http app has no labels", func() {
+			frontend := Frontend{Protocol: "http"}
+			errors := applyBackendSettings(&frontend, nil, conf.Backend{})
+
+			Convey("it should get the settings the template used to hardcode", func() {
+				So(errors, ShouldBeEmpty)
+				So(frontend.Balance, ShouldEqual, "roundrobin")
+				So(frontend.MaxConn, ShouldEqual, 10)
+				So(frontend.Sticky, ShouldBeTrue)
+				So(frontend.CheckInterval, ShouldEqual, 3000)
+				So(frontend.TimeoutServer, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When a tcp app has no labels", func() {
+			frontend := Frontend{Protocol: "tcp"}
+			applyBackendSettings(&frontend, nil, conf.Backend{})
+
+			Convey("it should balance by connections without checks or limits", func() {
+				So(frontend.Balance, ShouldEqual, "leastconn")
+				So(frontend.MaxConn, ShouldEqual, 0)
+				So(frontend.CheckInterval, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When defaults are configured", func() {
+			sticky := false
+			frontend := Frontend{Protocol: "http"}
+			applyBackendSettings(&frontend, map[string]string{LabelMaxConn: "50"}, conf.Backend{
+				Balance:       "leastconn",
+				MaxConn:       20,
+				TimeoutServer: "2m",
+				Sticky:        &sticky,
+			})
+
+			Convey("they should apply unless a label overrides them", func() {
+				So(frontend.Balance, ShouldEqual, "leastconn")
+				So(frontend.MaxConn, ShouldEqual, 50)
+				So(frontend.TimeoutServer, ShouldEqual, 120000)
+				So(frontend.Sticky, ShouldBeFalse)
+			})
+		})
+
+		Convey("When the labels are valid", func() {
+			frontend := Frontend{Protocol: "http"}
+			errors := applyBackendSettings(&frontend, map[string]string{
+				LabelBalance:       "hdr(host)",
+				LabelMaxConn:       "0",
+				LabelTimeoutServer: "90s",
+				LabelSticky:        "false",
+				LabelCheckInterval: "500ms",
+			}, conf.Backend{})
+
+			Convey("they should be parsed into typed fields", func() {
+				So(errors, ShouldBeEmpty)
+				So(frontend.Balance, ShouldEqual, "hdr(host)")
+				So(frontend.MaxConn, ShouldEqual, 0)
+				So(frontend.TimeoutServer, ShouldEqual, 90000)
+				So(frontend.Sticky, ShouldBeFalse)
+				So(frontend.CheckInterval, ShouldEqual, 500)
+			})
+		})
+
+		Convey("When the labels are invalid", func() {
+			frontend := Frontend{Protocol: "http"}
+			errors := applyBackendSettings(&frontend, map[string]string{
+				LabelBalance:       "roundrobin\n  server evil 1.2.3.4:80",
+				LabelMaxConn:       "-1",
+				LabelTimeoutServer: "soon",
+				LabelSticky:        "maybe",
+			}, conf.Backend{})
+
+			Convey("each should be reported and keep its default", func() {
+				So(len(errors), ShouldEqual, 4)
+				So(errors[0].(*SettingError).Setting, ShouldEqual, LabelBalance)
+				So(frontend.Balance, ShouldEqual, "roundrobin")
+				So(frontend.MaxConn, ShouldEqual, 10)
+				So(frontend.TimeoutServer, ShouldEqual, 0)
+				So(frontend.Sticky, ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -6,18 +6,23 @@ import (
 	"log"
 	"runtime"
 	"sort"
+	"strconv"
+	"sync"
 
 	conf "github.com/QubitProducts/bamboo/configuration"
 	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
 	"github.com/QubitProducts/bamboo/services/marathon"
+	"github.com/QubitProducts/bamboo/services/provider"
 	"github.com/QubitProducts/bamboo/services/service"
 )
 
 type templateData struct {
-	Frontends []Frontend
-	Weights   map[string]int
-	Services  map[string]service.Service
-	NBProc    int
+	Frontends       []Frontend
+	SharedFrontends []SharedFrontend
+	Weights         map[string]int
+	Services        map[string]service.Service
+	NBProc          int
 }
 
 type Server struct {
@@ -26,6 +31,15 @@ type Server struct {
 	Host    string
 	Port    int
 	Weight  int
+	// Disabled marks a free server slot, see HAProxy.ServerSlots
+	Disabled bool
+	// Administrative state, one of the marathon.TaskState constants
+	State string
+}
+
+// Whether the server takes new traffic and a share of the weights
+func (s Server) routable() bool {
+	return !s.Disabled && (s.State == "" || s.State == marathon.TaskStateReady)
 }
 
 type ByVersion []Server
@@ -42,9 +56,39 @@ func (a ByVersion) Less(i, j int) bool {
 
 type Frontend struct {
 	Name     string
+	AppId    string
 	Protocol string
 	Bind     int
 	Servers  []Server
+
+	// Endpoint svcType, picks BindAddress from HAProxy.BindAddresses
+	SvcType     string
+	BindAddress string
+	// Path prefix of the app on a shared frontend, see routes.go
+	Uri string
+	// Served by a SharedFrontend instead of listening itself
+	Routed bool
+	// Backends of single versions and the rules routing to them, see rules.go
+	VersionBackends []VersionBackend
+	Rules           []RoutingRule
+
+	// Version getting the traffic without weights, from the weight of the app
+	// or the oldest one in VersionOrder
+	PrimaryVersion string
+	// Versions of the app, oldest first
+	Versions     []string
+	VersionOrder string
+
+	// Backend settings from the app labels or their defaults, see backend.go
+	Balance string
+	// Max connections per server, 0 for no limit
+	MaxConn int
+	// Server timeout in milliseconds, 0 keeps the template's default
+	TimeoutServer int
+	// Cookie based stickiness, http only
+	Sticky bool
+	// Health check interval in milliseconds, 0 disables checks
+	CheckInterval int
 }
 type ByBind []Frontend
 
@@ -55,13 +99,51 @@ func (a ByBind) Swap(i, j int) {
 	a[i], a[j] = a[j], a[i]
 }
 func (a ByBind) Less(i, j int) bool {
-	return a[i].Bind < a[j].Bind
+	if a[i].Bind != a[j].Bind {
+		return a[i].Bind < a[j].Bind
+	}
+	return a[i].Name < a[j].Name
 }
 
-var FrontendMap map[string]Frontend = make(map[string]Frontend)
+// Frontends by app id as of the latest render. The update loop writes it
+// while API handlers and the canary monitor read it, use LookupFrontend and
+// Frontends.
+var frontendMap = map[string]Frontend{}
+var frontendMapLock sync.RWMutex
+
+// LookupFrontend returns the frontend of an app as of the latest render
+func LookupFrontend(id string) (Frontend, bool) {
+	frontendMapLock.RLock()
+	defer frontendMapLock.RUnlock()
+	frontend, ok := frontendMap[id]
+	return frontend, ok
+}
+
+// Frontends returns a copy of the frontends by app id
+func Frontends() map[string]Frontend {
+	frontendMapLock.RLock()
+	defer frontendMapLock.RUnlock()
+	frontends := make(map[string]Frontend, len(frontendMap))
+	for id, frontend := range frontendMap {
+		frontends[id] = frontend
+	}
+	return frontends
+}
+
+// Replaces the frontends by app id with those of a render, so frontends of
+// apps gone or renamed since don't linger
+func setFrontends(frontends []Frontend) {
+	byApp := make(map[string]Frontend, len(frontends))
+	for _, frontend := range frontends {
+		byApp[frontend.AppId] = frontend
+	}
+	frontendMapLock.Lock()
+	defer frontendMapLock.Unlock()
+	frontendMap = byApp
+}
 
 func GetTemplateData(config *conf.Configuration, storage service.Storage, appStorage application.Storage) (*templateData, error) {
-	apps, err := marathon.FetchApps(config.Marathon, config)
+	apps, err := provider.Apps(config)
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +158,11 @@ func GetTemplateData(config *conf.Configuration, storage service.Storage, appSto
 		return nil, err
 	}
 	apps = handleCanary(apps, zkWeights)
-	frontends := formFrontends(apps)
+	frontends := formFrontends(apps, config.HAProxy)
+	frontends, ruleErrors := applyRules(frontends, zkWeights)
+	diagnostics.Replace(diagnostics.SourceRules, ruleErrors, false)
+	setFrontends(frontends)
+	reportDiagnostics(config)
 	weightMap := formWeightMap(zkWeights)
 
 	//byName := make(map[string]service.Service)
@@ -88,14 +174,42 @@ func GetTemplateData(config *conf.Configuration, storage service.Storage, appSto
 	if cores > 64 {
 		cores = 64
 	}
-	return &templateData{frontends, weightMap, nil, cores}, nil
+	data := &templateData{frontends, formSharedFrontends(frontends), weightMap, nil, cores}
+	lastTemplateDataLock.Lock()
+	lastTemplateData = data
+	lastTemplateDataLock.Unlock()
+	return data, nil
+}
+
+// The data of the latest render, see LastTemplateData
+var lastTemplateData *templateData
+var lastTemplateDataLock sync.RWMutex
+
+// LastTemplateData returns the data the template was last rendered with, nil
+// before the first render. Unlike GetTemplateData it doesn't fetch apps or
+// touch slots and diagnostics, so it is safe to serve to API clients.
+func LastTemplateData() *templateData {
+	lastTemplateDataLock.RLock()
+	defer lastTemplateDataLock.RUnlock()
+	return lastTemplateData
+}
+
+// Sends the number of apps with problems, and each new problem, to StatsD
+func reportDiagnostics(config *conf.Configuration) {
+	for _, source := range diagnostics.Sources {
+		config.StatsD.Gauge(1.0, "diagnostics."+source+".apps", strconv.Itoa(diagnostics.Counts()[source]))
+	}
+	for _, problem := range diagnostics.TakeNew() {
+		config.StatsD.Increment(1.0, "diagnostics."+problem.Source+".invalid", 1)
+	}
 }
 
 func formWeightMap(zkWeights []application.Weight) map[string]int {
 	weightMap := map[string]int{}
 	processed := map[string]bool{}
+	frontends := Frontends()
 	for _, weight := range zkWeights {
-		if frontend, ok := FrontendMap[weight.ID]; ok {
+		if frontend, ok := frontends[weight.ID]; ok {
 			servers := CalcWeights(frontend, weight)
 			for _, server := range servers {
 				weightMap[server["server"].(string)] = server["weight"].(int)
@@ -104,7 +218,7 @@ func formWeightMap(zkWeights []application.Weight) map[string]int {
 		}
 	}
 	//set initial weight
-	for id, frontend := range FrontendMap {
+	for id, frontend := range frontends {
 		if !processed[id] {
 			for _, server := range frontend.Servers {
 				weightMap[server.Name] = server.Weight
@@ -114,43 +228,85 @@ func formWeightMap(zkWeights []application.Weight) map[string]int {
 	return weightMap
 }
 
-func formFrontends(apps marathon.AppList) []Frontend {
+func formFrontends(apps marathon.AppList, haproxyConf conf.HAProxy) []Frontend {
+	slots := haproxyConf.ServerSlots
 	frontends := []Frontend{}
+	labelErrors := map[string][]error{}
+	routeErrors := map[string][]error{}
+	portErrors := map[string][]error{}
 	for _, app := range apps {
 		endpointsLen := len(app.Endpoints)
 		if endpointsLen > 0 {
 			for epIdx, endpoint := range app.Endpoints {
 				frontend := Frontend{
 					Name:     fmt.Sprintf("%s-%s-%d", app.Frontend, endpoint.Protocol, endpoint.Bind),
+					AppId:    app.Id,
 					Protocol: endpoint.Protocol,
 					Bind:     endpoint.Bind,
+					SvcType:  endpoint.SvcType,
+					Uri:      endpoint.Uri,
+
+					PrimaryVersion: app.CurVsn,
+					Versions:       app.Versions,
+					VersionOrder:   app.VersionOrder,
+				}
+				address, err := bindAddress(endpoint.SvcType, haproxyConf.BindAddresses)
+				if err != nil {
+					log.Printf("App %s: %s\n", app.Id, err)
+					routeErrors[app.Id] = append(routeErrors[app.Id], err)
+					continue
+				}
+				frontend.BindAddress = address
+				errs := applyBackendSettings(&frontend, app.Labels, haproxyConf.Backend)
+				if epIdx == 0 && len(errs) > 0 {
+					for _, err := range errs {
+						log.Printf("App %s: %s\n", app.Id, err)
+					}
+					labelErrors[app.Id] = errs
 				}
 
 				servers := []Server{}
 				for _, task := range app.Tasks {
-					// endpoint contain haproxy map port so endpoint must one-one correspondence task.Port
-					// then length of endpoint must be equal to length task.Port
-					if len(task.Ports) != endpointsLen {
+					port, err := taskPort(task, endpoint, epIdx)
+					if err != nil {
+						log.Printf("App %s: %s\n", app.Id, err)
+						portErrors[app.Id] = append(portErrors[app.Id], err)
 						continue
 					}
 					server := Server{
-						Name:    fmt.Sprintf("%s-%s-%d", task.Server, task.Version, task.Ports[epIdx]),
+						Name:    fmt.Sprintf("%s-%s-%d", task.Server, task.Version, port),
 						Version: task.Version,
 						Host:    task.Host,
-						Port:    task.Ports[epIdx],
+						Port:    port,
 						Weight:  task.Weight,
+						State:   task.State,
 					}
 					servers = append(servers, server)
 				}
 				sort.Sort(ByVersion(servers))
+				if slots > 0 {
+					servers = assignSlots(frontend.Name, servers, slots)
+				}
 				frontend.Servers = servers
 
 				frontends = append(frontends, frontend)
-				FrontendMap[app.Id] = frontend
 			}
 		}
 	}
 	sort.Sort(ByBind(frontends))
+	frontends, conflicts := routeFrontends(frontends)
+	for appId, errs := range conflicts {
+		for _, err := range errs {
+			log.Printf("App %s: %s\n", appId, err)
+		}
+		routeErrors[appId] = append(routeErrors[appId], errs...)
+	}
+	if slots > 0 {
+		pruneSlots(frontends)
+	}
+	diagnostics.Replace(diagnostics.SourceLabels, labelErrors, false)
+	diagnostics.Replace(diagnostics.SourceRoutes, routeErrors, true)
+	diagnostics.Replace(diagnostics.SourcePorts, portErrors, false)
 	return frontends
 }
 
@@ -162,6 +318,9 @@ func handleCanary(apps marathon.AppList, weights []application.Weight) (result m
 	for _, app := range apps {
 		weight, hasWeight := weightMap[app.Id]
 		log.Println("weight", weight, "hasWeight", hasWeight)
+		if hasWeight && weight.Primary != "" && !app.SetPrimary(weight.Primary) {
+			log.Println("primary version", weight.Primary, "of", app.Id, "isn't running")
+		}
 		newTasks := []marathon.Task{}
 		for _, task := range app.Tasks {
 			if task.Version == app.CurVsn {
@@ -190,6 +349,7 @@ func extractWeights(weights []application.Weight) map[string]application.Weight
 
 //CalcWeights clac server weights
 func CalcWeights(frontend Frontend, weight application.Weight) []map[string]interface{} {
+	weight = withPrimary(weight)
 	versionMap := formVersionMap(frontend)
 	versionMapJson, _ := json.Marshal(versionMap)
 	log.Println("versionMap", string(versionMapJson))
@@ -208,6 +368,9 @@ func CalcWeights(frontend Frontend, weight application.Weight) []map[string]inte
 func formServers(frontend Frontend, weights map[string][2]int) []map[string]interface{} {
 	servers := []map[string]interface{}{}
 	for _, server := range frontend.Servers {
+		if !server.routable() {
+			continue
+		}
 		weight := weights[server.Version]
 		w, r := weight[0], weight[1]
 		//only use remainder on first server
@@ -227,11 +390,17 @@ func formServers(frontend Frontend, weights map[string][2]int) []map[string]inte
 }
 
 func formVersionWeights(weight application.Weight, versionMap map[string][]Server) map[string][2]int {
+	scale := weightScale(weight, versionMap)
 	weights := map[string][2]int{}
 	for vsn, servers := range versionMap {
 		len := len(servers)
-		exactWeight := weight.Versions[vsn] / len
-		remainder := weight.Versions[vsn] % len
+		versionWeight := weight.Versions[vsn] * scale
+		exactWeight := versionWeight / len
+		remainder := versionWeight % len
+		// keep every server of a weighted version in rotation
+		if versionWeight > 0 && exactWeight == 0 {
+			exactWeight, remainder = 1, 0
+		}
 		weights[vsn] = [2]int{exactWeight, remainder}
 	}
 	return weights
@@ -240,6 +409,9 @@ func formVersionWeights(weight application.Weight, versionMap map[string][]Serve
 func formVersionMap(frontend Frontend) map[string][]Server {
 	versions := map[string][]Server{}
 	for _, server := range frontend.Servers {
+		if !server.routable() {
+			continue
+		}
 		servers, ok := versions[server.Version]
 		if ok {
 			servers = append(servers, server)
@@ -0,0 +1,49 @@
+package haproxy
+
+import (
+	"fmt"
+
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+// PortError reports a task left out of a backend because it has no port
+// for the endpoint
+type PortError struct {
+	TaskId string
+	// Name of the port, or its index when the endpoint names none
+	Port   string
+	Reason string
+}
+
+func (e *PortError) Error() string {
+	return fmt.Sprintf("Task %s has no port %s: %s", e.TaskId, e.Port, e.Reason)
+}
+
+func (e *PortError) Detail() diagnostics.Detail {
+	return diagnostics.Detail{Field: "task", Value: e.TaskId, Message: e.Error()}
+}
+
+// Picks the port of a task an endpoint routes to, by name when the endpoint
+// has one and by its index otherwise
+func taskPort(task marathon.Task, endpoint marathon.Endpoint, epIdx int) (int, error) {
+	if endpoint.PortName == "" {
+		if epIdx >= len(task.Ports) {
+			return 0, &PortError{TaskId: task.Id, Port: fmt.Sprintf("#%d", epIdx),
+				Reason: fmt.Sprintf("it only has %d ports", len(task.Ports))}
+		}
+		return task.Ports[epIdx], nil
+	}
+
+	for i, name := range task.PortNames {
+		if name != endpoint.PortName {
+			continue
+		}
+		if i >= len(task.Ports) {
+			return 0, &PortError{TaskId: task.Id, Port: endpoint.PortName,
+				Reason: fmt.Sprintf("it only has %d ports", len(task.Ports))}
+		}
+		return task.Ports[i], nil
+	}
+	return 0, &PortError{TaskId: task.Id, Port: endpoint.PortName, Reason: "no port definition or mapping has that name"}
+}
@@ -0,0 +1,55 @@
+package haproxy
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	conf "github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+func TestTaskPorts(t *testing.T) {
+	Convey("#formFrontends", t, func() {
+		app := marathon.App{
+			Id:       "web",
+			Frontend: "web",
+			Endpoints: []marathon.Endpoint{
+				{SvcType: "pub", Protocol: "http", Bind: 80, PortName: "http"},
+				{SvcType: "pub", Protocol: "tcp", Bind: 9100},
+			},
+			Tasks: []marathon.Task{
+				{Id: "web.1", Server: "web-h1", Host: "h1", Ports: []int{31000, 31001, 31002}, PortNames: []string{"metrics", "http", "debug"}},
+				{Id: "web.2", Server: "web-h2", Host: "h2", Ports: []int{31005}, PortNames: []string{"debug"}},
+			},
+		}
+		frontends := formFrontends(marathon.AppList{app}, conf.HAProxy{})
+
+		Convey("it should route endpoints to named ports and keep extra ports out", func() {
+			So(len(frontends), ShouldEqual, 2)
+			So(len(frontends[0].Servers), ShouldEqual, 1)
+			So(frontends[0].Servers[0].Port, ShouldEqual, 31001)
+		})
+
+		Convey("it should fall back to the port at the endpoint's index", func() {
+			So(len(frontends[1].Servers), ShouldEqual, 1)
+			So(frontends[1].Servers[0].Port, ShouldEqual, 31001)
+		})
+
+		Convey("it should report each task missing a port", func() {
+			var problem diagnostics.Problem
+			for _, p := range diagnostics.All() {
+				if p.Source == diagnostics.SourcePorts {
+					problem = p
+				}
+			}
+			So(problem.AppId, ShouldEqual, "web")
+			So(problem.Skipped, ShouldBeFalse)
+			So(len(problem.Errors), ShouldEqual, 2)
+			So(problem.Errors[0].Value, ShouldEqual, "web.2")
+			So(problem.Errors[0].Message, ShouldContainSubstring, "no port http")
+			So(problem.Errors[1].Message, ShouldContainSubstring, "no port #1")
+		})
+	})
+}
@@ -0,0 +1,136 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Route sends the requests whose path starts with Uri to the backend of an app
+type Route struct {
+	Uri     string
+	Backend string
+	// Rules of the app, see rules.go
+	Rules []RoutingRule
+}
+
+// SharedFrontend is an http frontend serving several apps on one address
+// and port, the backend is picked by path prefix
+type SharedFrontend struct {
+	Name        string
+	BindAddress string
+	Bind        int
+	// Longest prefix first
+	Routes []Route
+	// Backend of the app on the same port without uri, or with uri "/"
+	DefaultBackend string
+	// Rules of the DefaultBackend app
+	DefaultRules []RoutingRule
+}
+
+type byPrefix []Route
+
+func (a byPrefix) Len() int {
+	return len(a)
+}
+func (a byPrefix) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a byPrefix) Less(i, j int) bool {
+	if len(a[i].Uri) != len(a[j].Uri) {
+		return len(a[i].Uri) > len(a[j].Uri)
+	}
+	return a[i].Uri < a[j].Uri
+}
+
+// Picks the address endpoints of a svcType bind to. Without BindAddresses
+// configured every endpoint binds all interfaces.
+func bindAddress(svcType string, addresses map[string]string) (string, error) {
+	if len(addresses) == 0 {
+		return "", nil
+	}
+	address, ok := addresses[svcType]
+	if !ok {
+		return "", &SettingError{Setting: "svcType", Value: svcType, Reason: "no address for it in HAProxy.BindAddresses"}
+	}
+	return address, nil
+}
+
+func listenAddress(frontend Frontend) string {
+	return fmt.Sprintf("%s:%d", frontend.BindAddress, frontend.Bind)
+}
+
+// Marks the frontends listening where an http frontend has a uri as Routed,
+// they are then served by a SharedFrontend. Frontends asking for a route
+// already taken, or for tcp on such a port, are left out and returned as
+// errors by app id.
+func routeFrontends(frontends []Frontend) ([]Frontend, map[string][]error) {
+	shared := map[string]bool{}
+	for _, frontend := range frontends {
+		if frontend.Protocol == "http" && frontend.Uri != "" {
+			shared[listenAddress(frontend)] = true
+		}
+	}
+
+	// listen address + uri => frontend name
+	taken := map[string]string{}
+	errors := map[string][]error{}
+	routed := []Frontend{}
+	for _, frontend := range frontends {
+		address := listenAddress(frontend)
+		if !shared[address] {
+			routed = append(routed, frontend)
+			continue
+		}
+		if frontend.Protocol != "http" {
+			errors[frontend.AppId] = append(errors[frontend.AppId],
+				&SettingError{Setting: "bind", Value: address, Reason: "already used by http routes"})
+			continue
+		}
+		uri := frontend.Uri
+		if uri == "" {
+			uri = "/"
+		}
+		if other, ok := taken[address+uri]; ok {
+			errors[frontend.AppId] = append(errors[frontend.AppId],
+				&SettingError{Setting: "uri", Value: uri, Reason: fmt.Sprintf("already routed to %s on %s", other, address)})
+			continue
+		}
+		taken[address+uri] = frontend.Name
+		frontend.Routed = true
+		routed = append(routed, frontend)
+	}
+	return routed, errors
+}
+
+// Groups the Routed frontends into the http frontends routing to them
+func formSharedFrontends(frontends []Frontend) []SharedFrontend {
+	byAddress := map[string]int{}
+	shared := []SharedFrontend{}
+	for _, frontend := range frontends {
+		if !frontend.Routed {
+			continue
+		}
+		address := listenAddress(frontend)
+		i, ok := byAddress[address]
+		if !ok {
+			name := fmt.Sprintf("shared-http-%d", frontend.Bind)
+			if frontend.BindAddress != "" {
+				name = fmt.Sprintf("shared-http-%s-%d", frontend.BindAddress, frontend.Bind)
+			}
+			shared = append(shared, SharedFrontend{Name: name, BindAddress: frontend.BindAddress, Bind: frontend.Bind})
+			i = len(shared) - 1
+			byAddress[address] = i
+		}
+
+		if frontend.Uri == "" || frontend.Uri == "/" {
+			shared[i].DefaultBackend = frontend.Name
+			shared[i].DefaultRules = frontend.Rules
+		} else {
+			shared[i].Routes = append(shared[i].Routes, Route{Uri: frontend.Uri, Backend: frontend.Name, Rules: frontend.Rules})
+		}
+	}
+	for _, frontend := range shared {
+		sort.Sort(byPrefix(frontend.Routes))
+	}
+	return shared
+}
@@ -0,0 +1,94 @@
+package haproxy
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	conf "github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+func routedApp(id string, endpoints ...marathon.Endpoint) marathon.App {
+	return marathon.App{Id: id, Frontend: id, Endpoints: endpoints}
+}
+
+func TestRoutes(t *testing.T) {
+	Convey("#formFrontends", t, func() {
+		Convey("When apps share a port by path", func() {
+			apps := marathon.AppList{
+				routedApp("web", marathon.Endpoint{SvcType: "pub", Protocol: "http", Bind: 80}),
+				routedApp("api", marathon.Endpoint{SvcType: "pub", Protocol: "http", Uri: "/api", Bind: 80}),
+				routedApp("apiv2", marathon.Endpoint{SvcType: "pub", Protocol: "http", Uri: "/api/v2", Bind: 80}),
+				routedApp("db", marathon.Endpoint{SvcType: "pub", Protocol: "tcp", Bind: 5432}),
+			}
+			frontends := formFrontends(apps, conf.HAProxy{})
+			shared := formSharedFrontends(frontends)
+
+			Convey("the http frontends on it should become backends of one shared frontend", func() {
+				So(len(frontends), ShouldEqual, 4)
+				for _, frontend := range frontends {
+					So(frontend.Routed, ShouldEqual, frontend.Bind == 80)
+				}
+				So(shared, ShouldResemble, []SharedFrontend{{
+					Name: "shared-http-80",
+					Bind: 80,
+					Routes: []Route{
+						{Uri: "/api/v2", Backend: "apiv2-http-80"},
+						{Uri: "/api", Backend: "api-http-80"},
+					},
+					DefaultBackend: "web-http-80",
+				}})
+			})
+		})
+
+		Convey("When routes clash", func() {
+			apps := marathon.AppList{
+				routedApp("api", marathon.Endpoint{SvcType: "pub", Protocol: "http", Uri: "/api", Bind: 80}),
+				routedApp("copy", marathon.Endpoint{SvcType: "pub", Protocol: "http", Uri: "/api", Bind: 80}),
+				routedApp("db", marathon.Endpoint{SvcType: "pub", Protocol: "tcp", Bind: 80}),
+			}
+			frontends := formFrontends(apps, conf.HAProxy{})
+
+			Convey("only the first app should get the route", func() {
+				So(len(frontends), ShouldEqual, 1)
+				So(frontends[0].Name, ShouldEqual, "api-http-80")
+			})
+
+			Convey("the others should be reported", func() {
+				problems := map[string]diagnostics.Problem{}
+				for _, problem := range diagnostics.All() {
+					if problem.Source == diagnostics.SourceRoutes {
+						problems[problem.AppId] = problem
+					}
+				}
+				So(len(problems), ShouldEqual, 2)
+				So(problems["copy"].Errors[0].Field, ShouldEqual, "uri")
+				So(problems["db"].Errors[0].Field, ShouldEqual, "bind")
+				So(problems["db"].Skipped, ShouldBeTrue)
+			})
+		})
+
+		Convey("When svcTypes have bind addresses", func() {
+			haproxyConf := conf.HAProxy{BindAddresses: map[string]string{"pub": "0.0.0.0", "inner": "10.0.0.5"}}
+			apps := marathon.AppList{
+				routedApp("web", marathon.Endpoint{SvcType: "pub", Protocol: "http", Bind: 80}),
+				routedApp("admin", marathon.Endpoint{SvcType: "inner", Protocol: "http", Bind: 81}),
+				routedApp("other", marathon.Endpoint{SvcType: "dmz", Protocol: "http", Bind: 82}),
+			}
+			frontends := formFrontends(apps, haproxyConf)
+
+			Convey("endpoints should bind their svcType's address", func() {
+				So(len(frontends), ShouldEqual, 2)
+				So(frontends[0].BindAddress, ShouldEqual, "0.0.0.0")
+				So(frontends[1].BindAddress, ShouldEqual, "10.0.0.5")
+			})
+
+			Convey("endpoints of unknown svcTypes should be left out", func() {
+				So(diagnostics.All()[0].AppId, ShouldEqual, "other")
+				So(diagnostics.All()[0].Errors[0].Field, ShouldEqual, "svcType")
+			})
+		})
+	})
+}
@@ -0,0 +1,106 @@
+package haproxy
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/QubitProducts/bamboo/services/application"
+)
+
+// VersionBackend serves a single version of an app, to the requests
+// matching a rule for it
+type VersionBackend struct {
+	Name    string
+	Version string
+	Servers []Server
+}
+
+// RoutingRule is a HAProxy ACL sending the requests it matches to a
+// VersionBackend
+type RoutingRule struct {
+	Acl       string
+	Condition string
+	Backend   string
+}
+
+// Characters HAProxy doesn't allow in backend names
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// Returns the ACL criterion matching the requests of a rule
+func ruleCondition(rule application.Rule) string {
+	switch {
+	case rule.Source != "":
+		return "src " + rule.Source
+	case rule.Header != "" && rule.Value == "":
+		return fmt.Sprintf("req.hdr(%s) -m found", rule.Header)
+	case rule.Header != "":
+		return fmt.Sprintf("req.hdr(%s) -m str %s", rule.Header, rule.Value)
+	case rule.Value == "":
+		return fmt.Sprintf("req.cook(%s) -m found", rule.Cookie)
+	}
+	return fmt.Sprintf("req.cook(%s) -m str %s", rule.Cookie, rule.Value)
+}
+
+// Adds the rules set in the weights of each app to its http frontends,
+// along with a backend per version they route to. The weighted backend
+// keeps serving the requests matching no rule. Invalid rules, and rules
+// for versions without servers, are left out and returned as errors by
+// app id.
+func applyRules(frontends []Frontend, weights []application.Weight) ([]Frontend, map[string][]error) {
+	rules := map[string][]application.Rule{}
+	errors := map[string][]error{}
+	for _, weight := range weights {
+		for _, rule := range weight.Rules {
+			err := rule.Validate()
+			if err != nil {
+				errors[weight.ID] = append(errors[weight.ID], err)
+				continue
+			}
+			rules[weight.ID] = append(rules[weight.ID], rule)
+		}
+	}
+
+	for i, frontend := range frontends {
+		appRules, ok := rules[frontend.AppId]
+		if !ok {
+			continue
+		}
+		if frontend.Protocol != "http" {
+			errors[frontend.AppId] = append(errors[frontend.AppId],
+				&SettingError{Setting: "rules", Value: frontend.Name, Reason: "only http endpoints can be routed by rules"})
+			continue
+		}
+
+		// backend name => whether the version has servers
+		backends := map[string]bool{}
+		for ruleIdx, rule := range appRules {
+			name := fmt.Sprintf("%s-%s", frontend.Name, unsafeName.ReplaceAllString(rule.Version, "_"))
+			hasServers, seen := backends[name]
+			if seen && !hasServers {
+				continue
+			}
+			if !seen {
+				servers := []Server{}
+				for _, server := range frontend.Servers {
+					if server.Version == rule.Version && !server.Disabled {
+						servers = append(servers, server)
+					}
+				}
+				backends[name] = len(servers) > 0
+				if len(servers) == 0 {
+					errors[frontend.AppId] = append(errors[frontend.AppId],
+						&SettingError{Setting: "rules", Value: rule.Version, Reason: fmt.Sprintf("no servers of this version on %s", frontend.Name)})
+					continue
+				}
+				frontend.VersionBackends = append(frontend.VersionBackends, VersionBackend{Name: name, Version: rule.Version, Servers: servers})
+			}
+			frontend.Rules = append(frontend.Rules, RoutingRule{
+				Acl:       fmt.Sprintf("%s-rule%d", frontend.Name, ruleIdx),
+				Condition: ruleCondition(rule),
+				Backend:   name,
+			})
+		}
+		frontends[i] = frontend
+	}
+	return frontends, errors
+}
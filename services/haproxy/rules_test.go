@@ -0,0 +1,92 @@
+package haproxy
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/services/application"
+)
+
+func TestRules(t *testing.T) {
+	Convey("#ruleCondition", t, func() {
+		Convey("should match headers and cookies by value or presence", func() {
+			So(ruleCondition(application.Rule{Header: "X-Canary", Value: "true"}), ShouldEqual, "req.hdr(X-Canary) -m str true")
+			So(ruleCondition(application.Rule{Header: "X-Canary"}), ShouldEqual, "req.hdr(X-Canary) -m found")
+			So(ruleCondition(application.Rule{Cookie: "canary", Value: "1"}), ShouldEqual, "req.cook(canary) -m str 1")
+			So(ruleCondition(application.Rule{Cookie: "canary"}), ShouldEqual, "req.cook(canary) -m found")
+		})
+
+		Convey("should match sources by range", func() {
+			So(ruleCondition(application.Rule{Source: "10.1.0.0/16"}), ShouldEqual, "src 10.1.0.0/16")
+		})
+	})
+
+	Convey("#applyRules", t, func() {
+		frontends := []Frontend{
+			{Name: "web-http-80", AppId: "/web", Protocol: "http", Servers: []Server{
+				{Name: "s1-v1-1", Version: "v1"},
+				{Name: "s2-v2-2", Version: "v2"},
+				{Name: "web-http-80-slot3", Version: "v2", Disabled: true},
+			}},
+			{Name: "web-tcp-81", AppId: "/web", Protocol: "tcp"},
+			{Name: "db-tcp-5432", AppId: "/db", Protocol: "tcp"},
+		}
+
+		Convey("should add a backend per version and the rules in order", func() {
+			weights := []application.Weight{{ID: "/web", Rules: []application.Rule{
+				{Version: "v2", Header: "X-Canary", Value: "true"},
+				{Version: "v1", Source: "10.0.0.0/8"},
+				{Version: "v2", Cookie: "canary"},
+			}}}
+			result, errors := applyRules(frontends, weights)
+
+			So(result[0].VersionBackends, ShouldResemble, []VersionBackend{
+				{Name: "web-http-80-v2", Version: "v2", Servers: []Server{{Name: "s2-v2-2", Version: "v2"}}},
+				{Name: "web-http-80-v1", Version: "v1", Servers: []Server{{Name: "s1-v1-1", Version: "v1"}}},
+			})
+			So(result[0].Rules, ShouldResemble, []RoutingRule{
+				{Acl: "web-http-80-rule0", Condition: "req.hdr(X-Canary) -m str true", Backend: "web-http-80-v2"},
+				{Acl: "web-http-80-rule1", Condition: "src 10.0.0.0/8", Backend: "web-http-80-v1"},
+				{Acl: "web-http-80-rule2", Condition: "req.cook(canary) -m found", Backend: "web-http-80-v2"},
+			})
+
+			Convey("and report tcp endpoints, which can't be routed by rules", func() {
+				So(result[1].Rules, ShouldBeNil)
+				So(len(errors["/web"]), ShouldEqual, 1)
+				So(result[2].Rules, ShouldBeNil)
+			})
+		})
+
+		Convey("should leave out invalid rules and versions without servers", func() {
+			weights := []application.Weight{{ID: "/web", Rules: []application.Rule{
+				{Version: "v2", Header: "X Canary"},
+				{Version: "v2", Header: "X-Canary", Cookie: "canary"},
+				{Version: "v2", Header: "X-Canary", Value: "a b"},
+				{Version: "v2", Source: "10.0.0.300/8"},
+				{Header: "X-Canary"},
+				{Version: "v3", Header: "X-Canary"},
+				{Version: "v3", Cookie: "canary"},
+			}}}
+			result, errors := applyRules(frontends[:1], weights)
+
+			So(result[0].Rules, ShouldBeNil)
+			So(result[0].VersionBackends, ShouldBeNil)
+			So(len(errors["/web"]), ShouldEqual, 6)
+		})
+	})
+
+	Convey("#formSharedFrontends", t, func() {
+		rules := []RoutingRule{{Acl: "a", Condition: "src 10.0.0.1", Backend: "b"}}
+		frontends := []Frontend{
+			{Name: "web-http-80", Protocol: "http", Bind: 80, Routed: true, Rules: rules},
+			{Name: "api-http-80", Protocol: "http", Bind: 80, Routed: true, Uri: "/api", Rules: rules},
+		}
+
+		Convey("should carry the rules of routed apps", func() {
+			shared := formSharedFrontends(frontends)
+			So(shared[0].DefaultRules, ShouldResemble, rules)
+			So(shared[0].Routes[0].Rules, ShouldResemble, rules)
+		})
+	})
+}
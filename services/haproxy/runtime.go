@@ -0,0 +1,124 @@
+package haproxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+var (
+	// ErrNoSuchServer is returned when HAProxy doesn't know the backend or server
+	// a runtime command refers to, i.e. its config is missing a reload
+	ErrNoSuchServer = errors.New("No such backend or server in running HAProxy")
+)
+
+const runtimeDefaultTimeout = time.Second * 5
+
+// RuntimeClient sends commands to the HAProxy runtime API exposed on the
+// admin stats socket, e.g. "stats socket /run/haproxy/admin.sock level admin"
+type RuntimeClient struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+func NewRuntimeClient(socketPath string) *RuntimeClient {
+	return &RuntimeClient{SocketPath: socketPath, Timeout: runtimeDefaultTimeout}
+}
+
+// Execute runs a single command and returns HAProxy's answer
+func (c *RuntimeClient) Execute(command string) (string, error) {
+	conn, err := net.DialTimeout("unix", c.SocketPath, c.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	_, err = conn.Write([]byte(command + "\n"))
+	if err != nil {
+		return "", err
+	}
+
+	// In non interactive mode HAProxy closes the connection after answering
+	output, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// Runs a command expected to answer nothing on success
+func (c *RuntimeClient) executeSilent(command string) error {
+	output, err := c.Execute(command)
+	if err != nil {
+		return err
+	}
+
+	answer := strings.TrimSpace(output)
+	switch {
+	case answer == "":
+		return nil
+	case strings.HasPrefix(answer, "No such"):
+		log.Printf("Runtime command %q: %s", command, answer)
+		return ErrNoSuchServer
+	}
+	return fmt.Errorf("Runtime command %q failed: %s", command, answer)
+}
+
+// SetWeight changes the weight of a server without reloading HAProxy
+func (c *RuntimeClient) SetWeight(backend string, server string, weight int) error {
+	return c.executeSilent(fmt.Sprintf("set weight %s/%s %d", backend, server, weight))
+}
+
+// SetServerAddr points a server at a new address without reloading HAProxy
+func (c *RuntimeClient) SetServerAddr(backend string, server string, host string, port int) error {
+	command := fmt.Sprintf("set server %s/%s addr %s port %d", backend, server, host, port)
+	output, err := c.Execute(command)
+	if err != nil {
+		return err
+	}
+
+	// HAProxy describes what changed, or that nothing had to
+	answer := strings.TrimSpace(output)
+	switch {
+	case strings.HasPrefix(answer, "No such"):
+		log.Printf("Runtime command %q: %s", command, answer)
+		return ErrNoSuchServer
+	case answer == "", strings.Contains(answer, "changed"), strings.HasPrefix(answer, "no need to change"):
+		return nil
+	}
+	return fmt.Errorf("Runtime command %q failed: %s", command, answer)
+}
+
+// SetServerState changes the administrative state of a server, one of
+// "ready", "drain" or "maint"
+func (c *RuntimeClient) SetServerState(backend string, server string, state string) error {
+	return c.executeSilent(fmt.Sprintf("set server %s/%s state %s", backend, server, state))
+}
+
+// ApplySlotChange moves a server slot to its new address, weight and state
+func (c *RuntimeClient) ApplySlotChange(change SlotChange) error {
+	if change.Disabled {
+		return c.SetServerState(change.Backend, change.Server, marathon.TaskStateMaint)
+	}
+
+	err := c.SetServerAddr(change.Backend, change.Server, change.Host, change.Port)
+	if err != nil {
+		return err
+	}
+	err = c.SetWeight(change.Backend, change.Server, change.Weight)
+	if err != nil {
+		return err
+	}
+	state := change.State
+	if state == "" {
+		state = marathon.TaskStateReady
+	}
+	return c.SetServerState(change.Backend, change.Server, state)
+}
@@ -0,0 +1,180 @@
+package haproxy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Address rendered for slots without a task, they are also disabled
+const (
+	freeSlotHost = "127.0.0.1"
+	freeSlotPort = 1
+)
+
+// Frontend name => server address ("host:port") held by each slot, "" if free
+var slotAssignments = map[string][]string{}
+var slotLock sync.Mutex
+
+// SlotChange describes a server slot to update through the runtime API
+type SlotChange struct {
+	Backend  string
+	Server   string
+	Host     string
+	Port     int
+	Weight   int
+	Disabled bool
+	State    string
+}
+
+func serverAddr(server Server) string {
+	return fmt.Sprintf("%s:%d", server.Host, server.Port)
+}
+
+// Places servers into a fixed number of named slots per frontend. A server
+// keeps its slot for as long as it exists, so adding or removing tasks only
+// changes the address and state of single slots. The slot count grows by
+// multiples of slots when they run out.
+func assignSlots(frontendName string, servers []Server, slots int) []Server {
+	slotLock.Lock()
+	defer slotLock.Unlock()
+
+	byAddr := make(map[string]Server, len(servers))
+	for _, server := range servers {
+		byAddr[serverAddr(server)] = server
+	}
+
+	assigned := slotAssignments[frontendName]
+	taken := map[string]bool{}
+	for i, addr := range assigned {
+		if _, ok := byAddr[addr]; ok {
+			taken[addr] = true
+		} else {
+			assigned[i] = ""
+		}
+	}
+
+	for _, server := range servers {
+		addr := serverAddr(server)
+		if taken[addr] {
+			continue
+		}
+		taken[addr] = true
+		placed := false
+		for i := range assigned {
+			if assigned[i] == "" {
+				assigned[i] = addr
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			assigned = append(assigned, addr)
+		}
+	}
+
+	size := slots
+	for size < len(assigned) {
+		size += slots
+	}
+	for len(assigned) < size {
+		assigned = append(assigned, "")
+	}
+	slotAssignments[frontendName] = assigned
+
+	result := make([]Server, len(assigned))
+	for i, addr := range assigned {
+		name := fmt.Sprintf("%s-slot%d", frontendName, i+1)
+		if addr == "" {
+			result[i] = Server{Name: name, Host: freeSlotHost, Port: freeSlotPort, Disabled: true}
+			continue
+		}
+		server := byAddr[addr]
+		server.Name = name
+		result[i] = server
+	}
+	return result
+}
+
+// Forgets the slots of frontends that no longer exist
+func pruneSlots(frontends []Frontend) {
+	slotLock.Lock()
+	defer slotLock.Unlock()
+
+	names := make(map[string]bool, len(frontends))
+	for _, frontend := range frontends {
+		names[frontend.Name] = true
+	}
+	for name := range slotAssignments {
+		if !names[name] {
+			delete(slotAssignments, name)
+		}
+	}
+}
+
+// Returns the server without the fields the runtime API can change
+func slotStructure(server Server) Server {
+	server.Host = ""
+	server.Port = 0
+	server.Version = ""
+	server.Weight = 0
+	server.Disabled = false
+	server.State = ""
+	return server
+}
+
+// SlotChanges compares the frontends running in HAProxy with freshly formed
+// ones. It returns the slots to update at runtime, or reloadRequired when a
+// frontend was added, removed or changed beyond its slots' address, state and
+// weight, so tasks starting to drain or becoming ready don't need a reload.
+// weights holds the rendered server weights, servers missing from it get
+// weight 1 like in the template.
+func SlotChanges(applied []Frontend, current []Frontend, weights map[string]int) (changes []SlotChange, reloadRequired bool) {
+	if len(applied) != len(current) {
+		return nil, true
+	}
+
+	appliedByName := make(map[string]Frontend, len(applied))
+	for _, frontend := range applied {
+		appliedByName[frontend.Name] = frontend
+	}
+
+	changes = []SlotChange{}
+	for _, frontend := range current {
+		old, ok := appliedByName[frontend.Name]
+		if !ok || len(old.Servers) != len(frontend.Servers) {
+			return nil, true
+		}
+
+		oldFrontend, newFrontend := old, frontend
+		oldFrontend.Servers, newFrontend.Servers = nil, nil
+		if !reflect.DeepEqual(oldFrontend, newFrontend) {
+			return nil, true
+		}
+
+		for i, server := range frontend.Servers {
+			oldServer := old.Servers[i]
+			if !reflect.DeepEqual(slotStructure(oldServer), slotStructure(server)) {
+				return nil, true
+			}
+			if reflect.DeepEqual(oldServer, server) {
+				continue
+			}
+
+			weight, ok := weights[server.Name]
+			if !ok {
+				weight = 1
+			}
+			changes = append(changes, SlotChange{
+				Backend:  frontend.Name,
+				Server:   server.Name,
+				Host:     server.Host,
+				Port:     server.Port,
+				Weight:   weight,
+				Disabled: server.Disabled,
+				State:    server.State,
+			})
+		}
+	}
+	return changes, false
+}
@@ -0,0 +1,108 @@
+package haproxy
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+)
+
+func TestAssignSlots(t *testing.T) {
+	Convey("#assignSlots", t, func() {
+		slotAssignments = map[string][]string{}
+		a := Server{Host: "10.0.0.1", Port: 31000, Version: "v1"}
+		b := Server{Host: "10.0.0.2", Port: 31001, Version: "v1"}
+		c := Server{Host: "10.0.0.3", Port: 31002, Version: "v1"}
+
+		first := assignSlots("app-http-80", []Server{a, b}, 3)
+
+		Convey("should pad the servers with disabled slots", func() {
+			So(len(first), ShouldEqual, 3)
+			So(first[0].Name, ShouldEqual, "app-http-80-slot1")
+			So(first[0].Host, ShouldEqual, "10.0.0.1")
+			So(first[2].Disabled, ShouldBeTrue)
+		})
+
+		Convey("should keep servers in their slot when another one goes away", func() {
+			servers := assignSlots("app-http-80", []Server{b, c}, 3)
+			So(servers[0].Host, ShouldEqual, "10.0.0.3")
+			So(servers[1].Host, ShouldEqual, "10.0.0.2")
+			So(servers[2].Disabled, ShouldBeTrue)
+		})
+
+		Convey("should grow by the slot count when slots run out", func() {
+			d := Server{Host: "10.0.0.4", Port: 31003, Version: "v1"}
+			servers := assignSlots("app-http-80", []Server{a, b, c, d}, 3)
+			So(len(servers), ShouldEqual, 6)
+			So(servers[3].Host, ShouldEqual, "10.0.0.4")
+		})
+	})
+}
+
+func TestSlotChanges(t *testing.T) {
+	Convey("#SlotChanges", t, func() {
+		applied := []Frontend{{
+			Name:     "app-http-80",
+			Protocol: "http",
+			Bind:     80,
+			Servers: []Server{
+				{Name: "app-http-80-slot1", Host: "10.0.0.1", Port: 31000, Version: "v1", Weight: 1},
+				{Name: "app-http-80-slot2", Host: freeSlotHost, Port: freeSlotPort, Disabled: true},
+			},
+		}}
+
+		Convey("When a task fills a free slot", func() {
+			current := []Frontend{applied[0]}
+			current[0].Servers = []Server{
+				applied[0].Servers[0],
+				{Name: "app-http-80-slot2", Host: "10.0.0.2", Port: 31001, Version: "v1", Weight: 1},
+			}
+			changes, reloadRequired := SlotChanges(applied, current, map[string]int{"app-http-80-slot2": 2})
+
+			Convey("it should be applied at runtime", func() {
+				So(reloadRequired, ShouldBeFalse)
+				So(changes, ShouldResemble, []SlotChange{{
+					Backend: "app-http-80",
+					Server:  "app-http-80-slot2",
+					Host:    "10.0.0.2",
+					Port:    31001,
+					Weight:  2,
+				}})
+			})
+		})
+
+		Convey("When a task goes away", func() {
+			current := []Frontend{applied[0]}
+			current[0].Servers = []Server{
+				{Name: "app-http-80-slot1", Host: freeSlotHost, Port: freeSlotPort, Disabled: true},
+				applied[0].Servers[1],
+			}
+			changes, reloadRequired := SlotChanges(applied, current, map[string]int{})
+
+			Convey("its slot should be disabled at runtime", func() {
+				So(reloadRequired, ShouldBeFalse)
+				So(len(changes), ShouldEqual, 1)
+				So(changes[0].Disabled, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the slot count changes", func() {
+			current := []Frontend{applied[0]}
+			current[0].Servers = append(applied[0].Servers, Server{Name: "app-http-80-slot3", Disabled: true})
+			_, reloadRequired := SlotChanges(applied, current, map[string]int{})
+
+			Convey("a reload should be required", func() {
+				So(reloadRequired, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a frontend is added", func() {
+			current := append([]Frontend{}, applied...)
+			current = append(current, Frontend{Name: "db-tcp-5432", Protocol: "tcp", Bind: 5432})
+			_, reloadRequired := SlotChanges(applied, current, map[string]int{})
+
+			Convey("a reload should be required", func() {
+				So(reloadRequired, ShouldBeTrue)
+			})
+		})
+	})
+}
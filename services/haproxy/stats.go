@@ -0,0 +1,152 @@
+package haproxy
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ServerStats are the counters HAProxy keeps for a server since its last
+// reload
+type ServerStats struct {
+	Backend string
+	Server  string
+	// HTTP responses of any status
+	Responses int64
+	// HTTP responses with a 5xx status
+	Errors5xx int64
+	// Failed health checks
+	CheckFailures int64
+	// Average response time in ms of the last 1024 requests
+	ResponseTime int64
+}
+
+// VersionStats sums up the stats of the servers of an app version
+type VersionStats struct {
+	Servers       int
+	Responses     int64
+	Errors5xx     int64
+	CheckFailures int64
+	// Average response time in ms, weighted by the responses of each server
+	ResponseTime float64
+}
+
+// Columns of "show stat" summed into Responses
+var responseColumns = []string{"hrsp_1xx", "hrsp_2xx", "hrsp_3xx", "hrsp_4xx", "hrsp_5xx", "hrsp_other"}
+
+// ParseStats reads the server rows of the CSV output of "show stat" or of
+// the ";csv" stats page
+func ParseStats(content string) ([]ServerStats, error) {
+	if !strings.HasPrefix(content, "# ") {
+		return nil, fmt.Errorf("HAProxy stats don't start with a header")
+	}
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(content, "# ")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, name := range []string{"pxname", "svname", "chkfail", "rtime"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("HAProxy stats lack the %s column", name)
+		}
+	}
+	value := func(record []string, name string) int64 {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return 0
+		}
+		n, _ := strconv.ParseInt(record[i], 10, 64)
+		return n
+	}
+
+	stats := []ServerStats{}
+	for _, record := range records[1:] {
+		if len(record) <= columns["svname"] {
+			continue
+		}
+		server := record[columns["svname"]]
+		if server == "FRONTEND" || server == "BACKEND" {
+			continue
+		}
+		s := ServerStats{
+			Backend:       record[columns["pxname"]],
+			Server:        server,
+			Errors5xx:     value(record, "hrsp_5xx"),
+			CheckFailures: value(record, "chkfail"),
+			ResponseTime:  value(record, "rtime"),
+		}
+		for _, name := range responseColumns {
+			s.Responses += value(record, name)
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// Stats reads the server stats over the admin socket
+func (c *RuntimeClient) Stats() ([]ServerStats, error) {
+	output, err := c.Execute("show stat")
+	if err != nil {
+		return nil, err
+	}
+	return ParseStats(output)
+}
+
+// FetchStats reads the server stats from the CSV stats page
+func FetchStats(url string) ([]ServerStats, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HAProxy stats page: status %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ParseStats(string(content))
+}
+
+// StatsByVersion sums up the stats of the routable servers of a frontend
+// by app version
+func StatsByVersion(frontend Frontend, stats []ServerStats) map[string]VersionStats {
+	byServer := make(map[string]ServerStats, len(stats))
+	for _, s := range stats {
+		if s.Backend == frontend.Name {
+			byServer[s.Server] = s
+		}
+	}
+
+	versions := map[string]VersionStats{}
+	for version, servers := range formVersionMap(frontend) {
+		sum := VersionStats{}
+		var weightedTime int64
+		for _, server := range servers {
+			s, ok := byServer[server.Name]
+			if !ok {
+				continue
+			}
+			sum.Servers++
+			sum.Responses += s.Responses
+			sum.Errors5xx += s.Errors5xx
+			sum.CheckFailures += s.CheckFailures
+			weightedTime += s.ResponseTime * s.Responses
+		}
+		if sum.Responses > 0 {
+			sum.ResponseTime = float64(weightedTime) / float64(sum.Responses)
+		}
+		versions[version] = sum
+	}
+	return versions
+}
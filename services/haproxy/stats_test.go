@@ -0,0 +1,54 @@
+package haproxy
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+)
+
+const showStat = `# pxname,svname,qcur,chkfail,rtime,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other,
+web-http-80,FRONTEND,,,,0,300,0,0,12,0,
+web-http-80,srv1-v1-31000,0,1,20,0,100,0,0,2,0,
+web-http-80,srv2-v1-31001,0,0,40,0,100,0,0,0,0,
+web-http-80,srv3-v2-31002,0,3,90,0,90,0,0,10,0,
+web-http-80,BACKEND,0,,,0,290,0,0,12,0,
+`
+
+func TestParseStats(t *testing.T) {
+	Convey("#ParseStats", t, func() {
+		Convey("should read the server rows by column name", func() {
+			stats, err := ParseStats(showStat)
+			So(err, ShouldBeNil)
+			So(len(stats), ShouldEqual, 3)
+			So(stats[2], ShouldResemble, ServerStats{
+				Backend:       "web-http-80",
+				Server:        "srv3-v2-31002",
+				Responses:     100,
+				Errors5xx:     10,
+				CheckFailures: 3,
+				ResponseTime:  90,
+			})
+		})
+
+		Convey("should reject output without a header", func() {
+			_, err := ParseStats("Unknown command.\n")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("#StatsByVersion", t, func() {
+		stats, _ := ParseStats(showStat)
+		frontend := Frontend{Name: "web-http-80", Servers: []Server{
+			{Name: "srv1-v1-31000", Version: "v1"},
+			{Name: "srv2-v1-31001", Version: "v1"},
+			{Name: "srv3-v2-31002", Version: "v2"},
+			{Name: "srv4-v2-31003", Version: "v2", State: "drain"},
+		}}
+
+		Convey("should sum the servers of each version", func() {
+			versions := StatsByVersion(frontend, stats)
+			So(versions["v1"], ShouldResemble, VersionStats{Servers: 2, Responses: 202, Errors5xx: 2, CheckFailures: 1, ResponseTime: float64(20*102+40*100) / 202})
+			So(versions["v2"], ShouldResemble, VersionStats{Servers: 1, Responses: 100, Errors5xx: 10, CheckFailures: 3, ResponseTime: 90})
+		})
+	})
+}
@@ -0,0 +1,108 @@
+package haproxy
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/QubitProducts/bamboo/services/application"
+)
+
+const (
+	// Sum of the version weights of an app
+	totalWeight = 100
+	// Highest server weight HAProxy accepts
+	maxServerWeight = 256
+)
+
+// ValidateWeight checks a weight against the live versions of its app,
+// returning a SettingError per invalid field
+func ValidateWeight(weight application.Weight) []error {
+	errors := []error{}
+	invalid := func(field string, value string, reason string) {
+		errors = append(errors, &SettingError{Setting: field, Value: value, Reason: reason})
+	}
+
+	if weight.ID == "" {
+		invalid("id", "", "a weight needs an app id")
+		return errors
+	}
+	frontend, ok := LookupFrontend(weight.ID)
+	if !ok {
+		invalid("id", weight.ID, "no such app")
+		return errors
+	}
+	live := formVersionMap(frontend)
+
+	if len(weight.Versions) == 0 && weight.Primary == "" {
+		invalid("versions", "", "a weight needs versions or a primary version")
+	}
+	if _, ok := live[weight.Primary]; weight.Primary != "" && !ok {
+		invalid("primary", weight.Primary, "no routable servers of this version")
+	}
+	total := 0
+	for version, w := range weight.Versions {
+		field := "versions." + version
+		if w < 0 {
+			invalid(field, strconv.Itoa(w), "weights can't be negative")
+		}
+		if _, ok := live[version]; !ok && w > 0 {
+			invalid(field, strconv.Itoa(w), "no routable servers of this version")
+		}
+		total += w
+	}
+	if len(weight.Versions) > 0 && total != totalWeight {
+		invalid("versions", strconv.Itoa(total), fmt.Sprintf("weights must add up to %d", totalWeight))
+	}
+
+	for i, rule := range weight.Rules {
+		err := rule.Validate()
+		if ruleErr, ok := err.(*application.RuleError); ok {
+			invalid(fmt.Sprintf("rules[%d].%s", i, ruleErr.Field), ruleErr.Value, ruleErr.Reason)
+			continue
+		}
+		if _, ok := live[rule.Version]; !ok {
+			invalid(fmt.Sprintf("rules[%d].version", i), rule.Version, "no routable servers of this version")
+		}
+	}
+	return errors
+}
+
+// A weight without Versions sends all the traffic to its primary version
+func withPrimary(weight application.Weight) application.Weight {
+	if len(weight.Versions) == 0 && weight.Primary != "" {
+		weight.Versions = map[string]int{weight.Primary: totalWeight}
+	}
+	return weight
+}
+
+// Returns what the version weights are multiplied by so every server of a
+// weighted version gets a weight of at least 1, unless that would take a
+// server over maxServerWeight
+func weightScale(weight application.Weight, versionMap map[string][]Server) int {
+	scale := 1
+	for vsn, servers := range versionMap {
+		w := weight.Versions[vsn]
+		if w <= 0 {
+			continue
+		}
+		if needed := (len(servers) + w - 1) / w; needed > scale {
+			scale = needed
+		}
+	}
+	for scale > 1 && maxFirstServerWeight(weight, versionMap, scale) > maxServerWeight {
+		scale--
+	}
+	return scale
+}
+
+// The first server of a version gets the remainder, so the most weight
+func maxFirstServerWeight(weight application.Weight, versionMap map[string][]Server, scale int) int {
+	max := 0
+	for vsn, servers := range versionMap {
+		w := weight.Versions[vsn] * scale
+		if first := w/len(servers) + w%len(servers); first > max {
+			max = first
+		}
+	}
+	return max
+}
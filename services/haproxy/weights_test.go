@@ -0,0 +1,210 @@
+package haproxy
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	conf "github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/application"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+// A frontend with the given number of servers of each version
+func versionedFrontend(name string, counts map[string]int) Frontend {
+	frontend := Frontend{Name: name}
+	for version, count := range counts {
+		for i := 0; i < count; i++ {
+			frontend.Servers = append(frontend.Servers, Server{Name: fmt.Sprintf("s%d-%s", i, version), Version: version})
+		}
+	}
+	return frontend
+}
+
+// Sets the frontend of an app as if it had just been rendered
+func renderedFrontend(id string, frontend Frontend) {
+	frontend.AppId = id
+	setFrontends([]Frontend{frontend})
+}
+
+// Sums the server weights of each version
+func versionTotals(frontend Frontend, servers []map[string]interface{}) map[string]int {
+	versions := map[string]string{}
+	for _, server := range frontend.Servers {
+		versions[server.Name] = server.Version
+	}
+	totals := map[string]int{}
+	for _, server := range servers {
+		totals[versions[server["server"].(string)]] += server["weight"].(int)
+	}
+	return totals
+}
+
+func TestCalcWeights(t *testing.T) {
+	Convey("#CalcWeights", t, func() {
+		Convey("should keep weights that split evenly", func() {
+			frontend := versionedFrontend("web", map[string]int{"v1": 2, "v2": 1})
+			servers := CalcWeights(frontend, application.Weight{Versions: map[string]int{"v1": 90, "v2": 10}})
+			So(versionTotals(frontend, servers), ShouldResemble, map[string]int{"v1": 90, "v2": 10})
+			for _, server := range servers {
+				So(server["weight"], ShouldBeIn, []int{45, 10})
+			}
+		})
+
+		Convey("should scale small weights so no server of the version gets 0", func() {
+			frontend := versionedFrontend("web", map[string]int{"v1": 10, "v2": 20})
+			servers := CalcWeights(frontend, application.Weight{Versions: map[string]int{"v1": 95, "v2": 5}})
+			for _, server := range servers {
+				So(server["weight"], ShouldBeGreaterThan, 0)
+			}
+			So(versionTotals(frontend, servers), ShouldResemble, map[string]int{"v1": 380, "v2": 20})
+		})
+
+		Convey("should stay within the highest HAProxy weight", func() {
+			frontend := versionedFrontend("web", map[string]int{"v1": 1, "v2": 300})
+			servers := CalcWeights(frontend, application.Weight{Versions: map[string]int{"v1": 99, "v2": 1}})
+			for _, server := range servers {
+				So(server["weight"], ShouldBeBetweenOrEqual, 1, maxServerWeight)
+			}
+		})
+
+		Convey("should leave unweighted versions at 0", func() {
+			frontend := versionedFrontend("web", map[string]int{"v1": 3, "v2": 1})
+			servers := CalcWeights(frontend, application.Weight{Versions: map[string]int{"v1": 100}})
+			So(versionTotals(frontend, servers), ShouldResemble, map[string]int{"v1": 100, "v2": 0})
+		})
+	})
+}
+
+func TestValidateWeight(t *testing.T) {
+	Convey("#ValidateWeight", t, func() {
+		renderedFrontend("/web", versionedFrontend("web-http-80", map[string]int{"v1": 2, "v2": 1}))
+		Reset(func() {
+			setFrontends(nil)
+		})
+		fields := func(errs []error) []string {
+			fields := []string{}
+			for _, err := range errs {
+				fields = append(fields, diagnostics.DetailOf(err).Field)
+			}
+			return fields
+		}
+
+		Convey("should accept live versions adding up to 100", func() {
+			errs := ValidateWeight(application.Weight{ID: "/web", Versions: map[string]int{"v1": 95, "v2": 5},
+				Rules: []application.Rule{{Version: "v2", Header: "X-Canary"}}})
+			So(errs, ShouldBeEmpty)
+		})
+
+		Convey("should reject unknown apps", func() {
+			So(fields(ValidateWeight(application.Weight{ID: "/other", Versions: map[string]int{"v1": 100}})), ShouldResemble, []string{"id"})
+		})
+
+		Convey("should reject unknown versions and negative weights", func() {
+			errs := ValidateWeight(application.Weight{ID: "/web", Versions: map[string]int{"v3": 110, "v1": -10}})
+			So(fields(errs), ShouldContain, "versions.v3")
+			So(fields(errs), ShouldContain, "versions.v1")
+			So(len(errs), ShouldEqual, 2)
+		})
+
+		Convey("should reject totals other than 100", func() {
+			errs := ValidateWeight(application.Weight{ID: "/web", Versions: map[string]int{"v1": 50, "v2": 10}})
+			So(fields(errs), ShouldResemble, []string{"versions"})
+			So(diagnostics.DetailOf(errs[0]).Value, ShouldEqual, "60")
+		})
+
+		Convey("should reject invalid rules by index", func() {
+			errs := ValidateWeight(application.Weight{ID: "/web", Versions: map[string]int{"v1": 100},
+				Rules: []application.Rule{{Version: "v2", Header: "X Canary"}, {Version: "v3", Cookie: "canary"}}})
+			So(fields(errs), ShouldResemble, []string{"rules[0].header", "rules[1].version"})
+		})
+	})
+}
+
+func TestPrimaryVersion(t *testing.T) {
+	Convey("#handleCanary", t, func() {
+		app := marathon.App{Id: "web", CurVsn: "v1", Versions: []string{"v1", "v2"}, Tasks: []marathon.Task{
+			{Version: "v1"},
+			{Version: "v2"},
+		}}
+
+		Convey("should route the oldest version without a primary", func() {
+			apps := handleCanary(marathon.AppList{app}, nil)
+			So(apps[0].CurVsn, ShouldEqual, "v1")
+			So(apps[0].Tasks[0].Weight, ShouldEqual, 1)
+			So(apps[0].Tasks[1].Weight, ShouldEqual, 0)
+		})
+
+		Convey("should route the primary version of the weight", func() {
+			apps := handleCanary(marathon.AppList{app}, []application.Weight{{ID: "web", Primary: "v2"}})
+			So(apps[0].CurVsn, ShouldEqual, "v2")
+			So(apps[0].Tasks[0].Weight, ShouldEqual, 0)
+			So(apps[0].Tasks[1].Weight, ShouldEqual, 1)
+		})
+
+		Convey("should ignore a primary version that isn't running", func() {
+			apps := handleCanary(marathon.AppList{app}, []application.Weight{{ID: "web", Primary: "v3"}})
+			So(apps[0].CurVsn, ShouldEqual, "v1")
+		})
+
+		Convey("should take the endpoints and service ports of the primary version", func() {
+			app.Endpoints = []marathon.Endpoint{{Protocol: "http", Bind: 80}}
+			app.ServicePort, app.ServicePorts = 10000, []int{10000}
+			app.VersionPorts = map[string]marathon.VersionPorts{
+				"v1": {Endpoints: app.Endpoints, ServicePorts: app.ServicePorts},
+				"v2": {Endpoints: []marathon.Endpoint{{Protocol: "http", Bind: 8080}}, ServicePorts: []int{10001}},
+			}
+			apps := handleCanary(marathon.AppList{app}, []application.Weight{{ID: "web", Primary: "v2"}})
+			So(apps[0].Endpoints[0].Bind, ShouldEqual, 8080)
+			So(apps[0].ServicePort, ShouldEqual, 10001)
+			frontends := formFrontends(apps, conf.HAProxy{})
+			So(frontends[0].Bind, ShouldEqual, 8080)
+		})
+	})
+
+	Convey("#CalcWeights", t, func() {
+		Convey("should send the traffic of a weight without versions to its primary", func() {
+			frontend := versionedFrontend("web", map[string]int{"v1": 1, "v2": 2})
+			servers := CalcWeights(frontend, application.Weight{Primary: "v2"})
+			So(versionTotals(frontend, servers), ShouldResemble, map[string]int{"v1": 0, "v2": 100})
+		})
+	})
+
+	Convey("#ValidateWeight", t, func() {
+		renderedFrontend("web", versionedFrontend("web-http-80", map[string]int{"v1": 1}))
+		Reset(func() {
+			setFrontends(nil)
+		})
+
+		Convey("should accept a primary version alone", func() {
+			So(ValidateWeight(application.Weight{ID: "web", Primary: "v1"}), ShouldBeEmpty)
+		})
+
+		Convey("should reject a primary version without servers", func() {
+			errs := ValidateWeight(application.Weight{ID: "web", Primary: "v2"})
+			So(len(errs), ShouldEqual, 1)
+			So(diagnostics.DetailOf(errs[0]).Field, ShouldEqual, "primary")
+		})
+	})
+}
+
+func TestSetFrontends(t *testing.T) {
+	Convey("#setFrontends", t, func() {
+		renderedFrontend("/old", versionedFrontend("old-http-80", map[string]int{"v1": 1}))
+		Reset(func() {
+			setFrontends(nil)
+		})
+
+		Convey("should drop the frontends of apps gone since the previous render", func() {
+			setFrontends([]Frontend{{Name: "web-http-80", AppId: "/web"}})
+			_, ok := LookupFrontend("/old")
+			So(ok, ShouldBeFalse)
+			frontend, ok := LookupFrontend("/web")
+			So(ok, ShouldBeTrue)
+			So(frontend.Name, ShouldEqual, "web-http-80")
+			So(len(Frontends()), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,227 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pinnedFile = "pinned"
+
+// DiskStorage keeps the config history as files under a local directory,
+// <id>.cfg holds the config and <id>.json the entry describing it
+type DiskStorage struct {
+	path string
+	size int
+	lock sync.Mutex
+}
+
+type byID []Entry
+
+func (a byID) Len() int {
+	return len(a)
+}
+func (a byID) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a byID) Less(i, j int) bool {
+	return a[i].ID < a[j].ID
+}
+
+// NewDiskStorage keeps at most size entries under path, creating it if needed
+func NewDiskStorage(path string, size int) (*DiskStorage, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("History size must be positive, got %d", size)
+	}
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskStorage{path: path, size: size}, nil
+}
+
+func (d *DiskStorage) All() ([]Entry, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.entries()
+}
+
+func (d *DiskStorage) Get(id string) (entry Entry, content string, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.get(id)
+}
+
+func (d *DiskStorage) Record(eventType string, content string) (entry Entry, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	entries, err := d.entries()
+	if err != nil {
+		return
+	}
+
+	hash := Hash(content)
+	nextID := 1
+	if len(entries) > 0 {
+		latest := entries[len(entries)-1]
+		if latest.Hash == hash {
+			return latest, nil
+		}
+		seq, _ := strconv.Atoi(latest.ID)
+		nextID = seq + 1
+	}
+
+	entry = Entry{
+		ID:        fmt.Sprintf("%08d", nextID),
+		Timestamp: time.Now(),
+		EventType: eventType,
+		Hash:      hash,
+	}
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(d.contentPath(entry.ID), []byte(content), 0644)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(d.entryPath(entry.ID), body, 0644)
+	if err != nil {
+		return
+	}
+
+	d.prune(append(entries, entry))
+	return
+}
+
+func (d *DiskStorage) Pin(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, _, err := d.get(id)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(d.path, pinnedFile), []byte(id), 0644)
+}
+
+func (d *DiskStorage) Unpin() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := os.Remove(filepath.Join(d.path, pinnedFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DiskStorage) Pinned() (*Entry, string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	id := d.pinnedID()
+	if id == "" {
+		return nil, "", nil
+	}
+	entry, content, err := d.get(id)
+	if err != nil {
+		return nil, "", err
+	}
+	return &entry, content, nil
+}
+
+func (d *DiskStorage) entries() ([]Entry, error) {
+	files, err := filepath.Glob(filepath.Join(d.path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := d.pinnedID()
+	entries := make([]Entry, 0, len(files))
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var entry Entry
+		err = json.Unmarshal(body, &entry)
+		if err != nil {
+			log.Printf("Failed to parse history entry at %v: %v", file, err)
+			continue
+		}
+		entry.Pinned = entry.ID == pinned
+		entries = append(entries, entry)
+	}
+	sort.Sort(byID(entries))
+	return entries, nil
+}
+
+func (d *DiskStorage) get(id string) (entry Entry, content string, err error) {
+	// ids are generated, anything else must not escape the history directory
+	if _, convErr := strconv.Atoi(id); convErr != nil {
+		return entry, "", ErrNotFound
+	}
+
+	body, err := ioutil.ReadFile(d.entryPath(id))
+	if os.IsNotExist(err) {
+		return entry, "", ErrNotFound
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &entry)
+	if err != nil {
+		return
+	}
+	entry.Pinned = entry.ID == d.pinnedID()
+
+	contentBytes, err := ioutil.ReadFile(d.contentPath(id))
+	if err != nil {
+		return
+	}
+	return entry, string(contentBytes), nil
+}
+
+// Removes the oldest entries beyond the configured size, the pinned and the
+// latest entries are always kept
+func (d *DiskStorage) prune(entries []Entry) {
+	pinned := d.pinnedID()
+	excess := len(entries) - d.size
+	for _, entry := range entries[:len(entries)-1] {
+		if excess <= 0 {
+			return
+		}
+		if entry.ID == pinned {
+			continue
+		}
+		os.Remove(d.entryPath(entry.ID))
+		os.Remove(d.contentPath(entry.ID))
+		excess--
+	}
+}
+
+func (d *DiskStorage) pinnedID() string {
+	body, err := ioutil.ReadFile(filepath.Join(d.path, pinnedFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(body))
+}
+
+func (d *DiskStorage) entryPath(id string) string {
+	return filepath.Join(d.path, id+".json")
+}
+
+func (d *DiskStorage) contentPath(id string) string {
+	return filepath.Join(d.path, id+".cfg")
+}
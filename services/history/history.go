@@ -0,0 +1,129 @@
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	//ErrNotFound unknown history entry
+	ErrNotFound = errors.New("History entry not found")
+)
+
+// Entry describes a rendered HAProxy config kept in the history
+type Entry struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	EventType string    `json:"eventType"`
+	Hash      string    `json:"hash"`
+	Pinned    bool      `json:"pinned"`
+}
+
+// The storage primitives required to keep a bounded config history
+type Storage interface {
+	// All returns the kept entries, oldest first
+	All() ([]Entry, error)
+	Get(id string) (Entry, string, error)
+	// Record stores content unless it matches the latest entry
+	Record(eventType string, content string) (Entry, error)
+	// Pin makes the config of entry id win over newly rendered configs
+	Pin(id string) error
+	Unpin() error
+	// Pinned returns the pinned entry and its content, or nil if none is pinned
+	Pinned() (*Entry, string, error)
+}
+
+// Hash returns the content hash recorded on entries
+func Hash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Beyond this many compared line pairs Diff gives up on finding common lines
+// and reports a full replacement
+const maxDiffCells = 4000000
+
+// Diff returns a line based diff between two configs. Lines are prefixed with
+// ' ' when unchanged, '-' when only in from and '+' when only in to.
+func Diff(from string, to string) string {
+	a := strings.Split(from, "\n")
+	b := strings.Split(to, "\n")
+
+	// Trim the common head and tail, configs mostly change in the middle
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+
+	lines := make([]string, 0, len(a)+len(b))
+	for _, line := range a[:head] {
+		lines = append(lines, " "+line)
+	}
+	lines = append(lines, diffLines(a[head:len(a)-tail], b[head:len(b)-tail])...)
+	for _, line := range a[len(a)-tail:] {
+		lines = append(lines, " "+line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Diffs two line slices using their longest common subsequence
+func diffLines(a []string, b []string) []string {
+	lines := []string{}
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			lines = append(lines, "-"+line)
+		}
+		for _, line := range b {
+			lines = append(lines, "+"+line)
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+	return lines
+}
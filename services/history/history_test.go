@@ -0,0 +1,113 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+)
+
+func orPanic(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestDiskStorage(t *testing.T) {
+	Convey("#DiskStorage", t, func() {
+		dir, err := ioutil.TempDir("", "bamboo_history")
+		orPanic(err)
+		defer os.RemoveAll(dir)
+
+		storage, err := NewDiskStorage(dir, 2)
+		orPanic(err)
+
+		Convey("When we record a config", func() {
+			entry, err := storage.Record("deployment_success", "config a")
+			orPanic(err)
+
+			Convey("it should be kept with its event type and hash", func() {
+				_, content, err := storage.Get(entry.ID)
+				So(err, ShouldBeNil)
+				So(content, ShouldEqual, "config a")
+				So(entry.EventType, ShouldEqual, "deployment_success")
+				So(entry.Hash, ShouldEqual, Hash("config a"))
+			})
+
+			Convey("recording the same config again should not add an entry", func() {
+				again, err := storage.Record("status_update_event", "config a")
+				So(err, ShouldBeNil)
+				So(again.ID, ShouldEqual, entry.ID)
+
+				entries, _ := storage.All()
+				So(len(entries), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When we record more configs than the history size", func() {
+			first, _ := storage.Record("a", "config a")
+			storage.Record("b", "config b")
+			last, _ := storage.Record("c", "config c")
+
+			Convey("the oldest entries should be dropped", func() {
+				entries, _ := storage.All()
+				So(len(entries), ShouldEqual, 2)
+				So(entries[1].ID, ShouldEqual, last.ID)
+
+				_, _, err := storage.Get(first.ID)
+				So(err, ShouldEqual, ErrNotFound)
+			})
+		})
+
+		Convey("When we pin an entry", func() {
+			first, _ := storage.Record("a", "config a")
+			orPanic(storage.Pin(first.ID))
+			storage.Record("b", "config b")
+			storage.Record("c", "config c")
+
+			Convey("it should be returned as pinned", func() {
+				entry, content, err := storage.Pinned()
+				So(err, ShouldBeNil)
+				So(entry.ID, ShouldEqual, first.ID)
+				So(entry.Pinned, ShouldBeTrue)
+				So(content, ShouldEqual, "config a")
+			})
+
+			Convey("it should survive pruning", func() {
+				_, _, err := storage.Get(first.ID)
+				So(err, ShouldBeNil)
+			})
+
+			Convey("unpinning should clear it", func() {
+				orPanic(storage.Unpin())
+				entry, _, err := storage.Pinned()
+				So(err, ShouldBeNil)
+				So(entry, ShouldBeNil)
+			})
+		})
+
+		Convey("When we pin an unknown entry", func() {
+			err := storage.Pin("../pinned")
+
+			Convey("we should get ErrNotFound", func() {
+				So(err, ShouldEqual, ErrNotFound)
+			})
+		})
+	})
+}
+
+func TestDiff(t *testing.T) {
+	Convey("#Diff", t, func() {
+		from := "global\n  maxconn 10\nlisten app :80\n  server a 10.0.0.1:31000"
+		to := "global\n  maxconn 20\nlisten app :80\n  server a 10.0.0.1:31000\n  server b 10.0.0.2:31000"
+
+		Convey("should mark removed, added and unchanged lines", func() {
+			So(Diff(from, to), ShouldEqual, " global\n-  maxconn 10\n+  maxconn 20\n listen app :80\n   server a 10.0.0.1:31000\n+  server b 10.0.0.2:31000")
+		})
+
+		Convey("should report no changes for identical configs", func() {
+			So(Diff(from, from), ShouldEqual, " global\n   maxconn 10\n listen app :80\n   server a 10.0.0.1:31000")
+		})
+	})
+}
@@ -0,0 +1,332 @@
+package marathon
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The fields of Marathon event payloads the cluster model uses
+type marathonEvent struct {
+	EventType     string           `json:"eventType"`
+	Timestamp     string           `json:"timestamp"`
+	AppId         string           `json:"appId"`
+	TaskId        string           `json:"taskId"`
+	TaskStatus    string           `json:"taskStatus"`
+	Host          string           `json:"host"`
+	Ports         []int            `json:"ports"`
+	IpAddresses   []marathonTaskIP `json:"ipAddresses"`
+	Version       string           `json:"version"`
+	Alive         bool             `json:"alive"`
+	AppDefinition *marathonApp     `json:"appDefinition"`
+	Plan          *marathonPlan    `json:"plan"`
+}
+
+type marathonPlan struct {
+	Target marathonGroup `json:"target"`
+}
+
+type marathonGroup struct {
+	Apps   []marathonApp   `json:"apps"`
+	Groups []marathonGroup `json:"groups"`
+}
+
+// Task states after which a task is gone from Marathon
+var terminalTaskStatuses = map[string]bool{
+	"TASK_FINISHED":         true,
+	"TASK_FAILED":           true,
+	"TASK_KILLED":           true,
+	"TASK_LOST":             true,
+	"TASK_ERROR":            true,
+	"TASK_DROPPED":          true,
+	"TASK_GONE":             true,
+	"TASK_GONE_BY_OPERATOR": true,
+	"TASK_UNREACHABLE":      true,
+	"TASK_UNKNOWN":          true,
+}
+
+// Events kept for replay while the model is stale. A resync that sees more
+// events than this stays stale and the next one starts over.
+const maxPendingEvents = 10000
+
+type pendingEvent struct {
+	eventType string
+	event     marathonEvent
+}
+
+// In-memory view of Marathon's apps and tasks, kept up to date from event
+// payloads. It is rebuilt from the REST API when stale: at startup, after the
+// event stream reconnects, when an event can't be applied and every resync
+// interval. Events arriving during a resync are replayed on top of it, as the
+// REST responses may predate them.
+type clusterState struct {
+	// held for a whole resync, so two can't interleave
+	syncLock sync.Mutex
+	lock     sync.Mutex
+	apps     map[string]marathonApp
+	tasks    map[string]marathonTaskList
+	pods     map[string]marathonPodStatus
+	syncedAt time.Time
+	stale    bool
+	// events received since the resync began, and whether some were missed
+	pending []pendingEvent
+	missed  bool
+}
+
+var cluster = &clusterState{stale: true}
+
+// ApplyEvent updates the cluster model with the payload of a Marathon event.
+// Event types starting with "bamboo_" are Bamboo's own, like startup and
+// event stream reconnects, and force a full resync.
+func ApplyEvent(eventType string, payload []byte) {
+	if strings.HasPrefix(eventType, "bamboo_") {
+		InvalidateState()
+		return
+	}
+
+	var event marathonEvent
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		log.Println("Unable to apply Marathon event", eventType, "to the cluster model:", err)
+		InvalidateState()
+		return
+	}
+	cluster.apply(eventType, event)
+}
+
+// InvalidateState makes the next FetchApps resync the whole cluster model
+func InvalidateState() {
+	cluster.invalidate()
+}
+
+// A resync in progress keeps the model stale, the REST responses may miss
+// whatever the invalidation was about
+func (c *clusterState) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stale = true
+	c.missed = true
+}
+
+func (c *clusterState) apply(eventType string, event marathonEvent) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stale {
+		if len(c.pending) >= maxPendingEvents {
+			c.pending = nil
+			c.missed = true
+		}
+		if !c.missed {
+			c.pending = append(c.pending, pendingEvent{eventType, event})
+		}
+		return
+	}
+
+	if !c.applyEvent(eventType, event) {
+		log.Println("Unable to apply Marathon event", eventType, "to the cluster model, resyncing")
+		c.stale = true
+	}
+}
+
+func (c *clusterState) applyEvent(eventType string, event marathonEvent) bool {
+	applied := true
+	switch eventType {
+	case "status_update_event":
+		applied = c.applyStatusUpdate(event)
+	case "health_status_changed_event":
+		applied = c.applyHealthChange(event)
+	case "api_post_event":
+		if event.AppDefinition == nil {
+			applied = false
+		} else {
+			c.apps[event.AppDefinition.Id] = *event.AppDefinition
+		}
+	case "deployment_info", "deployment_step_success", "deployment_failed":
+		// their payloads lack the deployments and readiness check results
+		// the state of new tasks depends on
+		applied = false
+	case "deployment_success":
+		if event.Plan == nil {
+			applied = false
+		} else {
+			c.applyGroup(event.Plan.Target)
+		}
+	case "app_terminated_event":
+		delete(c.apps, event.AppId)
+		delete(c.tasks, event.AppId)
+	case "pod_created_event", "pod_updated_event", "pod_deleted_event",
+		"instance_changed_event", "instance_health_changed_event":
+		// their payloads lack the ports and endpoints of instances
+		applied = false
+	}
+	return applied
+}
+
+func (c *clusterState) applyStatusUpdate(event marathonEvent) bool {
+	if event.AppId == "" || event.TaskId == "" {
+		return false
+	}
+
+	tasks := marathonTaskList{}
+	var previous *marathonTask
+	for i, task := range c.tasks[event.AppId] {
+		if task.Id == event.TaskId {
+			previous = &c.tasks[event.AppId][i]
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+
+	if !terminalTaskStatuses[event.TaskStatus] {
+		task := marathonTask{
+			AppId:   event.AppId,
+			Id:      event.TaskId,
+			Host:    event.Host,
+			Ports:   event.Ports,
+			Version: event.Version,
+			State:   event.TaskStatus,
+		}
+		task.IpAddresses = event.IpAddresses
+		if previous != nil {
+			if len(task.IpAddresses) == 0 {
+				task.IpAddresses = previous.IpAddresses
+			}
+			task.ServicePorts = previous.ServicePorts
+			task.StagedAt = previous.StagedAt
+			task.StartedAt = previous.StartedAt
+			task.HealthCheckResults = previous.HealthCheckResults
+		}
+		if task.StagedAt == "" {
+			task.StagedAt = event.Timestamp
+		}
+		if task.StartedAt == "" && event.TaskStatus == "TASK_RUNNING" {
+			task.StartedAt = event.Timestamp
+		}
+		tasks = append(tasks, task)
+		sort.Sort(tasks)
+	}
+
+	if len(tasks) == 0 {
+		delete(c.tasks, event.AppId)
+	} else {
+		c.tasks[event.AppId] = tasks
+	}
+	return true
+}
+
+// The event doesn't say which check changed, so it can only be applied to
+// apps with a single health check
+func (c *clusterState) applyHealthChange(event marathonEvent) bool {
+	app, ok := c.apps[event.AppId]
+	if !ok || len(app.HealthChecks) != 1 {
+		return false
+	}
+
+	tasks := make(marathonTaskList, len(c.tasks[event.AppId]))
+	copy(tasks, c.tasks[event.AppId])
+	for i := range tasks {
+		if tasks[i].Id == event.TaskId {
+			tasks[i].HealthCheckResults = []marathonHealthCheckResult{{Alive: event.Alive}}
+			c.tasks[event.AppId] = tasks
+			return true
+		}
+	}
+	// Health of a task we don't know yet
+	return false
+}
+
+func (c *clusterState) applyGroup(group marathonGroup) {
+	for _, app := range group.Apps {
+		c.apps[app.Id] = app
+	}
+	for _, child := range group.Groups {
+		c.applyGroup(child)
+	}
+}
+
+// Starts a resync, the events received from now on are replayed by reset
+func (c *clusterState) beginSync() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stale = true
+	c.pending = nil
+	c.missed = false
+}
+
+// Replaces the model with the REST responses and replays the events received
+// since beginSync. The model stays stale if events were missed or can't be
+// applied.
+func (c *clusterState) reset(apps map[string]marathonApp, tasks map[string]marathonTaskList, pods map[string]marathonPodStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.apps = apps
+	c.tasks = tasks
+	c.pods = pods
+	c.syncedAt = time.Now()
+	c.stale = c.missed
+	if c.missed {
+		log.Println("Marathon events were missed during the resync, resyncing again")
+	}
+
+	for _, pending := range c.pending {
+		if !c.applyEvent(pending.eventType, pending.event) {
+			log.Println("Unable to replay Marathon event", pending.eventType, "on the cluster model, resyncing")
+			c.stale = true
+		}
+	}
+	c.pending = nil
+	c.missed = false
+}
+
+// Returns the apps of the model, ok is false if it needs a full resync
+func (c *clusterState) appList(resyncInterval time.Duration, healthPolicy string, versionOrder string) (apps AppList, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stale || time.Since(c.syncedAt) >= resyncInterval {
+		return nil, false
+	}
+	return c.list(healthPolicy, versionOrder), true
+}
+
+// Returns the apps of the model, even if it needs a resync. Used right after
+// one, when events received meanwhile made it stale again.
+func (c *clusterState) currentAppList(healthPolicy string, versionOrder string) AppList {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.list(healthPolicy, versionOrder)
+}
+
+func (c *clusterState) list(healthPolicy string, versionOrder string) AppList {
+	mApps, tasks := c.withPods()
+	apps := createApps(tasks, mApps, healthPolicy, versionOrder)
+	sort.Sort(apps)
+	return apps
+}
+
+// Returns the apps and tasks of the model with the pods turned into apps.
+// Status updates of pod containers may have put tasks under a pod id, the
+// instances replace them.
+func (c *clusterState) withPods() (map[string]marathonApp, map[string]marathonTaskList) {
+	if len(c.pods) == 0 {
+		return c.apps, c.tasks
+	}
+	podApps, podTasks := podApps(c.pods)
+	apps := make(map[string]marathonApp, len(c.apps)+len(podApps))
+	tasks := make(map[string]marathonTaskList, len(c.tasks)+len(podTasks))
+	for id, app := range c.apps {
+		apps[id] = app
+	}
+	for id, appTasks := range c.tasks {
+		tasks[id] = appTasks
+	}
+	for id, app := range podApps {
+		apps[id] = app
+		tasks[id] = podTasks[id]
+	}
+	return apps, tasks
+}
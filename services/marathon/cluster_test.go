@@ -0,0 +1,172 @@
+package marathon
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+)
+
+func TestClusterState(t *testing.T) {
+	Convey("#clusterState", t, func() {
+		state := &clusterState{stale: true}
+		state.reset(map[string]marathonApp{
+			"/app": marathonApp{Id: "/app", HealthChecks: []marathonHealthCheck{{"/", "HTTP", 0}}},
+		}, map[string]marathonTaskList{
+			"/app": marathonTaskList{{AppId: "/app", Id: "app.1", Host: "10.0.0.1", Ports: []int{31000}, StartedAt: "t0",
+				HealthCheckResults: []marathonHealthCheckResult{{Alive: true}}}},
+		}, nil)
+		apply := func(eventType string, payload string) {
+			var event marathonEvent
+			err := json.Unmarshal([]byte(payload), &event)
+			So(err, ShouldBeNil)
+			state.apply(eventType, event)
+		}
+
+		Convey("When a task starts running", func() {
+			apply("status_update_event", `{"appId":"/app","taskId":"app.2","taskStatus":"TASK_RUNNING","host":"10.0.0.2","ports":[31001],"timestamp":"t1"}`)
+
+			Convey("it should be added with its start time", func() {
+				So(len(state.tasks["/app"]), ShouldEqual, 2)
+				So(state.tasks["/app"][1].StartedAt, ShouldEqual, "t1")
+				So(state.stale, ShouldBeFalse)
+			})
+
+			Convey("it should not be routed before its health check passes", func() {
+				apps, ok := state.appList(time.Minute, "", "")
+				So(ok, ShouldBeTrue)
+				So(len(apps[0].Tasks), ShouldEqual, 1)
+
+				apply("health_status_changed_event", `{"appId":"/app","taskId":"app.2","alive":true}`)
+				apps, _ = state.appList(time.Minute, "", "")
+				So(len(apps[0].Tasks), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When a container networking task starts running", func() {
+			apply("status_update_event", `{"appId":"/app","taskId":"app.3","taskStatus":"TASK_RUNNING","host":"10.0.0.3","ports":[],"ipAddresses":[{"ipAddress":"192.168.0.3","protocol":"IPv4"}]}`)
+			apply("status_update_event", `{"appId":"/app","taskId":"app.3","taskStatus":"TASK_KILLING","host":"10.0.0.3","ports":[]}`)
+
+			Convey("it should keep the IP addresses of its first update", func() {
+				So(state.tasks["/app"][1].IpAddresses, ShouldResemble, []marathonTaskIP{{IpAddress: "192.168.0.3", Protocol: "IPv4"}})
+			})
+		})
+
+		Convey("When a task is killed", func() {
+			apply("status_update_event", `{"appId":"/app","taskId":"app.1","taskStatus":"TASK_KILLED"}`)
+
+			Convey("it should be removed", func() {
+				So(state.tasks["/app"], ShouldBeNil)
+			})
+		})
+
+		Convey("When a task starts killing", func() {
+			apply("status_update_event", `{"appId":"/app","taskId":"app.1","taskStatus":"TASK_KILLING","host":"10.0.0.1","ports":[31000]}`)
+
+			Convey("it should keep its start time and health", func() {
+				task := state.tasks["/app"][0]
+				So(task.State, ShouldEqual, "TASK_KILLING")
+				So(task.StartedAt, ShouldEqual, "t0")
+				So(len(task.HealthCheckResults), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When an app is terminated", func() {
+			apply("app_terminated_event", `{"appId":"/app"}`)
+
+			Convey("it should be removed with its tasks", func() {
+				So(len(state.apps), ShouldEqual, 0)
+				So(len(state.tasks), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When a deployment succeeds", func() {
+			apply("deployment_success", `{"plan":{"target":{"apps":[],"groups":[{"apps":[{"id":"/group/web","env":{"A":"B"}}]}]}}}`)
+
+			Convey("it should add the apps of nested groups", func() {
+				So(state.apps["/group/web"].Env["A"], ShouldEqual, "B")
+			})
+		})
+
+		Convey("When a deployment step succeeds", func() {
+			apply("deployment_step_success", `{"plan":{"target":{"apps":[{"id":"/app"}]}}}`)
+
+			Convey("the model should need a resync for the readiness of new tasks", func() {
+				So(state.stale, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the health of an unknown task changes", func() {
+			apply("health_status_changed_event", `{"appId":"/app","taskId":"app.9","alive":true}`)
+
+			Convey("the model should need a resync", func() {
+				So(state.stale, ShouldBeTrue)
+				_, ok := state.appList(time.Minute, "", "")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When the resync interval passed", func() {
+			_, ok := state.appList(0, "", "")
+
+			Convey("the model should need a resync", func() {
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestClusterStateResync(t *testing.T) {
+	Convey("#clusterState resync", t, func() {
+		state := &clusterState{stale: true}
+		apps := map[string]marathonApp{"/app": marathonApp{Id: "/app"}}
+		tasks := map[string]marathonTaskList{
+			"/app": marathonTaskList{{AppId: "/app", Id: "app.1", Host: "10.0.0.1", Ports: []int{31000}, StartedAt: "t0"}},
+		}
+		apply := func(eventType string, payload string) {
+			var event marathonEvent
+			err := json.Unmarshal([]byte(payload), &event)
+			So(err, ShouldBeNil)
+			state.apply(eventType, event)
+		}
+		state.beginSync()
+
+		Convey("When a task changes during the resync", func() {
+			apply("status_update_event", `{"appId":"/app","taskId":"app.1","taskStatus":"TASK_KILLED"}`)
+			state.reset(apps, tasks, nil)
+
+			Convey("the change should be replayed on the fetched model", func() {
+				So(state.stale, ShouldBeFalse)
+				So(state.tasks["/app"], ShouldBeNil)
+			})
+		})
+
+		Convey("When an event that can't be applied arrives during the resync", func() {
+			apply("instance_changed_event", `{}`)
+			state.reset(apps, tasks, nil)
+
+			Convey("the model should stay stale but still list the fetched apps", func() {
+				So(state.stale, ShouldBeTrue)
+				_, ok := state.appList(time.Minute, "", "")
+				So(ok, ShouldBeFalse)
+				So(len(state.currentAppList("", "")), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the model is invalidated during the resync", func() {
+			state.invalidate()
+			state.reset(apps, tasks, nil)
+
+			Convey("it should stay stale", func() {
+				So(state.stale, ShouldBeTrue)
+			})
+
+			Convey("the next resync should make it fresh", func() {
+				state.beginSync()
+				state.reset(apps, tasks, nil)
+				So(state.stale, ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -3,25 +3,43 @@ package marathon
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/marathon_client"
+)
+
+// Administrative states of a task's server in HAProxy
+const (
+	// The task receives traffic
+	TaskStateReady = "ready"
+	// The task is being killed, it keeps its connections but gets no new ones
+	TaskStateDrain = "drain"
+	// The task started but its readiness checks didn't pass yet
+	TaskStateMaint = "maint"
 )
 
 // Describes an app process running
 type Task struct {
+	// Marathon task id
+	Id       string
 	Frontend string
 	Server   string
 	Host     string
 	Port     int
 	Ports    []int
-	Version  string
-	Weight   int
+	// Names of Ports from the app's port definitions or mappings, "" for
+	// unnamed ones
+	PortNames []string
+	Version   string
+	Weight    int
+	// One of the TaskState constants
+	State string
 }
 
 // A health check on the application
@@ -35,8 +53,16 @@ type HealthCheck struct {
 }
 
 type Endpoint struct {
+	// Which bind address the endpoint listens on, see HAProxy.BindAddresses
+	SvcType  string
 	Protocol string
-	Bind     int
+	// Path prefix routed to the app on a frontend shared with other apps,
+	// "" if the app has the port to itself
+	Uri  string
+	Bind int
+	// Name of the task port the endpoint routes to, the port at the
+	// endpoint's index when empty
+	PortName string
 }
 
 // An app may have multiple processes
@@ -51,7 +77,24 @@ type App struct {
 	Env             map[string]string
 	Labels          map[string]string
 	Endpoints       []Endpoint
-	CurVsn          string
+	// Primary version, the oldest one in VersionOrder
+	CurVsn string
+	// SRY_APP_VSN of the Marathon apps forming the app, oldest first
+	Versions []string
+	// Name of the order of Versions, see version.go
+	VersionOrder string
+	// Version => when Marathon last changed the config of the app running it
+	VersionTimes map[string]string
+	// Version => endpoints and service ports of the app running it, the
+	// primary version's are those of the app, see SetPrimary
+	VersionPorts map[string]VersionPorts
+}
+
+// Endpoints and service ports of the Marathon app running a version
+type VersionPorts struct {
+	// nil if the app has no BB_DM_ENDPOINTS
+	Endpoints    []Endpoint
+	ServicePorts []int
 }
 
 type AppList []App
@@ -75,14 +118,21 @@ type marathonTasks struct {
 }
 
 type marathonTask struct {
-	AppId        string
-	Id           string
-	Host         string
-	Ports        []int
-	ServicePorts []int
-	StartedAt    string
-	StagedAt     string
-	Version      string
+	AppId              string
+	Id                 string
+	Host               string
+	Ports              []int
+	ServicePorts       []int
+	StartedAt          string
+	StagedAt           string
+	Version            string
+	State              string
+	HealthCheckResults []marathonHealthCheckResult
+	IpAddresses        []marathonTaskIP
+}
+
+type marathonHealthCheckResult struct {
+	Alive bool `json:"alive"`
 }
 
 func (slice marathonTaskList) Len() int {
@@ -102,11 +152,68 @@ type marathonApps struct {
 }
 
 type marathonApp struct {
-	Id           string                `json:"id"`
-	HealthChecks []marathonHealthCheck `json:"healthChecks"`
-	Ports        []int                 `json:"ports"`
-	Env          map[string]string     `json:"env"`
-	Labels       map[string]string     `json:"labels"`
+	Id                    string                         `json:"id"`
+	HealthChecks          []marathonHealthCheck          `json:"healthChecks"`
+	Ports                 []int                          `json:"ports"`
+	Env                   map[string]string              `json:"env"`
+	Labels                map[string]string              `json:"labels"`
+	ReadinessChecks       []marathonReadinessCheck       `json:"readinessChecks"`
+	ReadinessCheckResults []marathonReadinessCheckResult `json:"readinessCheckResults"`
+	PortDefinitions       []marathonPort                 `json:"portDefinitions"`
+	Container             *marathonContainer             `json:"container"`
+	IpAddress             *marathonIPAddress             `json:"ipAddress"`
+	Networks              []marathonNetwork              `json:"networks"`
+	Version               string                         `json:"version"`
+	VersionInfo           *marathonVersionInfo           `json:"versionInfo"`
+	Deployments           []marathonDeploymentRef        `json:"deployments"`
+}
+
+// A deployment in progress for the app
+type marathonDeploymentRef struct {
+	Id string `json:"id"`
+}
+
+// Scaling changes the version of an app, not lastConfigChangeAt
+type marathonVersionInfo struct {
+	LastConfigChangeAt string `json:"lastConfigChangeAt"`
+}
+
+// Returns when the config of the app last changed
+func (mApp marathonApp) configChangedAt() string {
+	if mApp.VersionInfo != nil && mApp.VersionInfo.LastConfigChangeAt != "" {
+		return mApp.VersionInfo.LastConfigChangeAt
+	}
+	return mApp.Version
+}
+
+// A port definition, a discovery port or a port mapping of a container
+type marathonPort struct {
+	Number        int    `json:"number"`
+	ContainerPort int    `json:"containerPort"`
+	Name          string `json:"name"`
+}
+
+type marathonContainer struct {
+	// Marathon 1.5 moved portMappings out of the docker section
+	PortMappings []marathonPort  `json:"portMappings"`
+	Docker       *marathonDocker `json:"docker"`
+}
+
+type marathonDocker struct {
+	// BRIDGE, HOST or USER before Marathon 1.5
+	Network      string         `json:"network"`
+	PortMappings []marathonPort `json:"portMappings"`
+}
+
+type marathonReadinessCheck struct {
+	Name string `json:"name"`
+}
+
+// Marathon only reports readiness results while a deployment is in progress
+type marathonReadinessCheckResult struct {
+	Name   string `json:"name"`
+	TaskId string `json:"taskId"`
+	Ready  bool   `json:"ready"`
 }
 
 type marathonHealthCheck struct {
@@ -115,28 +222,13 @@ type marathonHealthCheck struct {
 	PortIndex int    `json:"portIndex"`
 }
 
-func fetchMarathonApps(endpoint string, conf *configuration.Configuration) (map[string]marathonApp, error) {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", endpoint+"/v2/apps", nil)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	if len(conf.Marathon.User) > 0 && len(conf.Marathon.Password) > 0 {
-		req.SetBasicAuth(conf.Marathon.User, conf.Marathon.Password)
-	}
-	response, err := client.Do(req)
-
+func fetchMarathonApps(client *marathon_client.Client) (map[string]marathonApp, error) {
+	contents, err := client.Get("/v2/apps?embed=apps.readiness")
 	if err != nil {
 		return nil, err
 	}
 
-	defer response.Body.Close()
 	var appResponse marathonApps
-
-	contents, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-
 	err = json.Unmarshal(contents, &appResponse)
 	if err != nil {
 		return nil, err
@@ -151,28 +243,13 @@ func fetchMarathonApps(endpoint string, conf *configuration.Configuration) (map[
 	return dataById, nil
 }
 
-func fetchTasks(endpoint string, conf *configuration.Configuration) (map[string]marathonTaskList, error) {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", endpoint+"/v2/tasks", nil)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	if len(conf.Marathon.User) > 0 && len(conf.Marathon.Password) > 0 {
-		req.SetBasicAuth(conf.Marathon.User, conf.Marathon.Password)
-	}
-	response, err := client.Do(req)
-
-	var tasks marathonTasks
-
-	if err != nil {
-		return nil, err
-	}
-
-	contents, err := ioutil.ReadAll(response.Body)
-	defer response.Body.Close()
+func fetchTasks(client *marathon_client.Client) (map[string]marathonTaskList, error) {
+	contents, err := client.Get("/v2/tasks")
 	if err != nil {
 		return nil, err
 	}
 
+	var tasks marathonTasks
 	err = json.Unmarshal(contents, &tasks)
 	if err != nil {
 		return nil, err
@@ -196,35 +273,53 @@ func fetchTasks(endpoint string, conf *configuration.Configuration) (map[string]
 	return tasksById, nil
 }
 
-func createApps(tasksById map[string]marathonTaskList, marathonApps map[string]marathonApp) AppList {
+func createApps(tasksById map[string]marathonTaskList, marathonApps map[string]marathonApp, healthPolicy string, versionOrder string) AppList {
 	appMap := map[string]*App{}
+	endpointErrors := map[string][]error{}
 	for _, mApp := range marathonApps {
 		mappJson, _ := json.Marshal(mApp)
 		log.Println("mapp", string(mappJson))
+
+		// diagnostics of every source are keyed by app path
 		appPath := formPath(mApp)
 		log.Println("appPath", string(appPath))
+
+		endpointStr, hasEndpoints := mApp.Env["BB_DM_ENDPOINTS"]
+		endpoints, errs := ParseEndpoints(endpointStr)
+		if len(errs) > 0 {
+			// one bad app must not take the others down
+			for _, err := range errs {
+				log.Printf("Skipping app %s: %s\n", mApp.Id, err)
+			}
+			endpointErrors[appPath] = append(endpointErrors[appPath], errs...)
+			continue
+		}
+
 		app, ok := appMap[appPath]
 		if !ok {
 			newApp := formApp(mApp, appPath)
 
-			if endpointStr, ok := mApp.Env["BB_DM_ENDPOINTS"]; ok {
-				endpoints := formEndpoints(endpointStr)
+			if hasEndpoints {
 				newApp.Endpoints = endpoints
 			}
 			app = &newApp
 			appMap[appPath] = app
 		}
 
-		//compare and select min version
-		if appVersionStr, ok := mApp.Env["SRY_APP_VSN"]; ok && appVersionStr < app.CurVsn {
-			app.CurVsn = appVersionStr
-			if endpointStr, ok := mApp.Env["BB_DM_ENDPOINTS"]; ok {
-				endpoints := formEndpoints(endpointStr)
-				app.Endpoints = endpoints
+		version := mApp.Env["SRY_APP_VSN"]
+		if _, ok := app.VersionTimes[version]; !ok {
+			app.Versions = append(app.Versions, version)
+			app.VersionTimes[version] = mApp.configChangedAt()
+		}
+		if _, ok := app.VersionPorts[version]; !ok {
+			ports := VersionPorts{ServicePorts: mApp.Ports}
+			if hasEndpoints {
+				ports.Endpoints = endpoints
 			}
+			app.VersionPorts[version] = ports
 		}
 
-		tasks := formTasks(mApp, *app, tasksById)
+		tasks := formTasks(mApp, *app, tasksById, healthPolicy)
 		tasksJson, _ := json.Marshal(tasks)
 		log.Println("tasks", string(tasksJson))
 		app.Tasks = append(app.Tasks, tasks...)
@@ -233,27 +328,37 @@ func createApps(tasksById map[string]marathonTaskList, marathonApps map[string]m
 	}
 	appMapJson, _ := json.Marshal(appMap)
 	log.Println("app", string(appMapJson))
+	diagnostics.Replace(diagnostics.SourceEndpoints, endpointErrors, true)
 
 	apps := AppList{}
 	for _, app := range appMap {
+		orderVersions(app, versionOrder)
 		apps = append(apps, *app)
 	}
 	return apps
 }
 
-func formTasks(mApp marathonApp, app App, tasksById map[string]marathonTaskList) []Task {
+func formTasks(mApp marathonApp, app App, tasksById map[string]marathonTaskList, healthPolicy string) []Task {
 	tasks := []Task{}
 	for _, mTask := range tasksById[mApp.Id] {
-		if len(mTask.Ports) > 0 {
-			server := fmt.Sprintf("%s-%s", app.Frontend, mTask.Host)
+		if !isTaskRoutable(mTask, mApp, healthPolicy) {
+			log.Println("skip unhealthy task", mTask.Id)
+			continue
+		}
+		host, ports, names := taskAddress(mTask, mApp)
+		if len(ports) > 0 {
+			server := fmt.Sprintf("%s-%s", app.Frontend, host)
 			t := Task{
-				Frontend: app.Frontend,
-				Server:   server,
-				Host:     mTask.Host,
-				Port:     mTask.Ports[0],
-				Ports:    mTask.Ports,
-				Version:  mApp.Env["SRY_APP_VSN"],
-				Weight:   1,
+				Id:        mTask.Id,
+				Frontend:  app.Frontend,
+				Server:    server,
+				Host:      host,
+				Port:      ports[0],
+				Ports:     ports,
+				PortNames: names,
+				Version:   mApp.Env["SRY_APP_VSN"],
+				Weight:    1,
+				State:     taskState(mTask, mApp),
 			}
 			tasks = append(tasks, t)
 		}
@@ -261,36 +366,165 @@ func formTasks(mApp marathonApp, app App, tasksById map[string]marathonTaskList)
 	return tasks
 }
 
-func formEndpoints(str string) []Endpoint {
-	//{{ range $tcpIdx, $endpoint := Split $app.Env.BB_DM_ENDPOINTS "," }}
-	//{{ $endpointSlices := Split $endpoint ":" }}
-	//{{ $svcType := index $endpointSlices 0 }}
-	//{{ $protocol := index $endpointSlices 1 }}
-	//{{ $uri := index $endpointSlices 2 }}
-	//{{ $port := index $endpointSlices 3 }}
-	//# len {{ len $end
-	//BB_DM_ENDPOINTS=pub:http:nil:9800,pub:tcp:nil:9801
+// Decides whether HAProxy may send traffic to a task. Tasks that are staged
+// but not started yet never get traffic, health checks are honoured
+// according to healthPolicy.
+func isTaskRoutable(mTask marathonTask, mApp marathonApp, healthPolicy string) bool {
+	if mTask.StartedAt == "" {
+		return false
+	}
+
+	switch healthPolicy {
+	case configuration.HealthPolicyIgnore:
+		return true
+	case configuration.HealthPolicyRequireHealthy:
+		if len(mApp.HealthChecks) == 0 {
+			return false
+		}
+	default:
+		if len(mApp.HealthChecks) == 0 {
+			return true
+		}
+	}
+
+	// Marathon only reports results once checks ran, all of them must pass
+	if len(mTask.HealthCheckResults) < len(mApp.HealthChecks) {
+		return false
+	}
+	for _, result := range mTask.HealthCheckResults {
+		if !result.Alive {
+			return false
+		}
+	}
+	return true
+}
+
+// Drains tasks Marathon is killing and holds tasks whose readiness checks
+// haven't passed yet in maintenance. While a deployment is in progress, the
+// tasks it started are held until their first check ran, tasks of earlier
+// versions aren't checked and keep their traffic.
+func taskState(mTask marathonTask, mApp marathonApp) string {
+	if mTask.State == "TASK_KILLING" {
+		return TaskStateDrain
+	}
+
+	if len(mApp.ReadinessChecks) > 0 {
+		checked := false
+		for _, result := range mApp.ReadinessCheckResults {
+			if result.TaskId == mTask.Id {
+				if !result.Ready {
+					return TaskStateMaint
+				}
+				checked = true
+			}
+		}
+		if !checked && len(mApp.Deployments) > 0 && mTask.Version == mApp.Version {
+			return TaskStateMaint
+		}
+	}
+	return TaskStateReady
+}
+
+// EndpointError describes an invalid BB_DM_ENDPOINTS declaration
+type EndpointError struct {
+	// The offending comma separated declaration
+	Declaration string
+	Field       string
+	Value       string
+	Reason      string
+}
+
+func (e *EndpointError) Error() string {
+	return fmt.Sprintf("Invalid endpoint %q: %s %q %s", e.Declaration, e.Field, e.Value, e.Reason)
+}
 
+func (e *EndpointError) Detail() diagnostics.Detail {
+	return diagnostics.Detail{Field: e.Field, Value: e.Value, Message: e.Error()}
+}
+
+// ParseEndpoints parses BB_DM_ENDPOINTS, e.g.
+// "pub:http:nil:9800,pub:tcp:nil:9801:admin", where each endpoint is
+// svcType:protocol:uri:bind with an optional port name
+func ParseEndpoints(str string) ([]Endpoint, []error) {
 	epStrSlices := strings.Split(str, ",")
 	endpoints := []Endpoint{}
+	errors := []error{}
 	for _, epStr := range epStrSlices {
+		epStr = strings.TrimSpace(epStr)
+		if epStr == "" {
+			continue
+		}
 		epParts := strings.Split(epStr, ":")
 		if len(epParts) < 4 {
+			errors = append(errors, &EndpointError{epStr, "declaration", epStr, "should be svcType:protocol:uri:bind[:portName]"})
 			continue
 		}
-		bind, err := strconv.Atoi(epParts[3])
+
+		svcType := epParts[0]
+		if !svcTypePattern.MatchString(svcType) {
+			errors = append(errors, &EndpointError{epStr, "svcType", svcType, "should be a name like pub"})
+			continue
+		}
+		protocol := epParts[1]
+		if protocol != "http" && protocol != "tcp" {
+			errors = append(errors, &EndpointError{epStr, "protocol", protocol, "should be http or tcp"})
+			continue
+		}
+		uri, err := formUri(epParts[2], protocol)
 		if err != nil {
-			log.Panicln("bad bind value", err.Error())
+			errors = append(errors, &EndpointError{epStr, "uri", epParts[2], err.Error()})
+			continue
 		}
+		bind, err := strconv.Atoi(epParts[3])
+		if err != nil || bind < 1 || bind > 65535 {
+			errors = append(errors, &EndpointError{epStr, "bind", epParts[3], "should be a port number"})
+			continue
+		}
+
+		portName := ""
+		if len(epParts) > 4 {
+			portName = epParts[4]
+			if !portNamePattern.MatchString(portName) {
+				errors = append(errors, &EndpointError{epStr, "portName", portName, "should be the name of a port definition or mapping"})
+				continue
+			}
+		}
+
 		endpoint := Endpoint{
-			Protocol: epParts[1],
+			SvcType:  svcType,
+			Protocol: protocol,
+			Uri:      uri,
 			Bind:     bind,
+			PortName: portName,
 		}
 
 		endpoints = append(endpoints, endpoint)
 	}
 
-	return endpoints
+	return endpoints, errors
+}
+
+var (
+	svcTypePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	uriPattern     = regexp.MustCompile(`^/?[A-Za-z0-9._~%/-]+$`)
+	// Port names Marathon accepts
+	portNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// Normalizes the uri of an endpoint into a path prefix without trailing
+// slash, "/" routes everything else and "nil" means no uri
+func formUri(uri string, protocol string) (string, error) {
+	if uri == "nil" || uri == "" {
+		return "", nil
+	}
+	if protocol != "http" {
+		return "", fmt.Errorf("should be nil for %s endpoints", protocol)
+	}
+	if !uriPattern.MatchString(uri) {
+		return "", fmt.Errorf("should be a path like /api")
+	}
+	uri = "/" + strings.Trim(uri, "/")
+	return uri, nil
 }
 
 func formPath(mApp marathonApp) string {
@@ -313,6 +547,8 @@ func formApp(mApp marathonApp, appPath string) App {
 		Env:             mApp.Env,
 		Labels:          mApp.Labels,
 		CurVsn:          mApp.Env["SRY_APP_VSN"],
+		VersionTimes:    map[string]string{},
+		VersionPorts:    map[string]VersionPorts{},
 	}
 	app.HealthChecks = make([]HealthCheck, 0, len(mApp.HealthChecks))
 	for _, marathonCheck := range mApp.HealthChecks {
@@ -350,34 +586,51 @@ func parseHealthCheckPath(checks []marathonHealthCheck) string {
 		endpoint: Marathon HTTP endpoint, e.g. http://localhost:8080
 */
 func FetchApps(maraconf configuration.Marathon, conf *configuration.Configuration) (AppList, error) {
+	applist, ok := cluster.appList(maraconf.ResyncDelay(), conf.Marathon.TaskHealthPolicy, conf.Marathon.VersionOrder)
+	if ok {
+		return applist, nil
+	}
 
-	var applist AppList
-	var err error
+	client, err := marathon_client.Shared(maraconf)
+	if err != nil {
+		return nil, err
+	}
 
-	// try all configured endpoints until one succeeds
-	for _, url := range maraconf.Endpoints() {
-		applist, err = _fetchApps(url, conf)
-		if err == nil {
-			return applist, err
-		}
+	cluster.syncLock.Lock()
+	defer cluster.syncLock.Unlock()
+	// a resync may have completed while waiting for the lock
+	applist, ok = cluster.appList(maraconf.ResyncDelay(), conf.Marathon.TaskHealthPolicy, conf.Marathon.VersionOrder)
+	if ok {
+		return applist, nil
 	}
-	// return last error
-	return nil, err
+	err = _fetchApps(client)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.currentAppList(conf.Marathon.TaskHealthPolicy, conf.Marathon.VersionOrder), nil
 }
 
-func _fetchApps(url string, conf *configuration.Configuration) (AppList, error) {
-	tasks, err := fetchTasks(url, conf)
+// Resyncs the cluster model from the leader's REST API, with
+// cluster.syncLock held
+func _fetchApps(client *marathon_client.Client) error {
+	cluster.beginSync()
+	tasks, err := fetchTasks(client)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	marathonApps, err := fetchMarathonApps(url, conf)
+	marathonApps, err := fetchMarathonApps(client)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	pods, err := fetchPods(client)
+	if err != nil {
+		return err
 	}
 	log.Println("got mapps", len(marathonApps))
 	log.Println("got mtasks", len(tasks))
-	apps := createApps(tasks, marathonApps)
-	sort.Sort(apps)
-	return apps, nil
+	log.Println("got mpods", len(pods))
+	cluster.reset(marathonApps, tasks, pods)
+	return nil
 }
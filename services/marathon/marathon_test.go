@@ -1,8 +1,12 @@
 package marathon
 
 import (
+	"encoding/json"
 	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
 	"testing"
+
+	"github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
 )
 
 func TestParseHealthCheckPathTCP(t *testing.T) {
@@ -43,3 +47,169 @@ func TestParseHealthCheckPathMixed(t *testing.T) {
 		})
 	})
 }
+
+func TestIsTaskRoutable(t *testing.T) {
+	Convey("#isTaskRoutable", t, func() {
+		checkedApp := marathonApp{HealthChecks: []marathonHealthCheck{{"/health", "HTTP", 0}}}
+		uncheckedApp := marathonApp{}
+
+		healthy := marathonTask{StartedAt: "2016-03-01T10:00:00.000Z", HealthCheckResults: []marathonHealthCheckResult{{Alive: true}}}
+		unhealthy := marathonTask{StartedAt: "2016-03-01T10:00:00.000Z", HealthCheckResults: []marathonHealthCheckResult{{Alive: false}}}
+		booting := marathonTask{StartedAt: "2016-03-01T10:00:00.000Z"}
+		staged := marathonTask{StagedAt: "2016-03-01T10:00:00.000Z"}
+
+		Convey("should never route staged tasks", func() {
+			So(isTaskRoutable(staged, uncheckedApp, configuration.HealthPolicyIgnore), ShouldBeFalse)
+		})
+
+		Convey("should only route healthy tasks by default", func() {
+			So(isTaskRoutable(healthy, checkedApp, ""), ShouldBeTrue)
+			So(isTaskRoutable(unhealthy, checkedApp, ""), ShouldBeFalse)
+			So(isTaskRoutable(booting, checkedApp, ""), ShouldBeFalse)
+			So(isTaskRoutable(booting, uncheckedApp, ""), ShouldBeTrue)
+		})
+
+		Convey("should route unhealthy tasks when health is ignored", func() {
+			So(isTaskRoutable(unhealthy, checkedApp, configuration.HealthPolicyIgnore), ShouldBeTrue)
+		})
+
+		Convey("should not route apps without checks when health is required", func() {
+			So(isTaskRoutable(booting, uncheckedApp, configuration.HealthPolicyRequireHealthy), ShouldBeFalse)
+			So(isTaskRoutable(healthy, checkedApp, configuration.HealthPolicyRequireHealthy), ShouldBeTrue)
+		})
+	})
+}
+
+func TestTaskState(t *testing.T) {
+	Convey("#taskState", t, func() {
+		app := marathonApp{
+			ReadinessChecks: []marathonReadinessCheck{{Name: "readiness"}},
+			ReadinessCheckResults: []marathonReadinessCheckResult{
+				{Name: "readiness", TaskId: "app.booting", Ready: false},
+				{Name: "readiness", TaskId: "app.warm", Ready: true},
+			},
+		}
+
+		Convey("should drain tasks being killed", func() {
+			task := marathonTask{Id: "app.old", State: "TASK_KILLING"}
+			So(taskState(task, app), ShouldEqual, TaskStateDrain)
+		})
+
+		Convey("should hold tasks failing readiness checks in maintenance", func() {
+			task := marathonTask{Id: "app.booting", State: "TASK_RUNNING"}
+			So(taskState(task, app), ShouldEqual, TaskStateMaint)
+		})
+
+		Convey("should route tasks that passed readiness checks", func() {
+			task := marathonTask{Id: "app.warm", State: "TASK_RUNNING"}
+			So(taskState(task, app), ShouldEqual, TaskStateReady)
+		})
+
+		Convey("should route running tasks once the deployment finished", func() {
+			task := marathonTask{Id: "app.other", State: "TASK_RUNNING"}
+			So(taskState(task, app), ShouldEqual, TaskStateReady)
+		})
+
+		Convey("During a deployment", func() {
+			app.Version = "2016-01-02T00:00:00.000Z"
+			app.Deployments = []marathonDeploymentRef{{Id: "deployment.1"}}
+
+			Convey("it should hold new tasks until their first readiness check", func() {
+				task := marathonTask{Id: "app.new", State: "TASK_RUNNING", Version: app.Version}
+				So(taskState(task, app), ShouldEqual, TaskStateMaint)
+			})
+
+			Convey("it should route the tasks of earlier versions", func() {
+				task := marathonTask{Id: "app.old", State: "TASK_RUNNING", Version: "2016-01-01T00:00:00.000Z"}
+				So(taskState(task, app), ShouldEqual, TaskStateReady)
+			})
+
+			Convey("it should route new tasks that passed readiness checks", func() {
+				task := marathonTask{Id: "app.warm", State: "TASK_RUNNING", Version: app.Version}
+				So(taskState(task, app), ShouldEqual, TaskStateReady)
+			})
+		})
+	})
+}
+
+func TestParseEndpoints(t *testing.T) {
+	Convey("#ParseEndpoints", t, func() {
+		Convey("should parse valid declarations", func() {
+			endpoints, errs := ParseEndpoints("pub:http:nil:9800,pub:tcp:nil:9801,")
+			So(errs, ShouldBeEmpty)
+			So(endpoints, ShouldResemble, []Endpoint{{SvcType: "pub", Protocol: "http", Bind: 9800}, {SvcType: "pub", Protocol: "tcp", Bind: 9801}})
+		})
+
+		Convey("should report each invalid declaration instead of panicking", func() {
+			_, errs := ParseEndpoints("pub:http:nil:98OO,pub:udp:nil:53,pub:http")
+			So(len(errs), ShouldEqual, 3)
+			So(errs[0].(*EndpointError).Field, ShouldEqual, "bind")
+			So(errs[0].(*EndpointError).Value, ShouldEqual, "98OO")
+			So(errs[1].(*EndpointError).Field, ShouldEqual, "protocol")
+			So(errs[2].(*EndpointError).Field, ShouldEqual, "declaration")
+		})
+
+		Convey("should keep the svcType and normalize the uri", func() {
+			endpoints, errs := ParseEndpoints("inner:http:api/v1/:8080,pub:http:/:80")
+			So(errs, ShouldBeEmpty)
+			So(endpoints, ShouldResemble, []Endpoint{
+				{SvcType: "inner", Protocol: "http", Uri: "/api/v1", Bind: 8080},
+				{SvcType: "pub", Protocol: "http", Uri: "/", Bind: 80},
+			})
+		})
+
+		Convey("should keep the port name", func() {
+			endpoints, errs := ParseEndpoints("pub:http:nil:80:web,inner:tcp:nil:9100:Bad_Name")
+			So(endpoints, ShouldResemble, []Endpoint{{SvcType: "pub", Protocol: "http", Bind: 80, PortName: "web"}})
+			So(len(errs), ShouldEqual, 1)
+			So(errs[0].(*EndpointError).Field, ShouldEqual, "portName")
+		})
+
+		Convey("should reject uris of tcp endpoints and unsafe ones", func() {
+			_, errs := ParseEndpoints("pub:tcp:/db:5432,pub:http:/a b:80,:http:nil:81")
+			So(len(errs), ShouldEqual, 3)
+			So(errs[0].(*EndpointError).Field, ShouldEqual, "uri")
+			So(errs[1].(*EndpointError).Field, ShouldEqual, "uri")
+			So(errs[2].(*EndpointError).Field, ShouldEqual, "svcType")
+		})
+	})
+
+	Convey("#createApps", t, func() {
+		apps := createApps(map[string]marathonTaskList{}, map[string]marathonApp{
+			"/good": {Id: "/good", Env: map[string]string{"BB_DM_ENDPOINTS": "pub:http:nil:80"}},
+			"/bad":  {Id: "/bad", Env: map[string]string{"BB_DM_ENDPOINTS": "pub:http:nil:eighty"}},
+		}, "", "")
+
+		Convey("should skip only the app with a bad declaration", func() {
+			So(len(apps), ShouldEqual, 1)
+			So(apps[0].Id, ShouldEqual, "good")
+		})
+
+		Convey("should expose the error as a diagnostic of the app path", func() {
+			problems := diagnostics.All()
+			So(len(problems), ShouldEqual, 1)
+			So(problems[0].AppId, ShouldEqual, "bad")
+			So(problems[0].Skipped, ShouldBeTrue)
+			So(problems[0].Errors[0].Field, ShouldEqual, "bind")
+		})
+	})
+}
+
+func TestPortNames(t *testing.T) {
+	Convey("#portNames", t, func() {
+		Convey("should name the ports of host networking apps from their definitions", func() {
+			var mApp marathonApp
+			json.Unmarshal([]byte(`{"portDefinitions": [{"port": 0, "name": "web"}, {"port": 0}]}`), &mApp)
+			So(portNames(mApp), ShouldResemble, []string{"web", ""})
+		})
+
+		Convey("should prefer the port mappings of containers", func() {
+			var legacy, current marathonApp
+			json.Unmarshal([]byte(`{"portDefinitions": [{"name": "unused"}],
+				"container": {"docker": {"portMappings": [{"containerPort": 80, "name": "web"}, {"containerPort": 9100, "name": "metrics"}]}}}`), &legacy)
+			json.Unmarshal([]byte(`{"container": {"portMappings": [{"containerPort": 9100, "name": "metrics"}]}}`), &current)
+			So(portNames(legacy), ShouldResemble, []string{"web", "metrics"})
+			So(portNames(current), ShouldResemble, []string{"metrics"})
+		})
+	})
+}
@@ -0,0 +1,119 @@
+package marathon
+
+import (
+	"strings"
+)
+
+// LabelNetwork overrides how the tasks of an app are reached, either
+// NetworkHost or NetworkContainer
+const LabelNetwork = "BAMBOO_NETWORK"
+
+// How HAProxy reaches the tasks of an app
+const (
+	// The agent's host and the host ports, for HOST and BRIDGE networking
+	NetworkHost = "host"
+	// The task's own IP and the container ports, for USER networking
+	NetworkContainer = "container"
+)
+
+type marathonTaskIP struct {
+	IpAddress string `json:"ipAddress"`
+	Protocol  string `json:"protocol"`
+}
+
+// IP-per-task settings of Marathon before 1.5
+type marathonIPAddress struct {
+	NetworkName string            `json:"networkName"`
+	Discovery   marathonDiscovery `json:"discovery"`
+}
+
+type marathonDiscovery struct {
+	Ports []marathonPort `json:"ports"`
+}
+
+// Networks of Marathon 1.5 and later
+type marathonNetwork struct {
+	Mode string `json:"mode"`
+	Name string `json:"name"`
+}
+
+// Tells how to reach the tasks of an app from its networking, the
+// BAMBOO_NETWORK label wins when set
+func networkMode(mApp marathonApp) string {
+	switch label := strings.ToLower(mApp.Labels[LabelNetwork]); label {
+	case NetworkHost, NetworkContainer:
+		return label
+	}
+
+	if mApp.IpAddress != nil {
+		return NetworkContainer
+	}
+	for _, network := range mApp.Networks {
+		if network.Mode == "container" {
+			return NetworkContainer
+		}
+	}
+	if mApp.Container != nil && mApp.Container.Docker != nil && mApp.Container.Docker.Network == "USER" {
+		return NetworkContainer
+	}
+	return NetworkHost
+}
+
+// Returns the address, ports and port names HAProxy reaches a task at. The
+// ports are empty when the task has none in the app's network mode.
+func taskAddress(mTask marathonTask, mApp marathonApp) (string, []int, []string) {
+	if networkMode(mApp) == NetworkHost {
+		return mTask.Host, mTask.Ports, portNames(mApp)
+	}
+
+	if len(mTask.IpAddresses) == 0 {
+		return "", nil, nil
+	}
+	ports := containerPorts(mApp)
+	numbers := make([]int, len(ports))
+	names := make([]string, len(ports))
+	for i, port := range ports {
+		numbers[i] = port.Number
+		names[i] = port.Name
+	}
+	return mTask.IpAddresses[0].IpAddress, numbers, names
+}
+
+// The ports tasks listen on inside their own network: the discovery ports
+// of ipAddress, or the container side of the port mappings
+func containerPorts(mApp marathonApp) []marathonPort {
+	if mApp.IpAddress != nil && len(mApp.IpAddress.Discovery.Ports) > 0 {
+		return mApp.IpAddress.Discovery.Ports
+	}
+	mappings := []marathonPort{}
+	if container := mApp.Container; container != nil {
+		mappings = container.PortMappings
+		if len(mappings) == 0 && container.Docker != nil {
+			mappings = container.Docker.PortMappings
+		}
+	}
+	ports := make([]marathonPort, len(mappings))
+	for i, mapping := range mappings {
+		ports[i] = marathonPort{Number: mapping.ContainerPort, Name: mapping.Name}
+	}
+	return ports
+}
+
+// Names of the ports each task of the app gets on its host, in the order of
+// the task's ports: from the container's port mappings in bridge mode, from
+// the port definitions otherwise
+func portNames(mApp marathonApp) []string {
+	ports := mApp.PortDefinitions
+	if container := mApp.Container; container != nil {
+		if len(container.PortMappings) > 0 {
+			ports = container.PortMappings
+		} else if container.Docker != nil && len(container.Docker.PortMappings) > 0 {
+			ports = container.Docker.PortMappings
+		}
+	}
+	names := make([]string, len(ports))
+	for i, port := range ports {
+		names[i] = port.Name
+	}
+	return names
+}
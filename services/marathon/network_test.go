@@ -0,0 +1,102 @@
+package marathon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+// Apps and tasks as /v2/apps and /v2/tasks return them
+type networkFixture struct {
+	Apps  []marathonApp    `json:"apps"`
+	Tasks marathonTaskList `json:"tasks"`
+}
+
+func loadNetworkFixture(name string, labels map[string]string) AppList {
+	content, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		panic(err)
+	}
+	var fixture networkFixture
+	if err := json.Unmarshal(content, &fixture); err != nil {
+		panic(err)
+	}
+
+	apps := map[string]marathonApp{}
+	for _, app := range fixture.Apps {
+		app.Labels = labels
+		apps[app.Id] = app
+	}
+	tasks := map[string]marathonTaskList{}
+	for _, task := range fixture.Tasks {
+		tasks[task.AppId] = append(tasks[task.AppId], task)
+	}
+	appList := createApps(tasks, apps, configuration.HealthPolicyIgnore, "")
+	sort.Sort(appList)
+	return appList
+}
+
+func TestNetworking(t *testing.T) {
+	Convey("#createApps", t, func() {
+		Convey("With HOST networking", func() {
+			apps := loadNetworkFixture("network_host.json", nil)
+
+			Convey("tasks should be reached on the agent's host ports", func() {
+				task := apps[0].Tasks[0]
+				So(task.Host, ShouldEqual, "agent1")
+				So(task.Ports, ShouldResemble, []int{31000, 31001})
+				So(task.PortNames, ShouldResemble, []string{"metrics", "http"})
+			})
+		})
+
+		Convey("With BRIDGE networking", func() {
+			apps := loadNetworkFixture("network_bridge.json", nil)
+
+			Convey("tasks should be reached on the host ports of their mappings", func() {
+				task := apps[0].Tasks[0]
+				So(task.Host, ShouldEqual, "agent1")
+				So(task.Ports, ShouldResemble, []int{31000, 31001})
+				So(task.PortNames, ShouldResemble, []string{"metrics", "http"})
+			})
+		})
+
+		Convey("With USER networking", func() {
+			apps := loadNetworkFixture("network_user.json", nil)
+
+			Convey("tasks should be reached on their IP and discovery ports", func() {
+				So(apps[1].Id, ShouldEqual, "shop/web")
+				task := apps[1].Tasks[0]
+				So(task.Host, ShouldEqual, "10.0.1.10")
+				So(task.Ports, ShouldResemble, []int{9100, 8080})
+				So(task.PortNames, ShouldResemble, []string{"metrics", "http"})
+			})
+
+			Convey("tasks of container networks should be reached on the container ports", func() {
+				So(apps[0].Id, ShouldEqual, "shop/api")
+				task := apps[0].Tasks[0]
+				So(task.Host, ShouldEqual, "10.0.1.11")
+				So(task.Ports, ShouldResemble, []int{8080})
+			})
+		})
+
+		Convey("With the BAMBOO_NETWORK label", func() {
+			Convey("tasks of a host networking app should be reached on their IP", func() {
+				apps := loadNetworkFixture("network_bridge.json", map[string]string{LabelNetwork: NetworkContainer})
+				task := apps[0].Tasks[0]
+				So(task.Host, ShouldEqual, "172.17.0.2")
+				So(task.Ports, ShouldResemble, []int{9100, 8080})
+			})
+
+			Convey("tasks without host ports should be left out when forced onto the host", func() {
+				apps := loadNetworkFixture("network_user.json", map[string]string{LabelNetwork: NetworkHost})
+				So(apps[0].Tasks, ShouldBeEmpty)
+				So(apps[1].Tasks, ShouldBeEmpty)
+			})
+		})
+	})
+}
@@ -0,0 +1,245 @@
+package marathon
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/QubitProducts/bamboo/services/marathon_client"
+)
+
+// A pod with its instances, as /v2/pods/::status returns it
+type marathonPodStatus struct {
+	Id        string                `json:"id"`
+	Spec      marathonPod           `json:"spec"`
+	Instances []marathonPodInstance `json:"instances"`
+}
+
+type marathonPod struct {
+	Id          string                 `json:"id"`
+	Labels      map[string]string      `json:"labels"`
+	Environment podEnvironment         `json:"environment"`
+	Containers  []marathonPodContainer `json:"containers"`
+	Networks    []marathonNetwork      `json:"networks"`
+}
+
+// Pod environment values are strings or secret references, only the
+// strings are kept
+type podEnvironment map[string]string
+
+func (e *podEnvironment) UnmarshalJSON(data []byte) error {
+	values := map[string]interface{}{}
+	err := json.Unmarshal(data, &values)
+	if err != nil {
+		return err
+	}
+	*e = podEnvironment{}
+	for name, value := range values {
+		if s, ok := value.(string); ok {
+			(*e)[name] = s
+		}
+	}
+	return nil
+}
+
+type marathonPodContainer struct {
+	Name        string                  `json:"name"`
+	Endpoints   []marathonPodEndpoint   `json:"endpoints"`
+	HealthCheck *marathonPodHealthCheck `json:"healthCheck"`
+}
+
+type marathonPodEndpoint struct {
+	Name          string `json:"name"`
+	ContainerPort int    `json:"containerPort"`
+}
+
+type marathonPodHealthCheck struct {
+	Http *struct {
+		Endpoint string `json:"endpoint"`
+		Path     string `json:"path"`
+	} `json:"http"`
+	Tcp *struct {
+		Endpoint string `json:"endpoint"`
+	} `json:"tcp"`
+}
+
+type marathonPodInstance struct {
+	Id            string                       `json:"id"`
+	StatusSince   string                       `json:"statusSince"`
+	AgentHostname string                       `json:"agentHostname"`
+	Networks      []marathonPodNetworkStatus   `json:"networks"`
+	Containers    []marathonPodContainerStatus `json:"containers"`
+}
+
+type marathonPodNetworkStatus struct {
+	Addresses []string `json:"addresses"`
+}
+
+type marathonPodContainerStatus struct {
+	Name       string                      `json:"name"`
+	Status     string                      `json:"status"`
+	Endpoints  []marathonPodEndpointStatus `json:"endpoints"`
+	Conditions []marathonPodCondition      `json:"conditions"`
+}
+
+type marathonPodEndpointStatus struct {
+	Name              string `json:"name"`
+	AllocatedHostPort int    `json:"allocatedHostPort"`
+}
+
+type marathonPodCondition struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func fetchPods(client *marathon_client.Client) (map[string]marathonPodStatus, error) {
+	contents, err := client.Get("/v2/pods/::status")
+	if statusErr, ok := err.(*marathon_client.StatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		// Marathon before 1.4 has no pods
+		return map[string]marathonPodStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []marathonPodStatus
+	err = json.Unmarshal(contents, &pods)
+	if err != nil {
+		return nil, err
+	}
+
+	podsById := make(map[string]marathonPodStatus, len(pods))
+	for _, pod := range pods {
+		podsById[pod.Id] = pod
+	}
+	return podsById, nil
+}
+
+// Turns pods into apps and their instances into tasks, so they are routed
+// like apps: the endpoints of all containers are the ports of the app, in
+// the order of the containers, and are named like in the pod definition.
+func podApps(pods map[string]marathonPodStatus) (map[string]marathonApp, map[string]marathonTaskList) {
+	apps := make(map[string]marathonApp, len(pods))
+	tasks := make(map[string]marathonTaskList, len(pods))
+	for id, pod := range pods {
+		mApp, endpoints := podApp(pod.Spec)
+		mApp.Id = id
+		apps[id] = mApp
+
+		podTasks := marathonTaskList{}
+		for _, instance := range pod.Instances {
+			podTasks = append(podTasks, podTask(id, pod.Spec, endpoints, instance))
+		}
+		tasks[id] = podTasks
+	}
+	return apps, tasks
+}
+
+// A pod endpoint and the container it belongs to
+type podEndpoint struct {
+	container string
+	name      string
+}
+
+func podApp(pod marathonPod) (marathonApp, []podEndpoint) {
+	mApp := marathonApp{
+		Id:        pod.Id,
+		Env:       map[string]string(pod.Environment),
+		Labels:    pod.Labels,
+		Networks:  pod.Networks,
+		Container: &marathonContainer{PortMappings: []marathonPort{}},
+	}
+	if mApp.Env == nil {
+		mApp.Env = map[string]string{}
+	}
+
+	endpoints := []podEndpoint{}
+	portIndex := map[string]int{}
+	for _, container := range pod.Containers {
+		for _, endpoint := range container.Endpoints {
+			portIndex[endpoint.Name] = len(endpoints)
+			endpoints = append(endpoints, podEndpoint{container.Name, endpoint.Name})
+			mApp.Container.PortMappings = append(mApp.Container.PortMappings,
+				marathonPort{ContainerPort: endpoint.ContainerPort, Name: endpoint.Name})
+		}
+	}
+
+	for _, container := range pod.Containers {
+		check := container.HealthCheck
+		switch {
+		case check == nil:
+		case check.Http != nil:
+			mApp.HealthChecks = append(mApp.HealthChecks,
+				marathonHealthCheck{Path: check.Http.Path, Protocol: "HTTP", PortIndex: portIndex[check.Http.Endpoint]})
+		case check.Tcp != nil:
+			mApp.HealthChecks = append(mApp.HealthChecks,
+				marathonHealthCheck{Protocol: "TCP", PortIndex: portIndex[check.Tcp.Endpoint]})
+		default:
+			mApp.HealthChecks = append(mApp.HealthChecks, marathonHealthCheck{Protocol: "COMMAND"})
+		}
+	}
+	return mApp, endpoints
+}
+
+// An instance is started once all its containers run, and killed as soon as
+// one of them is
+func podTask(podId string, pod marathonPod, endpoints []podEndpoint, instance marathonPodInstance) marathonTask {
+	task := marathonTask{
+		AppId: podId,
+		Id:    instance.Id,
+		Host:  instance.AgentHostname,
+		State: "TASK_RUNNING",
+	}
+
+	containers := map[string]marathonPodContainerStatus{}
+	running := len(instance.Containers) == len(pod.Containers)
+	for _, container := range instance.Containers {
+		containers[container.Name] = container
+		switch container.Status {
+		case "TASK_RUNNING":
+		case "TASK_KILLING":
+			task.State = "TASK_KILLING"
+		default:
+			running = false
+		}
+	}
+	if running {
+		task.StartedAt = instance.StatusSince
+		if task.StartedAt == "" {
+			task.StartedAt = "unknown"
+		}
+	}
+
+	// Host ports are only allocated in host and bridge networking
+	ports := make([]int, len(endpoints))
+	for i, endpoint := range endpoints {
+		for _, status := range containers[endpoint.container].Endpoints {
+			if status.Name == endpoint.name {
+				ports[i] = status.AllocatedHostPort
+			}
+		}
+		if ports[i] == 0 {
+			ports = nil
+			break
+		}
+	}
+	task.Ports = ports
+
+	for _, network := range instance.Networks {
+		for _, address := range network.Addresses {
+			task.IpAddresses = append(task.IpAddresses, marathonTaskIP{IpAddress: address})
+		}
+	}
+
+	for _, container := range pod.Containers {
+		if container.HealthCheck == nil {
+			continue
+		}
+		for _, condition := range containers[container.Name].Conditions {
+			if condition.Name == "healthy" {
+				task.HealthCheckResults = append(task.HealthCheckResults,
+					marathonHealthCheckResult{Alive: condition.Value == "true"})
+			}
+		}
+	}
+	return task
+}
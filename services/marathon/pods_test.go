@@ -0,0 +1,59 @@
+package marathon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+func TestPods(t *testing.T) {
+	Convey("#podApps", t, func() {
+		content, err := ioutil.ReadFile("testdata/pods.json")
+		So(err, ShouldBeNil)
+		var pods []marathonPodStatus
+		So(json.Unmarshal(content, &pods), ShouldBeNil)
+
+		state := &clusterState{stale: true}
+		state.reset(map[string]marathonApp{}, map[string]marathonTaskList{
+			// left by a status update of a pod container
+			"/shop/cart": {{AppId: "/shop/cart", Id: "shop_cart.instance-1.web", Host: "agent1", Ports: []int{31001}, StartedAt: "t0"}},
+		}, map[string]marathonPodStatus{pods[0].Id: pods[0], pods[1].Id: pods[1]})
+		apps, ok := state.appList(configuration.Marathon{}.ResyncDelay(), configuration.HealthPolicyNoChecksHealthy, "")
+		So(ok, ShouldBeTrue)
+		sort.Sort(apps)
+
+		Convey("pods should become apps with the endpoints of their environment", func() {
+			So(len(apps), ShouldEqual, 2)
+			cart := apps[0]
+			So(cart.Id, ShouldEqual, "shop/cart")
+			So(cart.CurVsn, ShouldEqual, "2")
+			So(cart.Labels["BAMBOO_STICKY"], ShouldEqual, "false")
+			So(cart.HealthCheckPath, ShouldEqual, "/health")
+			So(cart.Endpoints, ShouldResemble, []Endpoint{{SvcType: "pub", Protocol: "http", Uri: "/cart", Bind: 80, PortName: "web"}})
+		})
+
+		Convey("running and healthy instances should become tasks on their host ports", func() {
+			tasks := apps[0].Tasks
+			So(len(tasks), ShouldEqual, 1)
+			So(tasks[0].Id, ShouldEqual, "shop_cart.instance-1")
+			So(tasks[0].Host, ShouldEqual, "agent1")
+			So(tasks[0].Ports, ShouldResemble, []int{31000, 31001})
+			So(tasks[0].PortNames, ShouldResemble, []string{"metrics", "web"})
+			So(tasks[0].Version, ShouldEqual, "2")
+			So(tasks[0].State, ShouldEqual, TaskStateReady)
+		})
+
+		Convey("instances on container networks should be reached on their IP", func() {
+			tasks := apps[1].Tasks
+			So(len(tasks), ShouldEqual, 1)
+			So(tasks[0].Host, ShouldEqual, "10.0.2.7")
+			So(tasks[0].Ports, ShouldResemble, []int{9200})
+			So(tasks[0].State, ShouldEqual, TaskStateDrain)
+		})
+	})
+}
@@ -0,0 +1,213 @@
+package marathon
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+// Label picking the version order of an app, overriding
+// Marathon.VersionOrder
+const LabelVersionOrder = "BAMBOO_VERSION_ORDER"
+
+// Version orders, the primary version of an app is its oldest one
+const (
+	// Semantic versions like "v1.10.0-rc.1", other versions after them
+	VersionOrderSemver = "semver"
+	// Numbers like "10" or "2.5", other versions after them
+	VersionOrderNumeric = "numeric"
+	// When Marathon last changed the config of the app running the version
+	VersionOrderTimestamp = "timestamp"
+	// Plain string order, "v10" comes before "v9"
+	VersionOrderLexical = "lexical"
+)
+
+// VersionOrder tells whether version a of an app is older than version b
+type VersionOrder func(app App, a string, b string) bool
+
+var versionOrders = map[string]VersionOrder{
+	VersionOrderSemver:    semverLess,
+	VersionOrderNumeric:   numericLess,
+	VersionOrderTimestamp: timestampLess,
+	VersionOrderLexical:   lexicalLess,
+}
+var versionOrdersLock sync.Mutex
+
+func init() {
+	for name := range versionOrders {
+		configuration.AddVersionOrder(name)
+	}
+}
+
+// RegisterVersionOrder makes an order selectable by name in
+// Marathon.VersionOrder and the BAMBOO_VERSION_ORDER label. Register it
+// before loading the configuration, which rejects unknown orders.
+func RegisterVersionOrder(name string, order VersionOrder) {
+	versionOrdersLock.Lock()
+	defer versionOrdersLock.Unlock()
+	versionOrders[name] = order
+	configuration.AddVersionOrder(name)
+}
+
+// Picks the order of an app from its label, then the configured one, then
+// semver. Unknown orders are logged and skipped.
+func versionOrderOf(app App, configured string) (string, VersionOrder) {
+	versionOrdersLock.Lock()
+	defer versionOrdersLock.Unlock()
+
+	for _, name := range []string{app.Labels[LabelVersionOrder], configured} {
+		if name == "" {
+			continue
+		}
+		if order, ok := versionOrders[name]; ok {
+			return name, order
+		}
+		log.Printf("App %s: unknown version order %q\n", app.Id, name)
+	}
+	return VersionOrderSemver, versionOrders[VersionOrderSemver]
+}
+
+// Sorts the versions of an app oldest first, sets the order used and picks
+// the oldest version as the primary one
+func orderVersions(app *App, configured string) {
+	name, order := versionOrderOf(*app, configured)
+	sort.Stable(byVersionOrder{*app, order})
+	app.VersionOrder = name
+	if len(app.Versions) > 0 {
+		app.SetPrimary(app.Versions[0])
+	}
+}
+
+// SetPrimary makes a version the primary one of the app, whose endpoints
+// and service ports become the app's. It tells whether the app runs the
+// version, and leaves the app alone if it doesn't.
+func (app *App) SetPrimary(version string) bool {
+	if !app.HasVersion(version) {
+		return false
+	}
+	app.CurVsn = version
+	ports, ok := app.VersionPorts[version]
+	if !ok {
+		return true
+	}
+	if ports.Endpoints != nil {
+		app.Endpoints = ports.Endpoints
+	}
+	if len(ports.ServicePorts) > 0 {
+		app.ServicePort = ports.ServicePorts[0]
+		app.ServicePorts = ports.ServicePorts
+	}
+	return true
+}
+
+// HasVersion tells whether the app runs a version
+func (app App) HasVersion(version string) bool {
+	for _, v := range app.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts the Versions of an app, they share their backing array
+type byVersionOrder struct {
+	app   App
+	order VersionOrder
+}
+
+func (a byVersionOrder) Len() int {
+	return len(a.app.Versions)
+}
+func (a byVersionOrder) Swap(i, j int) {
+	a.app.Versions[i], a.app.Versions[j] = a.app.Versions[j], a.app.Versions[i]
+}
+func (a byVersionOrder) Less(i, j int) bool {
+	return a.order(a.app, a.app.Versions[i], a.app.Versions[j])
+}
+
+func lexicalLess(app App, a string, b string) bool {
+	return a < b
+}
+
+var semverPattern = regexp.MustCompile(`^[vV]?(\d+(?:\.\d+)*)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// Compares dot separated identifiers, numeric ones by value and before
+// alphanumeric ones
+func compareIdentifiers(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, errX := strconv.ParseUint(a[i], 10, 64)
+		y, errY := strconv.ParseUint(b[i], 10, 64)
+		switch {
+		case errX == nil && errY == nil && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		case errX == nil && errY != nil:
+			return -1
+		case errX != nil && errY == nil:
+			return 1
+		case errX != nil && errY != nil && a[i] != b[i]:
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+func semverLess(app App, a string, b string) bool {
+	matchA, matchB := semverPattern.FindStringSubmatch(a), semverPattern.FindStringSubmatch(b)
+	if matchA == nil || matchB == nil {
+		if matchA == nil && matchB == nil {
+			return a < b
+		}
+		return matchB == nil
+	}
+
+	if c := compareIdentifiers(strings.Split(matchA[1], "."), strings.Split(matchB[1], ".")); c != 0 {
+		return c < 0
+	}
+	// a pre-release comes before its release
+	preA, preB := matchA[2], matchB[2]
+	if preA == "" || preB == "" {
+		return preA != "" && preB == ""
+	}
+	return compareIdentifiers(strings.Split(preA, "."), strings.Split(preB, ".")) < 0
+}
+
+func numericLess(app App, a string, b string) bool {
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+	switch {
+	case errX == nil && errY == nil:
+		return x < y
+	case errX == nil || errY == nil:
+		return errX == nil
+	}
+	return a < b
+}
+
+// Versions without a known timestamp are ordered as semver after the
+// others
+func timestampLess(app App, a string, b string) bool {
+	x, errX := time.Parse(time.RFC3339Nano, app.VersionTimes[a])
+	y, errY := time.Parse(time.RFC3339Nano, app.VersionTimes[b])
+	switch {
+	case errX == nil && errY == nil && !x.Equal(y):
+		return x.Before(y)
+	case errX == nil && errY != nil:
+		return true
+	case errX != nil && errY == nil:
+		return false
+	}
+	return semverLess(app, a, b)
+}
@@ -0,0 +1,108 @@
+package marathon
+
+import (
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+func ordered(order string, app App, versions ...string) []string {
+	app.Versions = versions
+	orderVersions(&app, order)
+	return app.Versions
+}
+
+func TestVersionOrder(t *testing.T) {
+	Convey("#orderVersions", t, func() {
+		Convey("semver should compare numbers and put pre-releases first", func() {
+			So(ordered(VersionOrderSemver, App{}, "v10", "v9", "v1.10.0", "v1.2.0", "v1.10.0-rc.2", "v1.10.0-rc.10"),
+				ShouldResemble, []string{"v1.2.0", "v1.10.0-rc.2", "v1.10.0-rc.10", "v1.10.0", "v9", "v10"})
+		})
+
+		Convey("semver should put other versions last", func() {
+			So(ordered(VersionOrderSemver, App{}, "latest", "2", "canary"), ShouldResemble, []string{"2", "canary", "latest"})
+		})
+
+		Convey("numeric should compare values", func() {
+			So(ordered(VersionOrderNumeric, App{}, "10", "9.5", "x", "100"), ShouldResemble, []string{"9.5", "10", "100", "x"})
+		})
+
+		Convey("timestamp should follow the config changes of the Marathon apps", func() {
+			app := App{VersionTimes: map[string]string{
+				"blue":  "2016-03-02T10:00:00.000Z",
+				"green": "2016-03-01T10:00:00.000Z",
+			}}
+			So(ordered(VersionOrderTimestamp, app, "blue", "unknown", "green"), ShouldResemble, []string{"green", "blue", "unknown"})
+		})
+
+		Convey("lexical should keep the string order", func() {
+			So(ordered(VersionOrderLexical, App{}, "v9", "v10"), ShouldResemble, []string{"v10", "v9"})
+		})
+
+		Convey("should pick the oldest version as primary", func() {
+			app := App{Versions: []string{"v10", "v9"}}
+			orderVersions(&app, "")
+			So(app.CurVsn, ShouldEqual, "v9")
+			So(app.VersionOrder, ShouldEqual, VersionOrderSemver)
+		})
+
+		Convey("should let the label override the configured order", func() {
+			app := App{Versions: []string{"v10", "v9"}, Labels: map[string]string{LabelVersionOrder: VersionOrderLexical}}
+			orderVersions(&app, VersionOrderNumeric)
+			So(app.CurVsn, ShouldEqual, "v10")
+			So(app.VersionOrder, ShouldEqual, VersionOrderLexical)
+		})
+
+		Convey("should fall back on unknown orders", func() {
+			app := App{Versions: []string{"v10", "v9"}}
+			orderVersions(&app, "alphabetical")
+			So(app.VersionOrder, ShouldEqual, VersionOrderSemver)
+		})
+
+		Convey("should use registered orders", func() {
+			RegisterVersionOrder("newest-first", func(app App, a string, b string) bool {
+				return semverLess(app, b, a)
+			})
+			So(ordered("newest-first", App{}, "v9", "v10"), ShouldResemble, []string{"v10", "v9"})
+		})
+
+		Convey("should let the configuration name built-in and registered orders", func() {
+			config := configuration.Configuration{}
+			config.Marathon.VersionOrder = VersionOrderTimestamp
+			So(config.Validate(), ShouldBeNil)
+			config.Marathon.VersionOrder = "oldest-first"
+			So(config.Validate(), ShouldNotBeNil)
+			RegisterVersionOrder("oldest-first", semverLess)
+			So(config.Validate(), ShouldBeNil)
+		})
+	})
+
+	Convey("#createApps", t, func() {
+		mApp := func(id string, version string, bind string, changedAt string) marathonApp {
+			return marathonApp{
+				Id:          id,
+				Env:         map[string]string{"SRY_APP_ID": "/web", "SRY_APP_VSN": version, "BB_DM_ENDPOINTS": "pub:http:nil:" + bind},
+				VersionInfo: &marathonVersionInfo{LastConfigChangeAt: changedAt},
+			}
+		}
+		apps := map[string]marathonApp{
+			"/web-v9":  mApp("/web-v9", "v9", "80", "2016-03-02T10:00:00.000Z"),
+			"/web-v10": mApp("/web-v10", "v10", "8080", "2016-03-01T10:00:00.000Z"),
+		}
+
+		Convey("should take the primary version and its endpoints in the configured order", func() {
+			web := createApps(map[string]marathonTaskList{}, apps, configuration.HealthPolicyIgnore, "")[0]
+			So(web.CurVsn, ShouldEqual, "v9")
+			So(web.Versions, ShouldResemble, []string{"v9", "v10"})
+			So(web.Endpoints[0].Bind, ShouldEqual, 80)
+			So(web.VersionPorts["v10"].Endpoints[0].Bind, ShouldEqual, 8080)
+
+			web = createApps(map[string]marathonTaskList{}, apps, configuration.HealthPolicyIgnore, VersionOrderTimestamp)[0]
+			So(web.CurVsn, ShouldEqual, "v10")
+			So(web.VersionOrder, ShouldEqual, VersionOrderTimestamp)
+			So(web.Endpoints[0].Bind, ShouldEqual, 8080)
+		})
+	})
+}
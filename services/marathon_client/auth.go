@@ -0,0 +1,255 @@
+package marathon_client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+// Lifetime of the login token signed with an ACS service account key
+const acsLoginTokenLifetime = 5 * time.Minute
+
+// tokenSource provides the Authorization header of each request
+type tokenSource interface {
+	// Header returns the current header value, getting a token if needed
+	Header() (string, error)
+	// Refresh gets a new token after Marathon rejected the given header
+	Refresh(rejected string) (string, error)
+}
+
+func newTokenSource(conf configuration.Marathon, client *http.Client) (tokenSource, error) {
+	switch {
+	case conf.ACSLoginURL != "":
+		source := &acsToken{
+			client:   client,
+			loginURL: conf.ACSLoginURL,
+			uid:      conf.ACSUid,
+			password: conf.ACSPassword,
+		}
+		if conf.ACSPrivateKeyFile != "" {
+			key, err := readPrivateKey(conf.ACSPrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			source.privateKey = key
+		}
+		return source, nil
+	case conf.AuthTokenFile != "":
+		return &fileToken{path: conf.AuthTokenFile}, nil
+	case conf.AuthToken != "":
+		return staticToken("Bearer " + conf.AuthToken), nil
+	}
+	return nil, nil
+}
+
+type staticToken string
+
+func (t staticToken) Header() (string, error) {
+	return string(t), nil
+}
+
+func (t staticToken) Refresh(rejected string) (string, error) {
+	return "", errors.New("Marathon rejected the configured token")
+}
+
+// A bearer token kept in a file, e.g. by a sidecar renewing it
+type fileToken struct {
+	path   string
+	lock   sync.Mutex
+	header string
+}
+
+func (t *fileToken) Header() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.header != "" {
+		return t.header, nil
+	}
+	return t.read()
+}
+
+func (t *fileToken) Refresh(rejected string) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.header != rejected {
+		return t.header, nil
+	}
+	header, err := t.read()
+	if err == nil && header == rejected {
+		return "", errors.New("Marathon rejected the token in " + t.path)
+	}
+	return header, err
+}
+
+func (t *fileToken) read() (string, error) {
+	content, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return "", err
+	}
+	t.header = "Bearer " + strings.TrimSpace(string(content))
+	return t.header, nil
+}
+
+// A DC/OS ACS token, obtained by logging in with a password or a service
+// account key
+type acsToken struct {
+	client     *http.Client
+	loginURL   string
+	uid        string
+	password   string
+	privateKey *rsa.PrivateKey
+
+	lock   sync.Mutex
+	header string
+}
+
+type acsLogin struct {
+	Uid      string `json:"uid"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+type acsLoginResponse struct {
+	Token string `json:"token"`
+}
+
+func (t *acsToken) Header() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.header != "" {
+		return t.header, nil
+	}
+	return t.login()
+}
+
+func (t *acsToken) Refresh(rejected string) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// Another request already got a new token
+	if t.header != rejected && t.header != "" {
+		return t.header, nil
+	}
+	return t.login()
+}
+
+func (t *acsToken) login() (string, error) {
+	login := acsLogin{Uid: t.uid, Password: t.password}
+	if t.privateKey != nil {
+		token, err := signLoginToken(t.uid, t.privateKey, time.Now().Add(acsLoginTokenLifetime))
+		if err != nil {
+			return "", err
+		}
+		login = acsLogin{Uid: t.uid, Token: token}
+	}
+	body, _ := json.Marshal(login)
+
+	resp, err := t.client.Post(t.loginURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ACS login as %s failed: status %s: %s", t.uid, resp.Status, strings.TrimSpace(string(content)))
+	}
+
+	var loginResponse acsLoginResponse
+	err = json.Unmarshal(content, &loginResponse)
+	if err != nil {
+		return "", err
+	}
+	if loginResponse.Token == "" {
+		return "", fmt.Errorf("ACS login as %s returned no token", t.uid)
+	}
+	t.header = "token=" + loginResponse.Token
+	return t.header, nil
+}
+
+// Signs the RS256 JWT a DC/OS service account logs in with
+func signLoginToken(uid string, key *rsa.PrivateKey, expires time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{"uid": uid, "exp": expires.Unix()})
+	encoding := base64.RawURLEncoding
+	signed := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + encoding.EncodeToString(signature), nil
+}
+
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key %s: %s", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// Builds the TLS settings for HTTPS Marathon endpoints, nil if none are
+// configured
+func newTLSConfig(conf configuration.Marathon) (*tls.Config, error) {
+	if conf.CACertFile == "" && conf.ClientCertFile == "" && !conf.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CACertFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		content, err := ioutil.ReadFile(conf.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("No certificates found in %s", conf.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCertFile, conf.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,173 @@
+package marathon_client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+// A Marathon accepting only the Authorization header in valid, which the
+// test can change to revoke the current token
+func newAuthMarathon(valid *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != *valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v2/leader" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+}
+
+func TestTokenAuth(t *testing.T) {
+	Convey("#AuthTokenFile", t, func() {
+		valid := "Bearer first"
+		marathon := newAuthMarathon(&valid)
+		defer marathon.Close()
+
+		dir, _ := ioutil.TempDir("", "bamboo_token")
+		defer os.RemoveAll(dir)
+		tokenFile := filepath.Join(dir, "token")
+		ioutil.WriteFile(tokenFile, []byte("first\n"), 0600)
+
+		client, err := New(configuration.Marathon{Endpoint: marathon.URL, AuthTokenFile: tokenFile})
+		So(err, ShouldBeNil)
+		_, err = client.Get("/v2/apps")
+		So(err, ShouldBeNil)
+
+		Convey("When the token is renewed and Marathon rejects the old one", func() {
+			ioutil.WriteFile(tokenFile, []byte("second\n"), 0600)
+			valid = "Bearer second"
+			client.ForgetLeader()
+			_, err := client.Get("/v2/apps")
+
+			Convey("the file should be read again", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("#ACSLoginURL", t, func() {
+		logins := 0
+		var login acsLogin
+		acs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logins++
+			json.NewDecoder(r.Body).Decode(&login)
+			io.WriteString(w, `{"token":"acs-`+strconv.Itoa(logins)+`"}`)
+		}))
+		defer acs.Close()
+
+		valid := "token=acs-1"
+		marathon := newAuthMarathon(&valid)
+		defer marathon.Close()
+
+		client, err := New(configuration.Marathon{
+			Endpoint:    marathon.URL,
+			ACSLoginURL: acs.URL,
+			ACSUid:      "bamboo",
+			ACSPassword: "secret",
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When logging in with a password", func() {
+			_, err := client.Get("/v2/apps")
+
+			Convey("the token should be sent with each request", func() {
+				So(err, ShouldBeNil)
+				So(logins, ShouldEqual, 1)
+				So(login, ShouldResemble, acsLogin{Uid: "bamboo", Password: "secret"})
+			})
+		})
+
+		Convey("When the token expires", func() {
+			client.Get("/v2/apps")
+			valid = "token=acs-2"
+			client.ForgetLeader()
+			_, err := client.Get("/v2/apps")
+
+			Convey("it should log in again on 401", func() {
+				So(err, ShouldBeNil)
+				So(logins, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestSignLoginToken(t *testing.T) {
+	Convey("#signLoginToken", t, func() {
+		key, _ := rsa.GenerateKey(rand.Reader, 1024)
+		token, err := signLoginToken("bamboo", key, time.Unix(1500000000, 0))
+		So(err, ShouldBeNil)
+
+		parts := strings.Split(token, ".")
+		So(len(parts), ShouldEqual, 3)
+
+		Convey("should carry the uid and expiry", func() {
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			So(string(claims), ShouldEqual, `{"exp":1500000000,"uid":"bamboo"}`)
+		})
+
+		Convey("should be signed with RS256", func() {
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			So(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature), ShouldBeNil)
+		})
+	})
+}
+
+func TestTLS(t *testing.T) {
+	Convey("#CACertFile", t, func() {
+		marathon := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer marathon.Close()
+
+		dir, _ := ioutil.TempDir("", "bamboo_ca")
+		defer os.RemoveAll(dir)
+		caFile := filepath.Join(dir, "ca.pem")
+		ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: marathon.Certificate().Raw,
+		}), 0600)
+
+		Convey("should trust the given CA", func() {
+			client, err := New(configuration.Marathon{Endpoint: marathon.URL, CACertFile: caFile})
+			So(err, ShouldBeNil)
+			_, err = client.Leader()
+			So(err, ShouldBeNil)
+		})
+
+		Convey("should not trust the server without it", func() {
+			client, _ := New(configuration.Marathon{Endpoint: marathon.URL})
+			_, err := client.Leader()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("should fail on a file without certificates", func() {
+			ioutil.WriteFile(caFile, []byte("nothing"), 0600)
+			_, err := New(configuration.Marathon{Endpoint: marathon.URL, CACertFile: caFile})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,426 @@
+package marathon_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+const (
+	// How long a discovered leader is trusted before asking again
+	leaderCheckInterval = 30 * time.Second
+	// Attempts of a REST request, each one after a failure rediscovers the leader
+	maxAttempts = 4
+	minBackoff  = time.Second
+	maxBackoff  = 30 * time.Second
+)
+
+// Client talks to the Marathon leader. The leader is discovered through
+// /v2/leader on any configured endpoint, and discovered again when it fails
+// or every leaderCheckInterval.
+type Client struct {
+	Endpoints []string
+	User      string
+	Password  string
+	// Used for REST requests, its timeout applies to each request
+	HTTPClient *http.Client
+	// Used for the event stream, which stays open
+	StreamClient *http.Client
+
+	tokens     tokenSource
+	lock       sync.Mutex
+	leader     string
+	leaderTime time.Time
+	sleep      func(time.Duration)
+}
+
+// StatusError is a non-2xx answer of Marathon
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: status %s: %s", e.Method, e.Path, e.Status, e.Body)
+}
+
+type leaderResponse struct {
+	Leader string `json:"leader"`
+}
+
+type eventSubscriptions struct {
+	CallbackUrls []string `json:"callbackUrls"`
+}
+
+// Clients shared by every caller with the same Marathon configuration
+var shared = map[string]*Client{}
+var sharedLock sync.Mutex
+
+// New creates a client using the TLS and authentication settings of the
+// configuration: bearer or ACS tokens if set, basic auth otherwise
+func New(conf configuration.Marathon) (*Client, error) {
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+
+	client := &Client{
+		Endpoints:    conf.Endpoints(),
+		User:         conf.User,
+		Password:     conf.Password,
+		HTTPClient:   &http.Client{Timeout: conf.RequestDelay(), Transport: transport},
+		StreamClient: &http.Client{Transport: transport},
+		sleep:        time.Sleep,
+	}
+	client.tokens, err = newTokenSource(conf, client.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Shared returns the client of a Marathon configuration, creating it once
+func Shared(conf configuration.Marathon) (*Client, error) {
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+
+	key := conf.Endpoint + "\x00" + conf.User
+	client, ok := shared[key]
+	if !ok {
+		var err error
+		client, err = New(conf)
+		if err != nil {
+			return nil, err
+		}
+		shared[key] = client
+	}
+	return client, nil
+}
+
+// Backoff returns how long to wait before the given retry, doubling from
+// one second up to thirty
+func Backoff(attempt int) time.Duration {
+	delay := minBackoff
+	for i := 0; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Leader returns the base URL of the Marathon leader
+func (c *Client) Leader() (string, error) {
+	return c.leaderVia(c.HTTPClient)
+}
+
+func (c *Client) leaderVia(client *http.Client) (string, error) {
+	c.lock.Lock()
+	leader, leaderTime := c.leader, c.leaderTime
+	c.lock.Unlock()
+
+	if leader != "" && time.Since(leaderTime) < leaderCheckInterval {
+		return leader, nil
+	}
+	return c.refreshLeader(client)
+}
+
+// RefreshLeader asks the configured endpoints who the leader is now
+func (c *Client) RefreshLeader() (string, error) {
+	return c.refreshLeader(c.HTTPClient)
+}
+
+func (c *Client) refreshLeader(client *http.Client) (string, error) {
+	var err error
+	for _, endpoint := range c.Endpoints {
+		var leader string
+		leader, err = c.askLeader(client, endpoint)
+		if err != nil {
+			log.Printf("Unable to get the Marathon leader from %s: %s\n", endpoint, err)
+			continue
+		}
+
+		c.lock.Lock()
+		if leader != c.leader {
+			log.Println("Marathon leader is", leader)
+		}
+		c.leader, c.leaderTime = leader, time.Now()
+		c.lock.Unlock()
+		return leader, nil
+	}
+	return "", fmt.Errorf("No Marathon leader found: %s", err)
+}
+
+// ForgetLeader makes the next request discover the leader again
+func (c *Client) ForgetLeader() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.leader = ""
+}
+
+func (c *Client) askLeader(client *http.Client, endpoint string) (string, error) {
+	resp, err := c.send(client, "GET", endpoint+"/v2/leader", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Marathon versions without the endpoint, or without HA, act as leader
+	if resp.StatusCode == http.StatusNotFound {
+		return endpoint, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+
+	var leader leaderResponse
+	err = json.NewDecoder(resp.Body).Decode(&leader)
+	if err != nil {
+		return "", err
+	}
+	if leader.Leader == "" {
+		return "", fmt.Errorf("no leader elected")
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	// An endpoint with a path is a proxy, like the DC/OS admin router at
+	// https://master/service/marathon. It forwards to the leader, whose own
+	// address may not be reachable.
+	if strings.Trim(endpointURL.Path, "/") != "" {
+		return endpoint, nil
+	}
+	return endpointURL.Scheme + "://" + leader.Leader, nil
+}
+
+// Sends a request with the configured credentials. A token Marathon answers
+// 401 to is refreshed, and the request sent once more.
+func (c *Client) send(client *http.Client, method string, address string, header http.Header) (*http.Response, error) {
+	authorization := ""
+	if c.tokens != nil {
+		var err error
+		authorization, err = c.tokens.Header()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.sendWith(client, method, address, header, authorization)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.tokens == nil {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	authorization, err = c.tokens.Refresh(authorization)
+	if err != nil {
+		return nil, err
+	}
+	return c.sendWith(client, method, address, header, authorization)
+}
+
+func (c *Client) sendWith(client *http.Client, method string, address string, header http.Header, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(method, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	} else if len(c.User) > 0 && len(c.Password) > 0 {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	return client.Do(req)
+}
+
+// Do sends a request to the leader and returns the response body. Network
+// errors and 5xx answers are retried with backoff against a rediscovered
+// leader, other non-2xx answers are returned as StatusErrors.
+func (c *Client) Do(method string, path string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			c.ForgetLeader()
+			c.sleep(Backoff(attempt - 1))
+		}
+
+		var body []byte
+		var retry bool
+		body, retry, err = c.do(c.HTTPClient, method, path)
+		if err == nil || !retry {
+			return body, err
+		}
+		log.Printf("Marathon request %s %s failed: %s\n", method, path, err)
+	}
+	return nil, err
+}
+
+// Probe sends a single request to the leader and returns the response body.
+// Unlike Do it doesn't retry, and each request, leader discovery included,
+// is limited to timeout. Meant for health checks, which must answer quickly.
+func (c *Client) Probe(method string, path string, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout, Transport: c.HTTPClient.Transport}
+	body, _, err := c.do(client, method, path)
+	return body, err
+}
+
+func (c *Client) do(client *http.Client, method string, path string) (body []byte, retry bool, err error) {
+	leader, err := c.leaderVia(client)
+	if err != nil {
+		return nil, true, err
+	}
+	resp, err := c.send(client, method, leader+path, nil)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return body, resp.StatusCode >= 500, &StatusError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	return body, false, nil
+}
+
+func (c *Client) Get(path string) ([]byte, error) {
+	return c.Do("GET", path)
+}
+
+// Subscribe registers an HTTP callback for Marathon events
+func (c *Client) Subscribe(callbackURL string) error {
+	return subscribe(c.Do, callbackURL)
+}
+
+// Subscribed tells whether an HTTP callback is registered for Marathon events
+func (c *Client) Subscribed(callbackURL string) (bool, error) {
+	return subscribed(c.Do, callbackURL)
+}
+
+// ProbeSubscription registers an HTTP callback for Marathon events unless it
+// is already, with single requests limited to timeout like Probe
+func (c *Client) ProbeSubscription(callbackURL string, timeout time.Duration) error {
+	probe := func(method string, path string) ([]byte, error) {
+		return c.Probe(method, path, timeout)
+	}
+	registered, err := subscribed(probe, callbackURL)
+	if err != nil || registered {
+		return err
+	}
+	return subscribe(probe, callbackURL)
+}
+
+func subscribe(do func(method string, path string) ([]byte, error), callbackURL string) error {
+	body, err := do("POST", "/v2/eventSubscriptions?callbackUrl="+url.QueryEscape(callbackURL))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(string(body), "{\"message") {
+		return fmt.Errorf("Access to the callback system of Marathon seems to be failed, response: %s", body)
+	}
+	return nil
+}
+
+func subscribed(do func(method string, path string) ([]byte, error), callbackURL string) (bool, error) {
+	body, err := do("GET", "/v2/eventSubscriptions")
+	if err != nil {
+		return false, err
+	}
+	var subscriptions eventSubscriptions
+	err = json.Unmarshal(body, &subscriptions)
+	if err != nil {
+		return false, err
+	}
+	for _, subscribed := range subscriptions.CallbackUrls {
+		if subscribed == callbackURL {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// OpenEventStream connects to the event stream of the leader. The stream is
+// closed when the leader changes, so the caller reconnects to the new one.
+func (c *Client) OpenEventStream(lastEventID string) (io.ReadCloser, error) {
+	leader, err := c.Leader()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Accept": {"text/event-stream"}}
+	if lastEventID != "" {
+		header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := c.send(c.StreamClient, "GET", leader+"/v2/events", header)
+	if err != nil {
+		c.ForgetLeader()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		c.ForgetLeader()
+		return nil, fmt.Errorf("Marathon event stream: status %s", resp.Status)
+	}
+
+	stream := &leaderStream{ReadCloser: resp.Body, stop: make(chan struct{})}
+	go c.watchLeader(leader, stream)
+	return stream, nil
+}
+
+// An event stream that stops watching the leader once closed
+type leaderStream struct {
+	io.ReadCloser
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *leaderStream) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	return s.ReadCloser.Close()
+}
+
+// Closes the stream once the leader is no longer the given one
+func (c *Client) watchLeader(leader string, stream *leaderStream) {
+	ticker := time.NewTicker(leaderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.stop:
+			return
+		case <-ticker.C:
+			current, err := c.RefreshLeader()
+			if err == nil && current != leader {
+				log.Printf("Marathon leader moved from %s to %s, reconnecting\n", leader, current)
+				stream.Close()
+				return
+			}
+		}
+	}
+}
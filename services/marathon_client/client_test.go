@@ -0,0 +1,188 @@
+package marathon_client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/configuration"
+)
+
+// A fake Marathon node answering /v2/leader with the current leader and
+// other paths with its name, or with status while it is failing
+type fakeMarathon struct {
+	server *httptest.Server
+	name   string
+	leader *string
+	lock   sync.Mutex
+	status int
+	hits   int
+}
+
+func newFakeMarathon(name string, leader *string) *fakeMarathon {
+	m := &fakeMarathon{name: name, leader: leader, status: http.StatusOK}
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/leader" {
+			io.WriteString(w, `{"leader":"`+*m.leader+`"}`)
+			return
+		}
+		m.lock.Lock()
+		m.hits++
+		status := m.status
+		m.lock.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, m.name)
+	}))
+	return m
+}
+
+func (m *fakeMarathon) host() string {
+	return strings.TrimPrefix(m.server.URL, "http://")
+}
+
+func (m *fakeMarathon) setStatus(status int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.status = status
+}
+
+func (m *fakeMarathon) requests() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.hits
+}
+
+func TestClient(t *testing.T) {
+	Convey("#Client", t, func() {
+		var leader string
+		first := newFakeMarathon("first", &leader)
+		second := newFakeMarathon("second", &leader)
+		defer first.server.Close()
+		defer second.server.Close()
+		leader = second.host()
+
+		client, _ := New(configuration.Marathon{Endpoint: first.server.URL + "," + second.server.URL})
+		var slept []time.Duration
+		client.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+		Convey("When asking a follower", func() {
+			body, err := client.Get("/v2/tasks")
+
+			Convey("the request should go to the leader only", func() {
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "second")
+				So(first.requests(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the first endpoint is down", func() {
+			first.server.Close()
+			current, err := client.Leader()
+
+			Convey("the leader should be discovered through the next one", func() {
+				So(err, ShouldBeNil)
+				So(current, ShouldEqual, second.server.URL)
+			})
+		})
+
+		Convey("When the leader fails over", func() {
+			client.Get("/v2/tasks")
+			second.setStatus(http.StatusServiceUnavailable)
+			leader = first.host()
+			body, err := client.Get("/v2/tasks")
+
+			Convey("the request should be retried on the new leader after a backoff", func() {
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "first")
+				So(slept, ShouldResemble, []time.Duration{time.Second})
+			})
+		})
+
+		Convey("When the leader keeps failing", func() {
+			second.setStatus(http.StatusInternalServerError)
+			_, err := client.Get("/v2/tasks")
+
+			Convey("it should give up with growing backoffs", func() {
+				So(err, ShouldNotBeNil)
+				So(second.requests(), ShouldEqual, maxAttempts)
+				So(slept, ShouldResemble, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second})
+			})
+		})
+
+		Convey("When probing a failing leader", func() {
+			second.setStatus(http.StatusInternalServerError)
+			_, err := client.Probe("GET", "/ping", time.Second)
+
+			Convey("it should give up after a single attempt", func() {
+				So(err, ShouldNotBeNil)
+				So(second.requests(), ShouldEqual, 1)
+				So(slept, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the request is refused", func() {
+			second.setStatus(http.StatusUnauthorized)
+			_, err := client.Get("/v2/tasks")
+
+			Convey("it should not be retried", func() {
+				So(err, ShouldNotBeNil)
+				So(second.requests(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When opening the event stream", func() {
+			stream, err := client.OpenEventStream("")
+
+			Convey("it should connect to the leader", func() {
+				So(err, ShouldBeNil)
+				body, _ := ioutil.ReadAll(stream)
+				stream.Close()
+				So(string(body), ShouldEqual, "second")
+			})
+		})
+	})
+
+	Convey("#askLeader", t, func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+		client, _ := New(configuration.Marathon{Endpoint: server.URL})
+
+		Convey("should use the endpoint itself if Marathon has no /v2/leader", func() {
+			current, err := client.Leader()
+			So(err, ShouldBeNil)
+			So(current, ShouldEqual, server.URL)
+		})
+	})
+
+	Convey("#askLeader behind a proxy", t, func() {
+		var paths []string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			io.WriteString(w, `{"leader":"10.0.0.1:8080"}`)
+		}))
+		defer proxy.Close()
+		client, _ := New(configuration.Marathon{Endpoint: proxy.URL + "/service/marathon"})
+
+		Convey("should keep sending requests through the proxy", func() {
+			current, err := client.Leader()
+			So(err, ShouldBeNil)
+			So(current, ShouldEqual, proxy.URL+"/service/marathon")
+			So(paths, ShouldResemble, []string{"/service/marathon/v2/leader"})
+		})
+	})
+
+	Convey("#Backoff", t, func() {
+		Convey("should double up to thirty seconds", func() {
+			So(Backoff(0), ShouldEqual, time.Second)
+			So(Backoff(3), ShouldEqual, 8*time.Second)
+			So(Backoff(10), ShouldEqual, 30*time.Second)
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/QubitProducts/bamboo/configuration"
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+// Provider yields apps and their tasks for HAProxy to route to
+type Provider interface {
+	// Name identifies the provider in logs
+	Name() string
+	Apps() (marathon.AppList, error)
+}
+
+// Providers merged with Marathon, see Register
+var providers = []Provider{}
+var lock sync.Mutex
+
+// Register adds a provider whose apps are routed along with Marathon's
+func Register(provider Provider) {
+	lock.Lock()
+	defer lock.Unlock()
+	providers = append(providers, provider)
+}
+
+// Marathon provides the apps of the Marathon cluster
+type Marathon struct {
+	Conf *configuration.Configuration
+}
+
+func (m Marathon) Name() string {
+	return "marathon"
+}
+
+func (m Marathon) Apps() (marathon.AppList, error) {
+	return marathon.FetchApps(m.Conf.Marathon, m.Conf)
+}
+
+// Apps returns the apps of Marathon merged with those of the registered
+// providers
+func Apps(conf *configuration.Configuration) (marathon.AppList, error) {
+	lock.Lock()
+	all := append([]Provider{Marathon{conf}}, providers...)
+	lock.Unlock()
+	return Merge(all...)
+}
+
+// Merge returns the apps of all providers ordered by id. An app provided
+// more than once keeps the settings of the first provider and gets the
+// tasks of all of them, e.g. VMs serving next to Marathon tasks during a
+// migration. Any failing provider fails the merge.
+func Merge(providers ...Provider) (marathon.AppList, error) {
+	byId := map[string]int{}
+	merged := marathon.AppList{}
+	for _, provider := range providers {
+		apps, err := provider.Apps()
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			i, ok := byId[app.Id]
+			if !ok {
+				byId[app.Id] = len(merged)
+				merged = append(merged, app)
+				continue
+			}
+			if len(app.Endpoints) != len(merged[i].Endpoints) {
+				log.Printf("Ignoring the tasks of app %s from %s, its endpoints differ from the first provider's\n", app.Id, provider.Name())
+				continue
+			}
+			merged[i].Tasks = append(append([]marathon.Task{}, merged[i].Tasks...), app.Tasks...)
+			// the first provider keeps the primary version
+			for _, version := range app.Versions {
+				if !merged[i].HasVersion(version) {
+					merged[i].Versions = append(append([]string{}, merged[i].Versions...), version)
+				}
+			}
+		}
+	}
+	sort.Sort(merged)
+	return merged, nil
+}
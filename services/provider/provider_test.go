@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+type fakeProvider struct {
+	apps marathon.AppList
+	err  error
+}
+
+func (f fakeProvider) Name() string {
+	return "fake"
+}
+
+func (f fakeProvider) Apps() (marathon.AppList, error) {
+	return f.apps, f.err
+}
+
+func TestMerge(t *testing.T) {
+	Convey("#Merge", t, func() {
+		endpoints := []marathon.Endpoint{{SvcType: "pub", Protocol: "tcp", Bind: 5432}}
+		marathonApps := fakeProvider{apps: marathon.AppList{
+			{Id: "web", Labels: map[string]string{"BAMBOO_BALANCE": "source"}},
+			{Id: "db", Endpoints: endpoints, Tasks: []marathon.Task{{Host: "mesos1"}}, CurVsn: "10", Versions: []string{"10"}},
+		}}
+		staticApps := fakeProvider{apps: marathon.AppList{
+			{Id: "db", Endpoints: endpoints, Tasks: []marathon.Task{{Host: "vm1"}}, CurVsn: "9.6", Versions: []string{"9.6"}},
+			{Id: "legacy", Tasks: []marathon.Task{{Host: "vm2"}}},
+		}}
+
+		Convey("should order the apps of all providers by id", func() {
+			apps, err := Merge(marathonApps, staticApps)
+			So(err, ShouldBeNil)
+			So(len(apps), ShouldEqual, 3)
+			So(apps[0].Id, ShouldEqual, "db")
+			So(apps[1].Id, ShouldEqual, "legacy")
+			So(apps[2].Id, ShouldEqual, "web")
+		})
+
+		Convey("should add the tasks of apps provided twice to the first one", func() {
+			apps, _ := Merge(marathonApps, staticApps)
+			So(apps[0].Tasks, ShouldResemble, []marathon.Task{{Host: "mesos1"}, {Host: "vm1"}})
+			So(marathonApps.apps[1].Tasks, ShouldResemble, []marathon.Task{{Host: "mesos1"}})
+		})
+
+		Convey("should keep the primary version of the first one and add the other versions", func() {
+			apps, _ := Merge(marathonApps, staticApps)
+			So(apps[0].CurVsn, ShouldEqual, "10")
+			So(apps[0].Versions, ShouldResemble, []string{"10", "9.6"})
+			So(marathonApps.apps[1].Versions, ShouldResemble, []string{"10"})
+		})
+
+		Convey("should ignore the tasks of apps with other endpoints", func() {
+			other := fakeProvider{apps: marathon.AppList{{Id: "web", Endpoints: endpoints, Tasks: []marathon.Task{{Host: "vm3"}}}}}
+			apps, _ := Merge(marathonApps, other)
+			So(apps[1].Tasks, ShouldBeEmpty)
+			So(apps[1].Labels["BAMBOO_BALANCE"], ShouldEqual, "source")
+		})
+
+		Convey("should fail when a provider fails", func() {
+			_, err := Merge(marathonApps, fakeProvider{err: errors.New("unreachable")})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,241 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/samuel/go-zookeeper/zk"
+	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+// The backends listed in a static file or ZK node
+type staticBackends struct {
+	Apps []staticApp `json:"apps" yaml:"apps"`
+}
+
+type staticApp struct {
+	Id string `json:"id" yaml:"id"`
+	// Endpoints in the BB_DM_ENDPOINTS format
+	Endpoints string            `json:"endpoints" yaml:"endpoints"`
+	Version   string            `json:"version" yaml:"version"`
+	Labels    map[string]string `json:"labels" yaml:"labels"`
+	Env       map[string]string `json:"env" yaml:"env"`
+	Servers   []staticServer    `json:"servers" yaml:"servers"`
+}
+
+type staticServer struct {
+	Host      string   `json:"host" yaml:"host"`
+	Ports     []int    `json:"ports" yaml:"ports"`
+	PortNames []string `json:"portNames" yaml:"portNames"`
+	// One of the marathon.TaskState constants, defaults to ready
+	State string `json:"state" yaml:"state"`
+}
+
+var taskStates = map[string]bool{
+	marathon.TaskStateReady: true,
+	marathon.TaskStateDrain: true,
+	marathon.TaskStateMaint: true,
+}
+
+// Static provides backends listed in a file or ZK node, and calls OnChange
+// whenever they are reloaded. Content that fails to parse is logged and the
+// backends loaded before are kept.
+type Static struct {
+	source string
+	// Source the problems of the apps are reported as, each provider has
+	// its own so their reloads don't clear each other's
+	diagnosticsSource string
+	OnChange          func()
+
+	lock sync.Mutex
+	apps marathon.AppList
+}
+
+func (s *Static) Name() string {
+	return s.source
+}
+
+func (s *Static) Apps() (marathon.AppList, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.apps, nil
+}
+
+// Loads new content, reporting invalid apps to diagnostics. It fails when the
+// content can't be parsed at all.
+func (s *Static) load(content []byte) error {
+	backends, err := parseBackends(content)
+	if err != nil {
+		return fmt.Errorf("Invalid static backends in %s: %s", s.source, err)
+	}
+	apps, errors := staticApps(backends)
+	for appId, errs := range errors {
+		for _, err := range errs {
+			log.Printf("Skipping static app %s from %s: %s\n", appId, s.source, err)
+		}
+	}
+	diagnostics.Replace(s.diagnosticsSource, errors, true)
+
+	s.lock.Lock()
+	s.apps = apps
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Static) reload(content []byte) {
+	err := s.load(content)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("Reloaded static backends from", s.source)
+	if s.OnChange != nil {
+		s.OnChange()
+	}
+}
+
+// JSON objects are parsed as JSON for clearer errors, anything else as YAML
+func parseBackends(content []byte) (staticBackends, error) {
+	var backends staticBackends
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		err := json.Unmarshal(content, &backends)
+		return backends, err
+	}
+	err := yaml.UnmarshalStrict(content, &backends)
+	return backends, err
+}
+
+func staticApps(backends staticBackends) (marathon.AppList, map[string][]error) {
+	apps := marathon.AppList{}
+	errors := map[string][]error{}
+	for _, sApp := range backends.Apps {
+		id := strings.TrimPrefix(sApp.Id, "/")
+		if id == "" {
+			errors[sApp.Id] = append(errors[sApp.Id], fmt.Errorf("App without id"))
+			continue
+		}
+		endpoints, errs := marathon.ParseEndpoints(sApp.Endpoints)
+		if len(errs) > 0 {
+			errors[id] = errs
+			continue
+		}
+
+		app := marathon.App{
+			Id:        id,
+			Frontend:  strings.Replace(id, "/", "::", -1),
+			Env:       sApp.Env,
+			Labels:    sApp.Labels,
+			Endpoints: endpoints,
+			CurVsn:    sApp.Version,
+			Versions:  []string{sApp.Version},
+		}
+		for i, server := range sApp.Servers {
+			state := server.State
+			if state == "" {
+				state = marathon.TaskStateReady
+			}
+			if server.Host == "" || len(server.Ports) == 0 || !taskStates[state] {
+				errors[id] = append(errors[id], fmt.Errorf("Server %d needs a host, ports and a state of ready, drain or maint", i))
+				continue
+			}
+			app.Tasks = append(app.Tasks, marathon.Task{
+				Id:        fmt.Sprintf("%s.%s", id, server.Host),
+				Frontend:  app.Frontend,
+				Server:    fmt.Sprintf("%s-%s", app.Frontend, server.Host),
+				Host:      server.Host,
+				Port:      server.Ports[0],
+				Ports:     server.Ports,
+				PortNames: server.PortNames,
+				Version:   sApp.Version,
+				Weight:    1,
+				State:     state,
+			})
+		}
+		apps = append(apps, app)
+	}
+	return apps, errors
+}
+
+// WatchFile provides the backends listed in a file, checking it for changes
+// every interval
+func WatchFile(path string, interval time.Duration, onChange func()) (*Static, error) {
+	s := &Static{source: path, diagnosticsSource: diagnostics.SourceStaticFile, OnChange: onChange}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = s.load(content)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		modTime, size := info.ModTime(), info.Size()
+		for range time.Tick(interval) {
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Println("Unable to check static backends:", err)
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				log.Println("Unable to read static backends:", err)
+				continue
+			}
+			s.reload(content)
+		}
+	}()
+	return s, nil
+}
+
+// The part of the ZK connection watching a node
+type nodeWatcher interface {
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+}
+
+// WatchZK provides the backends listed in a ZK node, reloading them when the
+// node changes
+func WatchZK(conn nodeWatcher, path string, onChange func()) (*Static, error) {
+	s := &Static{source: "zk:" + path, diagnosticsSource: diagnostics.SourceStaticZK, OnChange: onChange}
+	content, _, events, err := conn.GetW(path)
+	if err != nil {
+		return nil, err
+	}
+	err = s.load(content)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			<-events
+			for {
+				content, _, events, err = conn.GetW(path)
+				if err == nil {
+					break
+				}
+				log.Printf("Unable to watch static backends at %s: %s\n", path, err)
+				time.Sleep(time.Second)
+			}
+			s.reload(content)
+		}
+	}()
+	return s, nil
+}
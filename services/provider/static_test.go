@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+
+	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/samuel/go-zookeeper/zk"
+	"github.com/QubitProducts/bamboo/services/diagnostics"
+	"github.com/QubitProducts/bamboo/services/marathon"
+)
+
+const staticYAML = `
+apps:
+  - id: /legacy/db
+    endpoints: inner:tcp:nil:5432
+    version: "9.6"
+    labels:
+      BAMBOO_BALANCE: source
+    servers:
+      - host: 10.0.0.5
+        ports: [5432]
+      - host: 10.0.0.6
+        ports: [5432]
+        state: drain
+  - id: broken
+    endpoints: inner:udp:nil:53
+`
+
+const staticJSON = `{"apps": [{"id": "vm", "endpoints": "pub:http:nil:80", "servers": [{"host": "vm1", "ports": [8080]}]}]}`
+
+// A ZK node whose content is replaced by set
+type fakeNode struct {
+	lock    sync.Mutex
+	content []byte
+	watch   chan zk.Event
+}
+
+func (n *fakeNode) GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.watch = make(chan zk.Event, 1)
+	return n.content, &zk.Stat{}, n.watch, nil
+}
+
+func (n *fakeNode) set(content string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.content = []byte(content)
+	n.watch <- zk.Event{Type: zk.EventNodeDataChanged}
+}
+
+func waitForChange(changes chan struct{}) bool {
+	select {
+	case <-changes:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func TestStatic(t *testing.T) {
+	Convey("#staticApps", t, func() {
+		backends, err := parseBackends([]byte(staticYAML))
+		So(err, ShouldBeNil)
+		apps, errors := staticApps(backends)
+
+		Convey("should form apps and tasks like Marathon's", func() {
+			So(len(apps), ShouldEqual, 1)
+			app := apps[0]
+			So(app.Id, ShouldEqual, "legacy/db")
+			So(app.Frontend, ShouldEqual, "legacy::db")
+			So(app.CurVsn, ShouldEqual, "9.6")
+			So(app.Endpoints, ShouldResemble, []marathon.Endpoint{{SvcType: "inner", Protocol: "tcp", Bind: 5432}})
+			So(app.Tasks[0], ShouldResemble, marathon.Task{
+				Id: "legacy/db.10.0.0.5", Frontend: "legacy::db", Server: "legacy::db-10.0.0.5",
+				Host: "10.0.0.5", Port: 5432, Ports: []int{5432}, Version: "9.6", Weight: 1, State: marathon.TaskStateReady,
+			})
+			So(app.Tasks[1].State, ShouldEqual, marathon.TaskStateDrain)
+		})
+
+		Convey("should leave invalid apps out", func() {
+			So(len(errors["broken"]), ShouldEqual, 1)
+		})
+
+		Convey("should reject unknown fields", func() {
+			_, err := parseBackends([]byte("apps:\n  - id: x\n    server: []\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("#WatchFile", t, func() {
+		dir, _ := ioutil.TempDir("", "static")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "backends.json")
+		ioutil.WriteFile(path, []byte(staticJSON), 0644)
+
+		changes := make(chan struct{}, 10)
+		static, err := WatchFile(path, 10*time.Millisecond, func() { changes <- struct{}{} })
+		So(err, ShouldBeNil)
+		apps, _ := static.Apps()
+		So(apps[0].Id, ShouldEqual, "vm")
+
+		Convey("it should reload the file when it changes", func() {
+			ioutil.WriteFile(path, []byte(staticYAML+"\n"), 0644)
+			So(waitForChange(changes), ShouldBeTrue)
+			apps, _ := static.Apps()
+			So(apps[0].Id, ShouldEqual, "legacy/db")
+			So(diagnostics.Counts()[diagnostics.SourceStaticFile], ShouldEqual, 1)
+		})
+
+		Convey("it should keep the apps when the file is broken", func() {
+			ioutil.WriteFile(path, []byte("{broken"), 0644)
+			time.Sleep(100 * time.Millisecond)
+			So(len(changes), ShouldEqual, 0)
+			apps, _ := static.Apps()
+			So(apps[0].Id, ShouldEqual, "vm")
+		})
+	})
+
+	Convey("#WatchZK", t, func() {
+		node := &fakeNode{content: []byte(staticJSON)}
+		changes := make(chan struct{}, 10)
+		static, err := WatchZK(node, "/bamboo/static", func() { changes <- struct{}{} })
+		So(err, ShouldBeNil)
+		So(static.Name(), ShouldEqual, "zk:/bamboo/static")
+
+		Convey("it should reload the node when it changes", func() {
+			node.set(staticYAML)
+			So(waitForChange(changes), ShouldBeTrue)
+			apps, _ := static.Apps()
+			So(apps[0].Id, ShouldEqual, "legacy/db")
+		})
+
+		Convey("its problems should not clear those of the file provider", func() {
+			diagnostics.Replace(diagnostics.SourceStaticFile, map[string][]error{"vm": {fmt.Errorf("invalid")}}, true)
+			node.set(staticYAML)
+			So(waitForChange(changes), ShouldBeTrue)
+			So(diagnostics.Counts()[diagnostics.SourceStaticZK], ShouldEqual, 1)
+			So(diagnostics.Counts()[diagnostics.SourceStaticFile], ShouldEqual, 1)
+			diagnostics.Replace(diagnostics.SourceStaticFile, nil, true)
+		})
+	})
+}
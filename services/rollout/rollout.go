@@ -0,0 +1,258 @@
+package rollout
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/QubitProducts/bamboo/services/application"
+)
+
+var (
+	//ErrNotFound unknown rollout
+	ErrNotFound = errors.New("Rollout not found")
+	//ErrConflict the rollout changed since it was read
+	ErrConflict = errors.New("Rollout changed concurrently")
+)
+
+// States of a rollout
+const (
+	StateRunning = "running"
+	StatePaused  = "paused"
+	StateAborted = "aborted"
+	StateDone    = "done"
+)
+
+// Rollout moves the traffic of an app from its baseline version to a new
+// version step by step
+type Rollout struct {
+	// App id, as in application.Weight
+	ID string `json:"id"`
+	// Version rolled out
+	Version string `json:"version"`
+	// Version replaced, gets the traffic Version doesn't
+	Baseline string `json:"baseline"`
+	// Weight of Version at each step, out of 100 shared with Baseline
+	Steps []int `json:"steps"`
+	// Seconds spent at each step before moving to the next one
+	Dwell int `json:"dwell"`
+
+	State string `json:"state"`
+	// Index in Steps of the current step
+	Step          int       `json:"step"`
+	StepStartedAt time.Time `json:"stepStartedAt"`
+	PausedAt      time.Time `json:"pausedAt"`
+	// Why the rollout was aborted
+	Reason string `json:"reason,omitempty"`
+
+	// Storage version the rollout was read at, see Storage.Update
+	revision int32
+}
+
+// Storage keeps the rollouts
+type Storage interface {
+	All() ([]Rollout, error)
+	Get(id string) (Rollout, error)
+	// Upsert creates or replaces a rollout
+	Upsert(rollout Rollout) error
+	// Update replaces a rollout unless it changed since it was read,
+	// ErrConflict otherwise
+	Update(rollout Rollout) error
+	Delete(id string) error
+}
+
+// New returns a rollout starting its first step now
+func New(id string, version string, baseline string, steps []int, dwell int) (Rollout, error) {
+	r := Rollout{
+		ID:            id,
+		Version:       version,
+		Baseline:      baseline,
+		Steps:         steps,
+		Dwell:         dwell,
+		State:         StateRunning,
+		StepStartedAt: time.Now(),
+	}
+	return r, r.validate()
+}
+
+func (r Rollout) validate() error {
+	switch {
+	case r.ID == "":
+		return errors.New("A rollout needs an app id")
+	case r.Version == "" || r.Baseline == "":
+		return errors.New("A rollout needs a version and a baseline version")
+	case r.Version == r.Baseline:
+		return errors.New("The version and the baseline version of a rollout must differ")
+	case len(r.Steps) == 0:
+		return errors.New("A rollout needs at least one step")
+	case r.Dwell < 0:
+		return errors.New("The dwell time of a rollout can't be negative")
+	}
+	previous := 0
+	for _, step := range r.Steps {
+		if step < previous || step > 100 {
+			return fmt.Errorf("Rollout steps must rise from 0 to at most 100, got %v", r.Steps)
+		}
+		previous = step
+	}
+	if previous != 100 {
+		return fmt.Errorf("The last rollout step must be 100, got %v", r.Steps)
+	}
+	return nil
+}
+
+// Active tells whether the rollout still owns the weights of its app
+func (r Rollout) Active() bool {
+	return r.State == StateRunning || r.State == StatePaused
+}
+
+// Percent returns the share of the traffic Version gets
+func (r Rollout) Percent() int {
+	if r.State == StateAborted {
+		return 0
+	}
+	return r.Steps[r.Step]
+}
+
+// Weight returns the stored weight of the app with the versions of the
+// current step. Its routing rules, primary version and aborted canaries are
+// kept.
+func (r Rollout) Weight(stored application.Weight) application.Weight {
+	percent := r.Percent()
+	weight := stored
+	weight.ID = r.ID
+	weight.Versions = map[string]int{r.Version: percent, r.Baseline: 100 - percent}
+	return weight
+}
+
+// NextStepAt returns when the rollout moves on, zero if it doesn't
+func (r Rollout) NextStepAt() time.Time {
+	if r.State != StateRunning {
+		return time.Time{}
+	}
+	return r.StepStartedAt.Add(time.Duration(r.Dwell) * time.Second)
+}
+
+// Moves to the next step, or finishes after the last one
+func (r *Rollout) advance(now time.Time) {
+	if r.Step == len(r.Steps)-1 {
+		r.State = StateDone
+		return
+	}
+	r.Step++
+	r.StepStartedAt = now
+}
+
+func (r *Rollout) pause(now time.Time) error {
+	if r.State != StateRunning {
+		return fmt.Errorf("Rollout %s is %s, only running rollouts can be paused", r.ID, r.State)
+	}
+	r.State = StatePaused
+	r.PausedAt = now
+	return nil
+}
+
+// The time spent paused doesn't count towards the dwell time
+func (r *Rollout) resume(now time.Time) error {
+	if r.State != StatePaused {
+		return fmt.Errorf("Rollout %s is %s, only paused rollouts can be resumed", r.ID, r.State)
+	}
+	r.State = StateRunning
+	r.StepStartedAt = r.StepStartedAt.Add(now.Sub(r.PausedAt))
+	r.PausedAt = time.Time{}
+	return nil
+}
+
+func (r *Rollout) abort(reason string) error {
+	if !r.Active() {
+		return fmt.Errorf("Rollout %s is already %s", r.ID, r.State)
+	}
+	r.State = StateAborted
+	r.Reason = reason
+	return nil
+}
+
+// Attempts of a read-modify-write before giving up on conflicts
+const maxUpdateAttempts = 3
+
+// Applies change to the stored rollout, reading it again on conflicts
+func modify(rollouts Storage, id string, change func(r *Rollout) error) (Rollout, error) {
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var r Rollout
+		r, err = rollouts.Get(id)
+		if err != nil {
+			return r, err
+		}
+		err = change(&r)
+		if err != nil {
+			return r, err
+		}
+		err = rollouts.Update(r)
+		if err != ErrConflict {
+			return r, err
+		}
+	}
+	return Rollout{}, err
+}
+
+// Start stores a new rollout and sets the weights of its first step. It
+// fails if the app already has an active rollout.
+func Start(rollouts Storage, weights application.Storage, r Rollout) error {
+	current, err := rollouts.Get(r.ID)
+	if err == nil && current.Active() {
+		return fmt.Errorf("Rollout of %s %s is already %s", current.ID, current.Version, current.State)
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	err = rollouts.Upsert(r)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rollout of %s %s started at %d%%\n", r.ID, r.Version, r.Percent())
+	return setWeight(weights, r)
+}
+
+// Pause stops a rollout at its current step
+func Pause(rollouts Storage, id string) (Rollout, error) {
+	return modify(rollouts, id, func(r *Rollout) error {
+		return r.pause(time.Now())
+	})
+}
+
+// Resume continues a paused rollout where it stopped
+func Resume(rollouts Storage, id string) (Rollout, error) {
+	return modify(rollouts, id, func(r *Rollout) error {
+		return r.resume(time.Now())
+	})
+}
+
+// Abort stops a rollout and sends all the traffic back to the baseline
+// version
+func Abort(rollouts Storage, weights application.Storage, id string, reason string) (Rollout, error) {
+	r, err := modify(rollouts, id, func(r *Rollout) error {
+		return r.abort(reason)
+	})
+	if err != nil {
+		return r, err
+	}
+	log.Printf("Rollout of %s %s aborted: %s\n", r.ID, r.Version, reason)
+	return r, setWeight(weights, r)
+}
+
+// Sets the weights of the current step on the stored weight of the app
+func setWeight(weights application.Storage, r Rollout) error {
+	all, err := weights.All()
+	if err != nil {
+		return err
+	}
+	stored := application.Weight{}
+	for _, weight := range all {
+		if weight.ID == r.ID {
+			stored = weight
+		}
+	}
+	return weights.Upsert(r.Weight(stored))
+}
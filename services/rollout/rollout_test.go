@@ -0,0 +1,246 @@
+package rollout
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+	"github.com/QubitProducts/bamboo/services/application"
+)
+
+// Keeps rollouts in memory, with revisions like ZooKeeper versions
+type memoryRollouts struct {
+	rollouts map[string]Rollout
+	// Rollouts changed behind the reader's back before the next Update
+	conflicts int
+}
+
+func newMemoryRollouts() *memoryRollouts {
+	return &memoryRollouts{rollouts: map[string]Rollout{}}
+}
+
+func (m *memoryRollouts) All() ([]Rollout, error) {
+	all := []Rollout{}
+	for _, r := range m.rollouts {
+		all = append(all, r)
+	}
+	return all, nil
+}
+
+func (m *memoryRollouts) Get(id string) (Rollout, error) {
+	r, ok := m.rollouts[id]
+	if !ok {
+		return r, ErrNotFound
+	}
+	return r, nil
+}
+
+func (m *memoryRollouts) Upsert(r Rollout) error {
+	r.revision = m.rollouts[r.ID].revision + 1
+	m.rollouts[r.ID] = r
+	return nil
+}
+
+func (m *memoryRollouts) Update(r Rollout) error {
+	stored, ok := m.rollouts[r.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if m.conflicts > 0 {
+		m.conflicts--
+		stored.revision++
+		m.rollouts[r.ID] = stored
+	}
+	if stored.revision != r.revision {
+		return ErrConflict
+	}
+	return m.Upsert(r)
+}
+
+func (m *memoryRollouts) Delete(id string) error {
+	delete(m.rollouts, id)
+	return nil
+}
+
+type memoryWeights map[string]application.Weight
+
+func (m memoryWeights) All() ([]application.Weight, error) {
+	all := []application.Weight{}
+	for _, weight := range m {
+		all = append(all, weight)
+	}
+	return all, nil
+}
+
+func (m memoryWeights) Upsert(weight application.Weight) error {
+	m[weight.ID] = weight
+	return nil
+}
+
+func (m memoryWeights) Delete(id string) error {
+	delete(m, id)
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	Convey("#New", t, func() {
+		Convey("should start at the first step", func() {
+			r, err := New("/app", "v2", "v1", []int{10, 50, 100}, 60)
+			So(err, ShouldBeNil)
+			So(r.State, ShouldEqual, StateRunning)
+			So(r.Percent(), ShouldEqual, 10)
+			So(r.Weight(application.Weight{}).Versions, ShouldResemble, map[string]int{"v2": 10, "v1": 90})
+		})
+
+		Convey("should reject steps that fall or exceed 100", func() {
+			_, err := New("/app", "v2", "v1", []int{50, 10}, 60)
+			So(err, ShouldNotBeNil)
+			_, err = New("/app", "v2", "v1", []int{150}, 60)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("should reject steps that don't end at 100", func() {
+			_, err := New("/app", "v2", "v1", []int{10, 50}, 60)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("should reject a rollout of the baseline", func() {
+			_, err := New("/app", "v1", "v1", []int{10}, 60)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestScheduler(t *testing.T) {
+	Convey("#Tick", t, func() {
+		rollouts := newMemoryRollouts()
+		weights := memoryWeights{}
+		start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+		now := start
+		scheduler := &Scheduler{Rollouts: rollouts, Weights: weights, now: func() time.Time { return now }}
+
+		r, _ := New("/app", "v2", "v1", []int{10, 50, 100}, 60)
+		r.StepStartedAt = start
+		So(Start(rollouts, weights, r), ShouldBeNil)
+
+		Convey("should wait for the dwell time", func() {
+			now = start.Add(59 * time.Second)
+			So(scheduler.Tick(), ShouldBeNil)
+			So(rollouts.rollouts["/app"].Step, ShouldEqual, 0)
+			So(weights["/app"].Versions["v2"], ShouldEqual, 10)
+		})
+
+		Convey("should advance and set the weights of the next step", func() {
+			now = start.Add(60 * time.Second)
+			So(scheduler.Tick(), ShouldBeNil)
+			So(rollouts.rollouts["/app"].Step, ShouldEqual, 1)
+			So(rollouts.rollouts["/app"].StepStartedAt, ShouldResemble, now)
+			So(weights["/app"].Versions, ShouldResemble, map[string]int{"v2": 50, "v1": 50})
+		})
+
+		Convey("should finish after the dwell time of the last step", func() {
+			for i := 1; i <= 3; i++ {
+				now = start.Add(time.Duration(i*60) * time.Second)
+				So(scheduler.Tick(), ShouldBeNil)
+			}
+			So(rollouts.rollouts["/app"].State, ShouldEqual, StateDone)
+			So(weights["/app"].Versions, ShouldResemble, map[string]int{"v2": 100, "v1": 0})
+		})
+
+		Convey("should leave the step to another instance on conflicts", func() {
+			rollouts.conflicts = 1
+			now = start.Add(60 * time.Second)
+			So(scheduler.Tick(), ShouldBeNil)
+			So(rollouts.rollouts["/app"].Step, ShouldEqual, 0)
+		})
+
+		Convey("should put back weights changed by hand", func() {
+			weights.Upsert(application.Weight{ID: "/app", Versions: map[string]int{"v2": 100}})
+			So(scheduler.Tick(), ShouldBeNil)
+			So(weights["/app"].Versions, ShouldResemble, map[string]int{"v2": 10, "v1": 90})
+		})
+
+		Convey("should keep the rules, primary version and aborted canaries of the app", func() {
+			rules := []application.Rule{{Version: "v2", Header: "X-Canary", Value: "1"}}
+			weight := weights["/app"]
+			weight.Rules = rules
+			weight.Primary = "v1"
+			weight.Aborted = map[string]string{"v0": "errors"}
+			weights.Upsert(weight)
+
+			now = start.Add(60 * time.Second)
+			So(scheduler.Tick(), ShouldBeNil)
+			So(weights["/app"].Versions, ShouldResemble, map[string]int{"v2": 50, "v1": 50})
+			So(weights["/app"].Rules, ShouldResemble, rules)
+			So(weights["/app"].Primary, ShouldEqual, "v1")
+			So(weights["/app"].Aborted, ShouldResemble, map[string]string{"v0": "errors"})
+		})
+
+		Convey("should not advance paused rollouts", func() {
+			_, err := Pause(rollouts, "/app")
+			So(err, ShouldBeNil)
+			now = start.Add(time.Hour)
+			So(scheduler.Tick(), ShouldBeNil)
+			So(rollouts.rollouts["/app"].Step, ShouldEqual, 0)
+		})
+
+		Convey("should refuse a second active rollout", func() {
+			other, _ := New("/app", "v3", "v1", []int{10, 100}, 60)
+			So(Start(rollouts, weights, other), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestStateChanges(t *testing.T) {
+	Convey("#Pause #Resume #Abort", t, func() {
+		rollouts := newMemoryRollouts()
+		weights := memoryWeights{}
+		rules := []application.Rule{{Version: "v2", Cookie: "canary", Value: "1"}}
+		weights.Upsert(application.Weight{ID: "/app", Rules: rules})
+		r, _ := New("/app", "v2", "v1", []int{20, 100}, 60)
+		So(Start(rollouts, weights, r), ShouldBeNil)
+		So(weights["/app"].Rules, ShouldResemble, rules)
+
+		Convey("resuming should not count the paused time", func() {
+			paused := time.Now()
+			r := rollouts.rollouts["/app"]
+			So(r.pause(paused), ShouldBeNil)
+			So(r.resume(paused.Add(time.Minute)), ShouldBeNil)
+			So(r.State, ShouldEqual, StateRunning)
+			So(r.NextStepAt(), ShouldResemble, rollouts.rollouts["/app"].NextStepAt().Add(time.Minute))
+		})
+
+		Convey("only paused rollouts should resume", func() {
+			_, err := Resume(rollouts, "/app")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("pausing should retry on conflicts", func() {
+			rollouts.conflicts = 1
+			paused, err := Pause(rollouts, "/app")
+			So(err, ShouldBeNil)
+			So(paused.State, ShouldEqual, StatePaused)
+		})
+
+		Convey("aborting should send all the traffic to the baseline", func() {
+			aborted, err := Abort(rollouts, weights, "/app", "errors")
+			So(err, ShouldBeNil)
+			So(aborted.State, ShouldEqual, StateAborted)
+			So(aborted.Reason, ShouldEqual, "errors")
+			So(weights["/app"].Versions, ShouldResemble, map[string]int{"v2": 0, "v1": 100})
+			So(weights["/app"].Rules, ShouldResemble, rules)
+
+			Convey("and be final", func() {
+				_, err := Resume(rollouts, "/app")
+				So(err, ShouldNotBeNil)
+				_, err = Abort(rollouts, weights, "/app", "again")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("unknown rollouts should not be found", func() {
+			_, err := Pause(rollouts, "/other")
+			So(err, ShouldEqual, ErrNotFound)
+		})
+	})
+}
@@ -0,0 +1,95 @@
+package rollout
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/QubitProducts/bamboo/services/application"
+)
+
+// How often the scheduler checks the rollouts
+const checkInterval = 5 * time.Second
+
+// Scheduler moves running rollouts through their steps. Every Bamboo
+// instance runs one, rollouts are updated with Storage.Update so a step is
+// only taken once.
+type Scheduler struct {
+	Rollouts Storage
+	Weights  application.Storage
+
+	now func() time.Time
+}
+
+// Run checks the rollouts until stop is closed
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := s.Tick()
+			if err != nil {
+				log.Println("Unable to check rollouts:", err)
+			}
+		}
+	}
+}
+
+// Tick takes the steps that are due, and puts back the weights of running
+// rollouts when they were changed by hand
+func (s *Scheduler) Tick() error {
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+
+	rollouts, err := s.Rollouts.All()
+	if err != nil {
+		return err
+	}
+	weights, err := s.Weights.All()
+	if err != nil {
+		return err
+	}
+	byId := make(map[string]application.Weight, len(weights))
+	for _, weight := range weights {
+		byId[weight.ID] = weight
+	}
+
+	for _, r := range rollouts {
+		if r.State != StateRunning {
+			continue
+		}
+		if !now.Before(r.NextStepAt()) {
+			r.advance(now)
+			err = s.Rollouts.Update(r)
+			if err == ErrConflict {
+				// another instance took the step
+				continue
+			}
+			if err != nil {
+				log.Printf("Unable to move rollout of %s to its next step: %s\n", r.ID, err)
+				continue
+			}
+			if r.State == StateDone {
+				log.Printf("Rollout of %s %s done\n", r.ID, r.Version)
+				continue
+			}
+			log.Printf("Rollout of %s %s at step %d: %d%%\n", r.ID, r.Version, r.Step+1, r.Percent())
+		}
+
+		current, ok := byId[r.ID]
+		weight := r.Weight(current)
+		if ok && reflect.DeepEqual(current, weight) {
+			continue
+		}
+		err = s.Weights.Upsert(weight)
+		if err != nil {
+			log.Printf("Unable to set the weights of rollout %s: %s\n", r.ID, err)
+		}
+	}
+	return nil
+}
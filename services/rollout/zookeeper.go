@@ -0,0 +1,126 @@
+package rollout
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/samuel/go-zookeeper/zk"
+	conf "github.com/QubitProducts/bamboo/configuration"
+)
+
+// ZKStorage keeps the rollouts under <Zookeeper.Path>/rollouts, next to
+// the weights
+type ZKStorage struct {
+	conn *zk.Conn
+	path string
+	acl  []zk.ACL
+}
+
+func NewZKStorage(conn *zk.Conn, conf conf.Zookeeper) (s *ZKStorage, err error) {
+	s = &ZKStorage{
+		conn: conn,
+		path: fmt.Sprintf("%s/%s", conf.Path, "rollouts"),
+		acl:  []zk.ACL{zk.ACL{Perms: zk.PermAll, Scheme: "world", ID: "anyone"}},
+	}
+	err = s.ensurePathExists()
+	return s, err
+}
+
+func (z *ZKStorage) All() ([]Rollout, error) {
+	keys, _, err := z.conn.Children(z.path)
+	if err != nil {
+		return nil, err
+	}
+
+	rollouts := make([]Rollout, 0, len(keys))
+	for _, key := range keys {
+		id, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, err
+		}
+		r, err := z.Get(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read rollout %s: %s\n", id, err)
+			continue
+		}
+		rollouts = append(rollouts, r)
+	}
+	return rollouts, nil
+}
+
+func (z *ZKStorage) Get(id string) (Rollout, error) {
+	var r Rollout
+	body, stat, err := z.conn.Get(z.rolloutPath(id))
+	if err == zk.ErrNoNode {
+		return r, ErrNotFound
+	}
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return r, err
+	}
+	r.ID = id
+	r.revision = stat.Version
+	return r, nil
+}
+
+func (z *ZKStorage) Upsert(r Rollout) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	path := z.rolloutPath(r.ID)
+	_, err = z.conn.Create(path, body, 0, z.acl)
+	if err == zk.ErrNodeExists {
+		_, err = z.conn.Set(path, body, -1)
+	}
+	return err
+}
+
+func (z *ZKStorage) Update(r Rollout) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = z.conn.Set(z.rolloutPath(r.ID), body, r.revision)
+	switch err {
+	case zk.ErrBadVersion:
+		return ErrConflict
+	case zk.ErrNoNode:
+		return ErrNotFound
+	}
+	return err
+}
+
+func (z *ZKStorage) Delete(id string) error {
+	err := z.conn.Delete(z.rolloutPath(id), -1)
+	if err == zk.ErrNoNode {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (z *ZKStorage) rolloutPath(id string) string {
+	return z.path + "/" + url.QueryEscape(id)
+}
+
+func (z *ZKStorage) ensurePathExists() error {
+	pathExists, _, _ := z.conn.Exists(z.path)
+	if pathExists {
+		return nil
+	}
+
+	log.Print("Creating base zk path", z.path)
+	_, err := z.conn.Create(z.path, []byte{}, 0, z.acl)
+	if err != nil {
+		log.Print("Failed to create base zk path", err)
+	}
+	return err
+}
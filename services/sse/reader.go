@@ -0,0 +1,112 @@
+package sse
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a server-sent event
+type Event struct {
+	// Last event ID seen on the stream, carried over from earlier events
+	ID string
+	// Event name, "message" if the server didn't set one
+	Type string
+	// Data lines joined by "\n"
+	Data string
+}
+
+// Reader parses a text/event-stream as described in the HTML Living
+// Standard, "Server-sent events"
+type Reader struct {
+	reader *bufio.Reader
+	lastID string
+	// Reconnection time sent by the server in a "retry:" field, 0 if none
+	Retry time.Duration
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(r)}
+}
+
+// LastEventID returns the ID to resume from after a reconnect
+func (r *Reader) LastEventID() string {
+	return r.lastID
+}
+
+// Next returns the next event. Comments, used as heartbeats, and blocks
+// without data are skipped. It returns io.EOF once the stream ends, an
+// event not terminated by a blank line is discarded.
+func (r *Reader) Next() (Event, error) {
+	var eventType string
+	var data []string
+	hasData := false
+
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return Event{}, err
+		}
+
+		if line == "" {
+			if !hasData {
+				eventType = ""
+				continue
+			}
+			if eventType == "" {
+				eventType = "message"
+			}
+			return Event{ID: r.lastID, Type: eventType, Data: strings.Join(data, "\n")}, nil
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], line[i+1:]
+			value = strings.TrimPrefix(value, " ")
+		}
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data = append(data, value)
+			hasData = true
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				r.lastID = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				r.Retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// Reads a line ended by "\r\n", "\n" or "\r"
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '\n':
+			return string(line), nil
+		case '\r':
+			next, err := r.reader.Peek(1)
+			if err == nil && next[0] == '\n' {
+				r.reader.ReadByte()
+			}
+			return string(line), nil
+		}
+		line = append(line, b)
+	}
+}
@@ -0,0 +1,194 @@
+package sse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/QubitProducts/bamboo/Godeps/_workspace/src/github.com/smartystreets/goconvey/convey"
+)
+
+func TestReader(t *testing.T) {
+	Convey("#Reader", t, func() {
+		reader := NewReader(strings.NewReader(
+			": heartbeat\n\n" +
+				"event: status_update_event\r\n" +
+				"id: 7\r\n" +
+				"data: {\"a\":\r\n" +
+				"data:1}\r\n\r\n" +
+				"retry: 2500\n" +
+				"data: plain\n\n" +
+				"event: ignored_without_data\n\n" +
+				"data: unterminated"))
+
+		Convey("should join multi-line data and keep the event name and id", func() {
+			event, err := reader.Next()
+			So(err, ShouldBeNil)
+			So(event, ShouldResemble, Event{ID: "7", Type: "status_update_event", Data: "{\"a\":\n1}"})
+		})
+
+		Convey("should default the event name and carry the last id over", func() {
+			reader.Next()
+			event, err := reader.Next()
+			So(err, ShouldBeNil)
+			So(event, ShouldResemble, Event{ID: "7", Type: "message", Data: "plain"})
+			So(reader.Retry, ShouldEqual, 2500*time.Millisecond)
+		})
+
+		Convey("should drop blocks without data and unterminated events", func() {
+			reader.Next()
+			reader.Next()
+			_, err := reader.Next()
+			So(err, ShouldEqual, io.EOF)
+			So(reader.LastEventID(), ShouldEqual, "7")
+		})
+	})
+}
+
+// An SSE server running one handler per connection, in order
+type fakeEventServer struct {
+	server      *httptest.Server
+	lock        sync.Mutex
+	connections int
+	lastIDs     []string
+	handlers    []func(w http.ResponseWriter, r *http.Request)
+}
+
+func newFakeEventServer(handlers ...func(w http.ResponseWriter, r *http.Request)) *fakeEventServer {
+	s := &fakeEventServer{handlers: handlers}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		i := s.connections
+		s.connections++
+		s.lastIDs = append(s.lastIDs, r.Header.Get("Last-Event-ID"))
+		s.lock.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if i < len(s.handlers) {
+			s.handlers[i](w, r)
+		}
+	}))
+	return s
+}
+
+func (s *fakeEventServer) connect(lastEventID string) (io.ReadCloser, error) {
+	req, _ := http.NewRequest("GET", s.server.URL, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *fakeEventServer) receivedIDs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.lastIDs...)
+}
+
+func send(w http.ResponseWriter, format string, args ...interface{}) {
+	fmt.Fprintf(w, format, args...)
+	w.(http.Flusher).Flush()
+}
+
+func TestStream(t *testing.T) {
+	Convey("#Stream", t, func() {
+		stop := make(chan struct{})
+		var lock sync.Mutex
+		var events []Event
+		var delays []time.Duration
+		reconnects := 0
+
+		stream := &Stream{
+			IdleTimeout: 100 * time.Millisecond,
+			OnEvent: func(event Event) {
+				lock.Lock()
+				defer lock.Unlock()
+				events = append(events, event)
+			},
+			OnReconnect: func() {
+				lock.Lock()
+				defer lock.Unlock()
+				reconnects++
+			},
+			sleep: func(d time.Duration) {
+				lock.Lock()
+				defer lock.Unlock()
+				delays = append(delays, d)
+			},
+			random: func() float64 { return 0.5 },
+		}
+
+		Convey("When the server closes the stream and then goes idle", func() {
+			server := newFakeEventServer(
+				func(w http.ResponseWriter, r *http.Request) {
+					send(w, "id: 1\nevent: first\ndata: a\n\n")
+				},
+				func(w http.ResponseWriter, r *http.Request) {
+					send(w, ": heartbeat\n\n")
+					<-stop
+				},
+				func(w http.ResponseWriter, r *http.Request) {
+					send(w, "id: 2\ndata: b\n\n")
+					close(stop)
+				},
+			)
+			defer server.server.Close()
+			stream.Connect = server.connect
+
+			done := make(chan struct{})
+			go func() {
+				stream.Run(stop)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+			}
+
+			Convey("it should reconnect resuming from the last event id", func() {
+				So(server.receivedIDs(), ShouldResemble, []string{"", "1", "1"})
+			})
+
+			Convey("it should deliver every event", func() {
+				lock.Lock()
+				defer lock.Unlock()
+				So(len(events), ShouldBeGreaterThanOrEqualTo, 1)
+				So(events[0], ShouldResemble, Event{ID: "1", Type: "first", Data: "a"})
+			})
+
+			Convey("it should report reconnects and back off with jitter", func() {
+				lock.Lock()
+				defer lock.Unlock()
+				So(reconnects, ShouldEqual, 2)
+				// attempt 0 after the first event, attempt 1 after the idle stream
+				So(delays[:2], ShouldResemble, []time.Duration{750 * time.Millisecond, 1500 * time.Millisecond})
+			})
+		})
+	})
+
+	Convey("#reconnectDelay", t, func() {
+		stream := &Stream{MinReconnect: time.Second, MaxReconnect: 8 * time.Second}
+
+		Convey("should stay between half and all of the doubled delay", func() {
+			So(stream.reconnectDelay(2, 0, func() float64 { return 0 }), ShouldEqual, 2*time.Second)
+			So(stream.reconnectDelay(2, 0, func() float64 { return 0.999999 }), ShouldAlmostEqual, 4*time.Second, float64(time.Millisecond))
+		})
+
+		Convey("should be capped", func() {
+			So(stream.reconnectDelay(10, 0, func() float64 { return 0 }), ShouldEqual, 4*time.Second)
+		})
+
+		Convey("should start from the server's retry time", func() {
+			So(stream.reconnectDelay(0, 500*time.Millisecond, func() float64 { return 0 }), ShouldEqual, 250*time.Millisecond)
+		})
+	})
+}
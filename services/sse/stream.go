@@ -0,0 +1,212 @@
+package sse
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrIdleTimeout ends a stream that sent nothing, not even a heartbeat,
+	// for longer than its idle timeout
+	ErrIdleTimeout = errors.New("Event stream idle timeout")
+)
+
+const (
+	defaultMinReconnect = time.Second
+	defaultMaxReconnect = 30 * time.Second
+)
+
+// Stream keeps an event stream open, reconnecting when it ends
+type Stream struct {
+	// Connect opens the stream, sending lastEventID as the Last-Event-ID
+	// header if it isn't empty
+	Connect func(lastEventID string) (io.ReadCloser, error)
+	// Reconnects once nothing was received for that long, 0 disables it
+	IdleTimeout time.Duration
+	// Reconnect delays double from MinReconnect up to MaxReconnect and are
+	// jittered down to half of that. They start over once an event arrived
+	MinReconnect time.Duration
+	MaxReconnect time.Duration
+
+	// OnEvent gets each event
+	OnEvent func(Event)
+	// OnError gets failed connections and streams ending with an error
+	OnError func(error)
+	// OnReconnect is called once the stream is open again after it ended
+	OnReconnect func()
+
+	sleep  func(time.Duration)
+	random func() float64
+}
+
+// Run reads the stream until stop is closed
+func (s *Stream) Run(stop <-chan struct{}) {
+	sleep, random := s.sleep, s.random
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	if random == nil {
+		random = rand.Float64
+	}
+
+	lastID := ""
+	var retry time.Duration
+	attempt := 0
+	connected := false
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		body, err := s.Connect(lastID)
+		if err != nil {
+			s.error(err)
+			sleep(s.reconnectDelay(attempt, retry, random))
+			attempt++
+			continue
+		}
+		if connected && s.OnReconnect != nil {
+			s.OnReconnect()
+		}
+		connected = true
+
+		reader, received, err := s.read(body, lastID, stop)
+		if reader.LastEventID() != "" {
+			lastID = reader.LastEventID()
+		}
+		if reader.Retry > 0 {
+			retry = reader.Retry
+		}
+		if err != nil && err != io.EOF {
+			s.error(err)
+		}
+		if received {
+			attempt = 0
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		sleep(s.reconnectDelay(attempt, retry, random))
+		attempt++
+	}
+}
+
+func (s *Stream) error(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+// Reads events until the stream ends, it is idle or stop is closed
+func (s *Stream) read(body io.ReadCloser, lastID string, stop <-chan struct{}) (reader *Reader, received bool, err error) {
+	idle := newIdleReader(body, s.IdleTimeout)
+	defer idle.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			idle.Close()
+		case <-done:
+		}
+	}()
+
+	reader = NewReader(idle)
+	reader.lastID = lastID
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			if idle.timedOut() {
+				err = ErrIdleTimeout
+			}
+			return reader, received, err
+		}
+		received = true
+		if s.OnEvent != nil {
+			s.OnEvent(event)
+		}
+	}
+}
+
+// The server's retry time replaces MinReconnect as the base delay
+func (s *Stream) reconnectDelay(attempt int, retry time.Duration, random func() float64) time.Duration {
+	delay, max := s.MinReconnect, s.MaxReconnect
+	if delay <= 0 {
+		delay = defaultMinReconnect
+	}
+	if retry > 0 {
+		delay = retry
+	}
+	if max <= 0 {
+		max = defaultMaxReconnect
+	}
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(random()*float64(delay/2))
+}
+
+// Closes the underlying stream when no bytes arrived within the timeout
+type idleReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	lock    sync.Mutex
+	idle    bool
+	closed  bool
+}
+
+func newIdleReader(body io.ReadCloser, timeout time.Duration) *idleReader {
+	r := &idleReader{body: body, timeout: timeout}
+	if timeout > 0 {
+		r.timer = time.AfterFunc(timeout, func() {
+			r.lock.Lock()
+			r.idle = true
+			r.lock.Unlock()
+			r.Close()
+		})
+	}
+	return r
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.timer != nil {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleReader) timedOut() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.idle
+}
+
+func (r *idleReader) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.lock.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	return r.body.Close()
+}